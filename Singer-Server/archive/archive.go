@@ -0,0 +1,312 @@
+package archive
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avast/retry-go/v4"
+	"github.com/google/uuid"
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/statistics"
+	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMaxRows       = 100000
+	defaultFlushInterval = 300
+	defaultBufferSize    = 1000
+
+	uploadAttempts = 3
+	uploadDelay    = 5 * time.Second
+
+	dateLayout = "2006-01-02"
+	hourLayout = "15"
+)
+
+// batch is a copy of the rows of one insert
+type batch struct {
+	task string
+	dims []*model.ColumnWithType
+	rows [][]interface{}
+	at   time.Time
+}
+
+// object is the open object of a task and hour
+type object struct {
+	task   string
+	key    string
+	dims   []*model.ColumnWithType
+	enc    encoder
+	opened time.Time
+}
+
+type archiver struct {
+	cfg     *config.ArchiveConfig
+	store   Store
+	ch      chan *batch
+	objects map[string]*object
+	wg      sync.WaitGroup
+}
+
+var (
+	mux sync.RWMutex
+	a   *archiver
+)
+
+// Init (re)creates the archiver as configured by cfg.Archive. A running archiver uploads its open objects once it
+// has been swapped out, so that Enabled and Submit don't wait for that.
+func Init(cfg *config.Config) (err error) {
+	var next *archiver
+	if cfg.Archive != nil {
+		next, err = newArchiver(cfg.Archive)
+	}
+	swap(next)
+	return
+}
+
+func newArchiver(arCfg *config.ArchiveConfig) (ar *archiver, err error) {
+	if _, ok := formats[arCfg.Format]; !ok {
+		return nil, errors.Newf("unknown archive format %s", arCfg.Format)
+	}
+	var store Store
+	if store, err = NewStore(arCfg); err != nil {
+		return
+	}
+	ar = &archiver{
+		cfg:     arCfg,
+		store:   store,
+		ch:      make(chan *batch, withDefault(arCfg.BufferSize, defaultBufferSize)),
+		objects: make(map[string]*object),
+	}
+	ar.wg.Add(1)
+	go ar.run()
+	util.Logger.Info("started archiver", zap.String("type", arCfg.Type), zap.String("format", arCfg.Format))
+	return
+}
+
+// Close uploads the open objects and stops the archiver.
+func Close() {
+	swap(nil)
+}
+
+// swap replaces the archiver, then closes the old one outside of the lock, as that drains and uploads with retries.
+func swap(next *archiver) {
+	mux.Lock()
+	old := a
+	a = next
+	mux.Unlock()
+	if old != nil {
+		old.close()
+	}
+}
+
+// Enabled tells whether rows are archived, so callers can skip preparing them.
+func Enabled() bool {
+	mux.RLock()
+	defer mux.RUnlock()
+	return a != nil
+}
+
+// Submit queues rows which have been written to ClickHouse, dims describes their values. The rows are copied, so
+// the caller may reuse them, and grouped by the hour of their event time. Submit never blocks, the rows are dropped
+// if the queue is full.
+func Submit(task string, dims []*model.ColumnWithType, rows model.Rows, skip func(i int) bool) {
+	mux.RLock()
+	defer mux.RUnlock()
+	if a == nil {
+		return
+	}
+	idxTime := timeColumn(dims, a.cfg.TimeColumn)
+	now := time.Now().UTC()
+	batches := make(map[time.Time]*batch)
+	for i, row := range rows {
+		if skip != nil && skip(i) {
+			continue
+		}
+		at := now
+		if idxTime >= 0 {
+			if t, ok := (*row)[idxTime].(time.Time); ok {
+				at = t.UTC()
+			}
+		}
+		hour := at.Truncate(time.Hour)
+		b, ok := batches[hour]
+		if !ok {
+			b = &batch{task: task, dims: dims, at: at}
+			batches[hour] = b
+		}
+		b.rows = append(b.rows, append([]interface{}(nil), (*row)[:len(dims)]...))
+	}
+	for _, b := range batches {
+		select {
+		case a.ch <- b:
+		default:
+			statistics.ArchiveDroppedRowsTotal.WithLabelValues(task).Add(float64(len(b.rows)))
+		}
+	}
+}
+
+// timeColumn returns the index of the event time column, -1 if there is none.
+func timeColumn(dims []*model.ColumnWithType, name string) int {
+	for i, dim := range dims {
+		if dim.Type.Type != model.DateTime || dim.Type.Array {
+			continue
+		}
+		if name == "" || dim.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (a *archiver) run() {
+	defer a.wg.Done()
+	interval := time.Duration(withDefault(a.cfg.FlushInterval, defaultFlushInterval)) * time.Second
+	ticker := time.NewTicker(interval / 10)
+	defer ticker.Stop()
+	maxRows := withDefault(a.cfg.MaxRows, defaultMaxRows)
+	for {
+		select {
+		case b, ok := <-a.ch:
+			if !ok {
+				for key, obj := range a.objects {
+					a.upload(key, obj)
+				}
+				return
+			}
+			a.append(b, maxRows)
+		case <-ticker.C:
+			now := time.Now()
+			for key, obj := range a.objects {
+				if now.Sub(obj.opened) >= interval {
+					a.upload(key, obj)
+				}
+			}
+		}
+	}
+}
+
+func (a *archiver) append(b *batch, maxRows int) {
+	key := fmt.Sprintf("%s/date=%s/hour=%s", b.task, b.at.Format(dateLayout), b.at.Format(hourLayout))
+	obj, ok := a.objects[key]
+	// a schema change starts a new object
+	if ok && !sameDims(obj.dims, b.dims) {
+		a.upload(key, obj)
+		ok = false
+	}
+	if !ok {
+		enc, ext, err := newEncoder(a.cfg.Format, b.dims)
+		if err != nil {
+			util.Logger.Error("failed to create archive encoder", zap.String("task", b.task), zap.Error(err))
+			statistics.ArchiveErrorsTotal.WithLabelValues(b.task).Inc()
+			statistics.ArchiveDroppedRowsTotal.WithLabelValues(b.task).Add(float64(len(b.rows)))
+			return
+		}
+		obj = &object{
+			task:   b.task,
+			key:    fmt.Sprintf("%s/%d-%s.%s", key, time.Now().UnixNano(), uuid.New().String()[:8], ext),
+			dims:   b.dims,
+			enc:    enc,
+			opened: time.Now(),
+		}
+		if a.cfg.Prefix != "" {
+			obj.key = a.cfg.Prefix + "/" + obj.key
+		}
+		a.objects[key] = obj
+	}
+	for _, row := range b.rows {
+		if err := obj.enc.Append(row); err != nil {
+			util.Logger.Warn("failed to archive row", zap.String("task", b.task), zap.Error(err))
+			statistics.ArchiveDroppedRowsTotal.WithLabelValues(b.task).Inc()
+		}
+	}
+	if obj.enc.Rows() >= maxRows {
+		a.upload(key, obj)
+	}
+}
+
+func (a *archiver) upload(key string, obj *object) {
+	delete(a.objects, key)
+	task := obj.task
+	rows := obj.enc.Rows()
+	data, err := obj.enc.Close()
+	if err == nil && rows != 0 {
+		err = retry.Do(
+			func() error { return a.store.Put(obj.key, data) },
+			retry.LastErrorOnly(true),
+			retry.Attempts(uploadAttempts),
+			retry.Delay(uploadDelay),
+		)
+	}
+	if err != nil {
+		util.Logger.Error("failed to archive object", zap.String("key", obj.key), zap.Int("rows", rows), zap.Error(err))
+		statistics.ArchiveErrorsTotal.WithLabelValues(task).Inc()
+		statistics.ArchiveDroppedRowsTotal.WithLabelValues(task).Add(float64(rows))
+		return
+	}
+	if rows != 0 {
+		util.Logger.Debug("archived object", zap.String("key", obj.key), zap.Int("rows", rows), zap.Int("bytes", len(data)))
+		statistics.ArchivedObjectsTotal.WithLabelValues(task).Inc()
+		statistics.ArchivedRowsTotal.WithLabelValues(task).Add(float64(rows))
+	}
+}
+
+func (a *archiver) close() {
+	close(a.ch)
+	a.wg.Wait()
+}
+
+// ListObjects returns the keys of the objects of task whose rows fall in the hours overlapping [from, to), in order.
+func ListObjects(store Store, arCfg *config.ArchiveConfig, task string, from, to time.Time) (keys []string, err error) {
+	from, to = from.UTC().Truncate(time.Hour), to.UTC()
+	for day := from.Truncate(24 * time.Hour); day.Before(to); day = day.Add(24 * time.Hour) {
+		prefix := fmt.Sprintf("%s/date=%s/", task, day.Format(dateLayout))
+		if arCfg.Prefix != "" {
+			prefix = arCfg.Prefix + "/" + prefix
+		}
+		var dayKeys []string
+		if dayKeys, err = store.List(prefix); err != nil {
+			return
+		}
+		for _, key := range dayKeys {
+			// <prefix>hour=HH/<id>.<ext>
+			hour, ok := strings.CutPrefix(key[len(prefix):], "hour=")
+			if !ok || len(hour) < 3 || hour[2] != '/' {
+				continue
+			}
+			h, e := strconv.Atoi(hour[:2])
+			if e != nil {
+				continue
+			}
+			if t := day.Add(time.Duration(h) * time.Hour); !t.Before(from) && t.Before(to) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return
+}
+
+func sameDims(d1, d2 []*model.ColumnWithType) bool {
+	if len(d1) != len(d2) {
+		return false
+	}
+	for i := range d1 {
+		if d1[i].Name != d2[i].Name || d1[i].Type.Type != d2[i].Type.Type {
+			return false
+		}
+	}
+	return true
+}
+
+func withDefault(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,453 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/v14/arrow"
+	"github.com/apache/arrow/go/v14/arrow/array"
+	"github.com/apache/arrow/go/v14/arrow/memory"
+	"github.com/apache/arrow/go/v14/parquet/file"
+	"github.com/apache/arrow/go/v14/parquet/pqarrow"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/klauspost/compress/zstd"
+	"github.com/shopspring/decimal"
+	"github.com/thanos-io/thanos/pkg/errors"
+)
+
+// Decode reads an archived object and returns its rows laid out as dims, with values of the types the ClickHouse
+// driver expects. Columns missing from the object get their default value, rows which can't be converted are
+// skipped and counted.
+func Decode(key string, data []byte, dims []*model.ColumnWithType) (rows model.Rows, skipped int, err error) {
+	var cols []string
+	var records [][]interface{}
+	switch {
+	case strings.HasSuffix(key, ".ndjson.zst"):
+		cols, records, err = decodeNDJSON(data)
+	case strings.HasSuffix(key, ".parquet"):
+		cols, records, err = decodeParquet(data)
+	default:
+		err = errors.Newf("unknown archive format of %s", key)
+	}
+	if err != nil {
+		return
+	}
+
+	idx := make([]int, len(dims))
+	for i, dim := range dims {
+		idx[i] = -1
+		for j, col := range cols {
+			if col == dim.Name {
+				idx[i] = j
+				break
+			}
+		}
+	}
+	rows = make(model.Rows, 0, len(records))
+RECORDS:
+	for _, rec := range records {
+		row := make(model.Row, len(dims))
+		for i, dim := range dims {
+			var v interface{}
+			if idx[i] >= 0 && idx[i] < len(rec) {
+				v = rec[idx[i]]
+			}
+			var e error
+			if row[i], e = columnValue(dim.Type, v); e != nil {
+				skipped++
+				continue RECORDS
+			}
+		}
+		rows = append(rows, &row)
+	}
+	return
+}
+
+// decodeNDJSON returns the columns in order of appearance, a record may be shorter than them.
+func decodeNDJSON(data []byte) (cols []string, records [][]interface{}, err error) {
+	var zr *zstd.Decoder
+	if zr, err = zstd.NewReader(bytes.NewReader(data)); err != nil {
+		return nil, nil, errors.Wrapf(err, "")
+	}
+	defer zr.Close()
+	dec := json.NewDecoder(bufio.NewReader(zr))
+	dec.UseNumber()
+	colIdx := make(map[string]int)
+	for {
+		var obj map[string]interface{}
+		if err = dec.Decode(&obj); err != nil {
+			if err == io.EOF {
+				return cols, records, nil
+			}
+			return nil, nil, errors.Wrapf(err, "")
+		}
+		rec := make([]interface{}, len(cols))
+		for k, v := range obj {
+			i, ok := colIdx[k]
+			if !ok {
+				i = len(cols)
+				colIdx[k] = i
+				cols = append(cols, k)
+				rec = append(rec, nil)
+			}
+			rec[i] = v
+		}
+		records = append(records, rec)
+	}
+}
+
+func decodeParquet(data []byte) (cols []string, records [][]interface{}, err error) {
+	var rdr *file.Reader
+	if rdr, err = file.NewParquetReader(bytes.NewReader(data)); err != nil {
+		return nil, nil, errors.Wrapf(err, "")
+	}
+	defer rdr.Close()
+	var fr *pqarrow.FileReader
+	if fr, err = pqarrow.NewFileReader(rdr, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator); err != nil {
+		return nil, nil, errors.Wrapf(err, "")
+	}
+	var tbl arrow.Table
+	if tbl, err = fr.ReadTable(context.Background()); err != nil {
+		return nil, nil, errors.Wrapf(err, "")
+	}
+	defer tbl.Release()
+
+	records = make([][]interface{}, tbl.NumRows())
+	for i := range records {
+		records[i] = make([]interface{}, tbl.NumCols())
+	}
+	for j := 0; j < int(tbl.NumCols()); j++ {
+		col := tbl.Column(j)
+		cols = append(cols, col.Name())
+		var r int
+		for _, chunk := range col.Data().Chunks() {
+			for i := 0; i < chunk.Len(); i++ {
+				records[r][j] = arrowValue(chunk, i)
+				r++
+			}
+		}
+	}
+	return
+}
+
+// arrowValue returns the value at i as int64, uint64, float64, bool, string, time.Time, []interface{} for lists,
+// []mapEntry for maps, or nil.
+func arrowValue(arr arrow.Array, i int) interface{} {
+	if arr.IsNull(i) {
+		return nil
+	}
+	switch a := arr.(type) {
+	case *array.Map:
+		begin, end := a.ValueOffsets(i)
+		entries := make([]mapEntry, 0, end-begin)
+		for k := int(begin); k < int(end); k++ {
+			entries = append(entries, mapEntry{key: arrowValue(a.Keys(), k), value: arrowValue(a.Items(), k)})
+		}
+		return entries
+	case *array.List:
+		begin, end := a.ValueOffsets(i)
+		elems := make([]interface{}, 0, end-begin)
+		for k := int(begin); k < int(end); k++ {
+			elems = append(elems, arrowValue(a.ListValues(), k))
+		}
+		return elems
+	case *array.Boolean:
+		return a.Value(i)
+	case *array.Int8:
+		return int64(a.Value(i))
+	case *array.Int16:
+		return int64(a.Value(i))
+	case *array.Int32:
+		return int64(a.Value(i))
+	case *array.Int64:
+		return a.Value(i)
+	case *array.Uint8:
+		return uint64(a.Value(i))
+	case *array.Uint16:
+		return uint64(a.Value(i))
+	case *array.Uint32:
+		return uint64(a.Value(i))
+	case *array.Uint64:
+		return a.Value(i)
+	case *array.Float32:
+		return float64(a.Value(i))
+	case *array.Float64:
+		return a.Value(i)
+	case *array.String:
+		return a.Value(i)
+	case *array.Binary:
+		return string(a.Value(i))
+	case *array.Timestamp:
+		return a.Value(i).ToTime(a.DataType().(*arrow.TimestampType).Unit)
+	}
+	return arr.ValueStr(i)
+}
+
+// columnValue converts a decoded value to the type of a column. Nil is null, or the default of a column which
+// isn't Nullable.
+func columnValue(ti *model.TypeInfo, v interface{}) (interface{}, error) {
+	if ti.Array {
+		elemTi := *ti
+		elemTi.Array = false
+		if v == nil {
+			return reflect.MakeSlice(reflect.SliceOf(elemType(&elemTi)), 0, 0).Interface(), nil
+		}
+		elems, ok := v.([]interface{})
+		if !ok {
+			return nil, errors.Newf("%T is not an array", v)
+		}
+		arr := reflect.MakeSlice(reflect.SliceOf(elemType(&elemTi)), len(elems), len(elems))
+		for i, e := range elems {
+			ev, err := columnValue(&elemTi, e)
+			if err != nil {
+				return nil, err
+			}
+			if ev == nil {
+				continue
+			}
+			if elemTi.Nullable && elemTi.Type != model.Map {
+				p := reflect.New(reflect.TypeOf(ev))
+				p.Elem().Set(reflect.ValueOf(ev))
+				arr.Index(i).Set(p)
+			} else {
+				arr.Index(i).Set(reflect.ValueOf(ev))
+			}
+		}
+		return arr.Interface(), nil
+	}
+	if ti.Type == model.Map {
+		m := model.NewOrderedMap()
+		add := func(k, v interface{}) (err error) {
+			var kv, vv interface{}
+			if kv, err = columnValue(ti.MapKey, k); err != nil {
+				return
+			}
+			if vv, err = columnValue(ti.MapValue, v); err != nil {
+				return
+			}
+			m.Put(kv, vv)
+			return
+		}
+		switch v := v.(type) {
+		case nil:
+		case []mapEntry:
+			for _, e := range v {
+				if err := add(e.key, e.value); err != nil {
+					return nil, err
+				}
+			}
+		case map[string]interface{}:
+			for k, val := range v {
+				if err := add(k, val); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, errors.Newf("%T is not a map", v)
+		}
+		return m, nil
+	}
+	if v == nil {
+		if ti.Nullable {
+			return nil, nil
+		}
+		return defaultValue(ti.Type), nil
+	}
+	return scalarValue(ti.Type, v)
+}
+
+// elemType is the Go type of the elements of an array column.
+func elemType(ti *model.TypeInfo) reflect.Type {
+	if ti.Type == model.Map {
+		return reflect.TypeOf(model.NewOrderedMap())
+	}
+	typ := reflect.TypeOf(defaultValue(ti.Type))
+	if ti.Nullable {
+		typ = reflect.PointerTo(typ)
+	}
+	return typ
+}
+
+func defaultValue(typ int) interface{} {
+	switch typ {
+	case model.Bool:
+		return false
+	case model.Int8:
+		return int8(0)
+	case model.Int16:
+		return int16(0)
+	case model.Int32:
+		return int32(0)
+	case model.Int64:
+		return int64(0)
+	case model.UInt8:
+		return uint8(0)
+	case model.UInt16:
+		return uint16(0)
+	case model.UInt32:
+		return uint32(0)
+	case model.UInt64:
+		return uint64(0)
+	case model.Float32:
+		return float32(0)
+	case model.Float64:
+		return float64(0)
+	case model.Decimal:
+		return decimal.Zero
+	case model.DateTime:
+		return time.Unix(0, 0).UTC()
+	case model.Object:
+		return map[string]interface{}{}
+	case model.IPv4:
+		return "0.0.0.0"
+	case model.IPv6:
+		return "::"
+	case model.UUID:
+		return "00000000-0000-0000-0000-000000000000"
+	}
+	return ""
+}
+
+func scalarValue(typ int, v interface{}) (val interface{}, err error) {
+	switch typ {
+	case model.Bool:
+		switch v := v.(type) {
+		case bool:
+			return v, nil
+		case string:
+			return strconv.ParseBool(v)
+		}
+	case model.Int8, model.Int16, model.Int32, model.Int64:
+		var i int64
+		if i, err = toInt64(v); err != nil {
+			return
+		}
+		return reflect.ValueOf(i).Convert(reflect.TypeOf(defaultValue(typ))).Interface(), nil
+	case model.UInt8, model.UInt16, model.UInt32, model.UInt64:
+		var u uint64
+		if u, err = toUint64(v); err != nil {
+			return
+		}
+		return reflect.ValueOf(u).Convert(reflect.TypeOf(defaultValue(typ))).Interface(), nil
+	case model.Float32, model.Float64:
+		var f float64
+		if f, err = toFloat64(v); err != nil {
+			return
+		}
+		if typ == model.Float32 {
+			return float32(f), nil
+		}
+		return f, nil
+	case model.Decimal:
+		switch v := v.(type) {
+		case string:
+			return decimal.NewFromString(v)
+		case json.Number:
+			return decimal.NewFromString(v.String())
+		case float64:
+			return decimal.NewFromFloat(v), nil
+		case int64:
+			return decimal.NewFromInt(v), nil
+		}
+	case model.DateTime:
+		switch v := v.(type) {
+		case time.Time:
+			return v, nil
+		case string:
+			return time.Parse(time.RFC3339Nano, v)
+		case json.Number:
+			// unix seconds
+			var f float64
+			if f, err = v.Float64(); err != nil {
+				return
+			}
+			sec, frac := math.Modf(f)
+			return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+		}
+	case model.Object:
+		switch v := v.(type) {
+		case map[string]interface{}:
+			return v, nil
+		case string:
+			var obj map[string]interface{}
+			if err = json.Unmarshal([]byte(v), &obj); err != nil {
+				return nil, errors.Wrapf(err, "")
+			}
+			return obj, nil
+		}
+	default:
+		// String, IPv4, IPv6, UUID
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+		return fmt.Sprint(v), nil
+	}
+	return nil, errors.Newf("can't convert %T to %s", v, model.GetTypeName(typ))
+}
+
+func toInt64(v interface{}) (int64, error) {
+	switch v := v.(type) {
+	case int64:
+		return v, nil
+	case uint64:
+		return int64(v), nil
+	case float64:
+		return int64(v), nil
+	case json.Number:
+		return strconv.ParseInt(v.String(), 10, 64)
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, errors.Newf("can't convert %T to an integer", v)
+}
+
+func toUint64(v interface{}) (uint64, error) {
+	switch v := v.(type) {
+	case uint64:
+		return v, nil
+	case int64:
+		return uint64(v), nil
+	case float64:
+		return uint64(v), nil
+	case json.Number:
+		return strconv.ParseUint(v.String(), 10, 64)
+	case string:
+		return strconv.ParseUint(v, 10, 64)
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, errors.Newf("can't convert %T to an unsigned integer", v)
+}
+
+func toFloat64(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case json.Number:
+		return v.Float64()
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, errors.Newf("can't convert %T to a float", v)
+}
@@ -0,0 +1,121 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/klauspost/compress/zstd"
+	"github.com/thanos-io/thanos/pkg/errors"
+)
+
+const (
+	FormatNDJSON  = "ndjson"
+	FormatParquet = "parquet"
+)
+
+type format struct {
+	ext        string
+	newEncoder func(dims []*model.ColumnWithType) (encoder, error)
+}
+
+var formats = map[string]format{
+	"":            {"ndjson.zst", newNDJSONEncoder},
+	FormatNDJSON:  {"ndjson.zst", newNDJSONEncoder},
+	FormatParquet: {"parquet", newParquetEncoder},
+}
+
+// encoder accumulates the rows of one object in memory.
+type encoder interface {
+	Append(row []interface{}) error
+	Rows() int
+	// Close returns the encoded object, the encoder can't be used afterwards.
+	Close() ([]byte, error)
+}
+
+// newEncoder returns an encoder of the named format for rows described by dims, and the file extension of its objects.
+func newEncoder(name string, dims []*model.ColumnWithType) (enc encoder, ext string, err error) {
+	f, ok := formats[name]
+	if !ok {
+		err = errors.Newf("unknown archive format %s", name)
+		return
+	}
+	enc, err = f.newEncoder(dims)
+	return enc, f.ext, err
+}
+
+// ndjsonEncoder writes a JSON object per row, keyed by column name, through zstd.
+type ndjsonEncoder struct {
+	dims []*model.ColumnWithType
+	buf  bytes.Buffer
+	zw   *zstd.Encoder
+	je   *json.Encoder
+	obj  map[string]interface{}
+	rows int
+}
+
+func newNDJSONEncoder(dims []*model.ColumnWithType) (encoder, error) {
+	enc := &ndjsonEncoder{dims: dims, obj: make(map[string]interface{}, len(dims))}
+	zw, err := zstd.NewWriter(&enc.buf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "")
+	}
+	enc.zw = zw
+	enc.je = json.NewEncoder(zw)
+	return enc, nil
+}
+
+func (enc *ndjsonEncoder) Append(row []interface{}) (err error) {
+	for i, dim := range enc.dims {
+		enc.obj[dim.Name] = JSONValue(row[i])
+	}
+	if err = enc.je.Encode(enc.obj); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	enc.rows++
+	return
+}
+
+// JSONValue replaces what encoding/json can't represent faithfully in a row value. Map columns become JSON objects
+// keyed by the string form of their keys.
+func JSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	// JSON has no NaN and Inf
+	case float32:
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return nil
+		}
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil
+		}
+	case *model.OrderedMap:
+		// JSON object keys are strings, the reader converts them back by the column type
+		obj := make(map[string]interface{})
+		for k := range v.Keys() {
+			val, _ := v.Get(k)
+			obj[fmt.Sprint(k)] = JSONValue(val)
+		}
+		return obj
+	case []*model.OrderedMap:
+		arr := make([]interface{}, len(v))
+		for i, m := range v {
+			arr[i] = JSONValue(m)
+		}
+		return arr
+	}
+	return v
+}
+
+func (enc *ndjsonEncoder) Rows() int {
+	return enc.rows
+}
+
+func (enc *ndjsonEncoder) Close() (data []byte, err error) {
+	if err = enc.zw.Close(); err != nil {
+		return nil, errors.Wrapf(err, "")
+	}
+	return enc.buf.Bytes(), nil
+}
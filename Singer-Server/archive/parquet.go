@@ -0,0 +1,348 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/apache/arrow/go/v14/arrow"
+	"github.com/apache/arrow/go/v14/arrow/array"
+	"github.com/apache/arrow/go/v14/arrow/memory"
+	"github.com/apache/arrow/go/v14/parquet"
+	"github.com/apache/arrow/go/v14/parquet/compress"
+	"github.com/apache/arrow/go/v14/parquet/pqarrow"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/thanos-io/thanos/pkg/errors"
+)
+
+const rowGroupRows = 64 * 1024
+
+// parquetEncoder writes a zstd compressed Parquet file whose schema follows the ClickHouse columns:
+//   - Nullable(T) is an optional column, other columns are required.
+//   - Array(T) is a LIST, whose elements are optional for Array(Nullable(T)).
+//   - Map(K, V) is a MAP with optional values.
+//   - DateTime and Date are TIMESTAMP(MICROS) in UTC, Decimal is its exact string, and String, UUID, IPv4, IPv6
+//     and Object are strings.
+type parquetEncoder struct {
+	schema *arrow.Schema
+	buf    bytes.Buffer
+	fw     *pqarrow.FileWriter
+	rb     *array.RecordBuilder
+	vals   []interface{}
+	rows   int
+	// rows in rb
+	pending int
+}
+
+// mapEntry is a normalized map entry, maps are kept in order.
+type mapEntry struct {
+	key, value interface{}
+}
+
+func newParquetEncoder(dims []*model.ColumnWithType) (encoder, error) {
+	schema, err := parquetSchema(dims)
+	if err != nil {
+		return nil, err
+	}
+	enc := &parquetEncoder{schema: schema, vals: make([]interface{}, len(dims))}
+	props := parquet.NewWriterProperties(parquet.WithCompression(compress.Codecs.Zstd))
+	if enc.fw, err = pqarrow.NewFileWriter(schema, &enc.buf, props, pqarrow.DefaultWriterProps()); err != nil {
+		return nil, errors.Wrapf(err, "")
+	}
+	enc.rb = array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	return enc, nil
+}
+
+// parquetSchema derives the schema of an object from the ClickHouse columns.
+func parquetSchema(dims []*model.ColumnWithType) (*arrow.Schema, error) {
+	fields := make([]arrow.Field, len(dims))
+	for i, dim := range dims {
+		dt, err := arrowType(dim.Type)
+		if err != nil {
+			return nil, errors.Wrapf(err, "column %s", dim.Name)
+		}
+		// ClickHouse doesn't allow Nullable(Array) and Nullable(Map)
+		nullable := dim.Type.Nullable && !dim.Type.Array && dim.Type.Type != model.Map
+		fields[i] = arrow.Field{Name: dim.Name, Type: dt, Nullable: nullable}
+	}
+	return arrow.NewSchema(fields, nil), nil
+}
+
+func arrowType(ti *model.TypeInfo) (dt arrow.DataType, err error) {
+	switch ti.Type {
+	case model.Bool:
+		dt = arrow.FixedWidthTypes.Boolean
+	case model.Int8:
+		dt = arrow.PrimitiveTypes.Int8
+	case model.Int16:
+		dt = arrow.PrimitiveTypes.Int16
+	case model.Int32:
+		dt = arrow.PrimitiveTypes.Int32
+	case model.Int64:
+		dt = arrow.PrimitiveTypes.Int64
+	case model.UInt8:
+		dt = arrow.PrimitiveTypes.Uint8
+	case model.UInt16:
+		dt = arrow.PrimitiveTypes.Uint16
+	case model.UInt32:
+		dt = arrow.PrimitiveTypes.Uint32
+	case model.UInt64:
+		dt = arrow.PrimitiveTypes.Uint64
+	case model.Float32:
+		dt = arrow.PrimitiveTypes.Float32
+	case model.Float64:
+		dt = arrow.PrimitiveTypes.Float64
+	case model.DateTime:
+		dt = &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"}
+	case model.Decimal, model.String, model.Object, model.IPv4, model.IPv6, model.UUID:
+		dt = arrow.BinaryTypes.String
+	case model.Map:
+		if ti.MapKey == nil || ti.MapValue == nil {
+			return nil, errors.Newf("map without key or value type")
+		}
+		var kt, vt arrow.DataType
+		if kt, err = arrowType(ti.MapKey); err != nil {
+			return
+		}
+		if vt, err = arrowType(ti.MapValue); err != nil {
+			return
+		}
+		dt = arrow.MapOf(kt, vt)
+	default:
+		return nil, errors.Newf("unsupported type %d", ti.Type)
+	}
+	if ti.Array {
+		if ti.Nullable {
+			dt = arrow.ListOf(dt)
+		} else {
+			dt = arrow.ListOfNonNullable(dt)
+		}
+	}
+	return
+}
+
+// Append converts the whole row before appending it, so that a bad value doesn't leave the columns misaligned.
+func (enc *parquetEncoder) Append(row []interface{}) (err error) {
+	for i, field := range enc.schema.Fields() {
+		if enc.vals[i], err = normalize(field.Type, row[i]); err != nil {
+			return errors.Wrapf(err, "column %s", field.Name)
+		}
+	}
+	for i, field := range enc.schema.Fields() {
+		appendValue(enc.rb.Field(i), field.Nullable, enc.vals[i])
+	}
+	enc.rows++
+	if enc.pending++; enc.pending >= rowGroupRows {
+		err = enc.flush()
+	}
+	return
+}
+
+func (enc *parquetEncoder) Rows() int {
+	return enc.rows
+}
+
+func (enc *parquetEncoder) Close() (data []byte, err error) {
+	defer enc.rb.Release()
+	if err = enc.flush(); err != nil {
+		return
+	}
+	if err = enc.fw.Close(); err != nil {
+		return nil, errors.Wrapf(err, "")
+	}
+	return enc.buf.Bytes(), nil
+}
+
+// flush writes the pending rows as a row group.
+func (enc *parquetEncoder) flush() (err error) {
+	if enc.pending == 0 {
+		return
+	}
+	rec := enc.rb.NewRecord()
+	defer rec.Release()
+	enc.pending = 0
+	if err = enc.fw.Write(rec); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+// normalize converts v to the Go type appendValue expects for dt: bool, int64, uint64, float64, string,
+// []interface{} for lists, []mapEntry for maps, or nil.
+func normalize(dt arrow.DataType, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	rv := reflect.ValueOf(v)
+	switch dt := dt.(type) {
+	case *arrow.ListType:
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return nil, errors.Newf("%T is not an array", v)
+		}
+		elems := make([]interface{}, rv.Len())
+		for i := range elems {
+			var err error
+			if elems[i], err = normalize(dt.Elem(), rv.Index(i).Interface()); err != nil {
+				return nil, err
+			}
+		}
+		return elems, nil
+	case *arrow.MapType:
+		return normalizeMap(dt, v)
+	case *arrow.TimestampType:
+		t, ok := v.(time.Time)
+		if !ok {
+			return nil, errors.Newf("%T is not a time", v)
+		}
+		return t.UnixMicro(), nil
+	case *arrow.StringType:
+		return stringOf(v)
+	case *arrow.BooleanType:
+		b, ok := v.(bool)
+		if !ok {
+			return nil, errors.Newf("%T is not a bool", v)
+		}
+		return b, nil
+	}
+	switch {
+	case arrow.IsSignedInteger(dt.ID()):
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return rv.Int(), nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return int64(rv.Uint()), nil
+		}
+	case arrow.IsUnsignedInteger(dt.ID()):
+		switch rv.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return rv.Uint(), nil
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return uint64(rv.Int()), nil
+		}
+	case arrow.IsFloating(dt.ID()):
+		switch rv.Kind() {
+		case reflect.Float32, reflect.Float64:
+			return rv.Float(), nil
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return float64(rv.Int()), nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return float64(rv.Uint()), nil
+		}
+	}
+	return nil, errors.Newf("%T is not a %s", v, dt)
+}
+
+func normalizeMap(dt *arrow.MapType, v interface{}) (entries []mapEntry, err error) {
+	add := func(k, v interface{}) (err error) {
+		var e mapEntry
+		if e.key, err = normalize(dt.KeyType(), k); err != nil {
+			return
+		}
+		if e.value, err = normalize(dt.ItemType(), v); err != nil {
+			return
+		}
+		entries = append(entries, e)
+		return
+	}
+	if om, ok := v.(*model.OrderedMap); ok {
+		keys := om.Keys()
+		for k := range keys {
+			val, _ := om.Get(k)
+			if err = add(k, val); err != nil {
+				// drain the rest, the sender doesn't stop otherwise
+				for range keys {
+				}
+				return
+			}
+		}
+		return
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Map {
+		return nil, errors.Newf("%T is not a map", v)
+	}
+	iter := rv.MapRange()
+	for iter.Next() {
+		if err = add(iter.Key().Interface(), iter.Value().Interface()); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func stringOf(v interface{}) (string, error) {
+	switch s := v.(type) {
+	case string:
+		return s, nil
+	case []byte:
+		return string(s), nil
+	case fmt.Stringer:
+		// decimal.Decimal, net.IP, uuid.UUID
+		return s.String(), nil
+	}
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Map, reflect.Slice, reflect.Struct:
+		// Object
+		bs, err := json.Marshal(v)
+		if err != nil {
+			return "", errors.Wrapf(err, "")
+		}
+		return string(bs), nil
+	}
+	return fmt.Sprint(v), nil
+}
+
+// appendValue appends a value returned by normalize. Nil is null, or the zero value of a required column.
+func appendValue(b array.Builder, nullable bool, v interface{}) {
+	if v == nil {
+		if nullable {
+			b.AppendNull()
+		} else {
+			b.AppendEmptyValue()
+		}
+		return
+	}
+	switch b := b.(type) {
+	case *array.ListBuilder:
+		elemNullable := b.Type().(*arrow.ListType).ElemField().Nullable
+		b.Append(true)
+		for _, e := range v.([]interface{}) {
+			appendValue(b.ValueBuilder(), elemNullable, e)
+		}
+	case *array.MapBuilder:
+		itemNullable := b.Type().(*arrow.MapType).ItemField().Nullable
+		b.Append(true)
+		for _, e := range v.([]mapEntry) {
+			appendValue(b.KeyBuilder(), false, e.key)
+			appendValue(b.ItemBuilder(), itemNullable, e.value)
+		}
+	case *array.BooleanBuilder:
+		b.Append(v.(bool))
+	case *array.Int8Builder:
+		b.Append(int8(v.(int64)))
+	case *array.Int16Builder:
+		b.Append(int16(v.(int64)))
+	case *array.Int32Builder:
+		b.Append(int32(v.(int64)))
+	case *array.Int64Builder:
+		b.Append(v.(int64))
+	case *array.Uint8Builder:
+		b.Append(uint8(v.(uint64)))
+	case *array.Uint16Builder:
+		b.Append(uint16(v.(uint64)))
+	case *array.Uint32Builder:
+		b.Append(uint32(v.(uint64)))
+	case *array.Uint64Builder:
+		b.Append(v.(uint64))
+	case *array.Float32Builder:
+		b.Append(float32(v.(float64)))
+	case *array.Float64Builder:
+		b.Append(v.(float64))
+	case *array.TimestampBuilder:
+		b.Append(arrow.Timestamp(v.(int64)))
+	case *array.StringBuilder:
+		b.Append(v.(string))
+	}
+}
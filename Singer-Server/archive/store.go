@@ -0,0 +1,188 @@
+package archive
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/thanos-io/thanos/pkg/errors"
+)
+
+const (
+	StoreS3    = "s3"
+	StoreLocal = "local"
+)
+
+var (
+	_ Store = (*s3Store)(nil)
+	_ Store = (*localStore)(nil)
+)
+
+// Store is where the archived objects go.
+type Store interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	// List returns the keys starting with prefix in lexical order.
+	List(prefix string) ([]string, error)
+}
+
+// NewStore creates the store of arCfg.Type.
+func NewStore(arCfg *config.ArchiveConfig) (Store, error) {
+	switch arCfg.Type {
+	case StoreS3:
+		return newS3Store(arCfg)
+	case StoreLocal:
+		return newLocalStore(arCfg)
+	default:
+		return nil, errors.Newf("unknown archive type %s", arCfg.Type)
+	}
+}
+
+// s3Store puts objects to AWS S3 or any S3 compatible endpoint.
+type s3Store struct {
+	bucket string
+	cl     *s3.S3
+}
+
+func newS3Store(arCfg *config.ArchiveConfig) (st *s3Store, err error) {
+	if arCfg.Bucket == "" {
+		return nil, errors.Newf("archive type s3 requires a bucket")
+	}
+	awsCfg := aws.NewConfig().WithS3ForcePathStyle(arCfg.PathStyle)
+	if arCfg.Region != "" {
+		awsCfg = awsCfg.WithRegion(arCfg.Region)
+	}
+	if arCfg.Endpoint != "" {
+		awsCfg = awsCfg.WithEndpoint(arCfg.Endpoint)
+	}
+	// otherwise the default credential chain applies
+	if arCfg.AccessKey != "" {
+		awsCfg = awsCfg.WithCredentials(credentials.NewStaticCredentials(arCfg.AccessKey, arCfg.SecretKey, ""))
+	}
+	var sess *session.Session
+	if sess, err = session.NewSessionWithOptions(session.Options{
+		Config:            *awsCfg,
+		SharedConfigState: session.SharedConfigEnable,
+	}); err != nil {
+		return nil, errors.Wrapf(err, "")
+	}
+	return &s3Store{bucket: arCfg.Bucket, cl: s3.New(sess)}, nil
+}
+
+func (st *s3Store) Put(key string, data []byte) (err error) {
+	if _, err = st.cl.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(st.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	}); err != nil {
+		err = errors.Wrapf(err, "failed to put s3://%s/%s", st.bucket, key)
+	}
+	return
+}
+
+func (st *s3Store) Get(key string) (data []byte, err error) {
+	var out *s3.GetObjectOutput
+	if out, err = st.cl.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(st.bucket),
+		Key:    aws.String(key),
+	}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get s3://%s/%s", st.bucket, key)
+	}
+	defer out.Body.Close()
+	if data, err = io.ReadAll(out.Body); err != nil {
+		err = errors.Wrapf(err, "failed to get s3://%s/%s", st.bucket, key)
+	}
+	return
+}
+
+func (st *s3Store) List(prefix string) (keys []string, err error) {
+	if err = st.cl.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(st.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.StringValue(obj.Key))
+		}
+		return true
+	}); err != nil {
+		err = errors.Wrapf(err, "failed to list s3://%s/%s", st.bucket, prefix)
+	}
+	return
+}
+
+// localStore writes objects as files under Dir. A file appears complete or not at all.
+type localStore struct {
+	dir string
+}
+
+func newLocalStore(arCfg *config.ArchiveConfig) (st *localStore, err error) {
+	if arCfg.Dir == "" {
+		return nil, errors.Newf("archive type local requires a dir")
+	}
+	if err = os.MkdirAll(arCfg.Dir, 0o755); err != nil {
+		return nil, errors.Wrapf(err, "")
+	}
+	return &localStore{dir: arCfg.Dir}, nil
+}
+
+func (st *localStore) Put(key string, data []byte) (err error) {
+	path := filepath.Join(st.dir, filepath.FromSlash(key))
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+func (st *localStore) Get(key string) (data []byte, err error) {
+	if data, err = os.ReadFile(filepath.Join(st.dir, filepath.FromSlash(key))); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+func (st *localStore) List(prefix string) (keys []string, err error) {
+	// walk the deepest directory containing prefix
+	root := st.dir
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		root = filepath.Join(st.dir, filepath.FromSlash(prefix[:i]))
+	}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(st.dir, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "")
+	}
+	return
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -19,9 +20,13 @@ var (
 	builtBy = "None"
 
 	cmdOps      util.CmdOptions
+	adminToken  string
 	httpAddr    string
 	httpMetrics = promhttp.Handler()
 	runner      *task.Sinker
+
+	restoring  bool
+	restoreOps task.RestoreOptions
 )
 
 const (
@@ -47,6 +52,7 @@ func initCmdOptions() {
 	util.EnvStringVar(&cmdOps.ClickhousePassword, "clickhouse-password")
 	util.EnvStringVar(&cmdOps.KafkaUsername, "kafka-username")
 	util.EnvStringVar(&cmdOps.KafkaPassword, "kafka-password")
+	util.EnvStringVar(&adminToken, "admin-token")
 
 	flag.StringVar(&cmdOps.LogLevel, "log-level", cmdOps.LogLevel, "one of debug, info, warn, error, dpanic, panic, fatal")
 	flag.StringVar(&cmdOps.LogPaths, "log-paths", cmdOps.LogPaths, "a list of comma-separated log file path. stdout means the console stdout")
@@ -59,8 +65,54 @@ func initCmdOptions() {
 	flag.StringVar(&cmdOps.KafkaPassword, "kafka-password", cmdOps.KafkaPassword, "kafka password")
 	flag.StringVar(&cmdOps.KafkaGSSAPIUsername, "kafka-gssapi-username", cmdOps.KafkaGSSAPIUsername, "kafka GSSAPI username")
 	flag.StringVar(&cmdOps.KafkaGSSAPIPassword, "kafka-gssapi-password", cmdOps.KafkaGSSAPIPassword, "kafka GSSAPI password")
+	flag.StringVar(&adminToken, "admin-token", adminToken, "bearer token of the admin api under /api/, which is only served on the loopback address if empty")
 
 	flag.Parse()
+	if flag.Arg(0) == "restore" {
+		restoring = true
+		parseRestoreOptions(flag.Args()[1:])
+	}
+}
+
+// parseRestoreOptions parses the options of "clickhouse_sinker [options] restore [restore options]".
+func parseRestoreOptions(args []string) {
+	var from, to string
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	fs.StringVar(&restoreOps.Task, "task", "", "task whose archived objects to restore")
+	fs.StringVar(&restoreOps.Table, "table", "", "target table, the table of the task if empty")
+	fs.StringVar(&from, "from", "", "start of the time range, RFC3339, 2006-01-02T15 or 2006-01-02 in UTC")
+	fs.StringVar(&to, "to", "", "end of the time range (exclusive), in the format of --from")
+	fs.IntVar(&restoreOps.Parallelism, "parallelism", task.DefaultRestoreParallelism, "objects restored concurrently")
+	fs.IntVar(&restoreOps.BatchSize, "batch-size", task.DefaultRestoreBatchSize, "rows per insert")
+	fs.StringVar(&restoreOps.StateFile, "state-file", "", "file recording the restored objects to resume from, restore_<task>.state if empty")
+	_ = fs.Parse(args)
+
+	var err error
+	if restoreOps.Task == "" {
+		err = fmt.Errorf("--task is required")
+	} else if restoreOps.From, err = parseRestoreTime(from); err == nil {
+		restoreOps.To, err = parseRestoreTime(to)
+	}
+	if err == nil && !restoreOps.From.Before(restoreOps.To) {
+		err = fmt.Errorf("--from must be before --to")
+	}
+	if err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		fs.Usage()
+		os.Exit(2)
+	}
+	if restoreOps.StateFile == "" {
+		restoreOps.StateFile = fmt.Sprintf("restore_%s.state", restoreOps.Task)
+	}
+}
+
+func parseRestoreTime(s string) (t time.Time, err error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15", "2006-01-02"} {
+		if t, err = time.Parse(layout, s); err == nil {
+			return
+		}
+	}
+	return t, fmt.Errorf("invalid time %q", s)
 }
 
 func getVersion() string {
@@ -79,7 +131,65 @@ func init() {
 	util.Logger.Info("parsed command options:", zap.Reflect("opts", cmdOps))
 }
 
+// initRcm returns the Nacos config manager, or nil if the config is a local file.
+func initRcm() (rcm cm.RemoteConfManager, err error) {
+	logDir := "."
+	logPaths := strings.Split(cmdOps.LogPaths, ",")
+	for _, logPath := range logPaths {
+		if logPath != "stdout" && logPath != "stderr" {
+			logDir, _ = filepath.Split(logPath)
+		}
+	}
+	logDir, _ = filepath.Abs(logDir)
+	if cmdOps.NacosDataID == "" {
+		util.Logger.Info(fmt.Sprintf("get config from local file %s", cmdOps.LocalCfgFile))
+		return
+	}
+	util.Logger.Info(fmt.Sprintf("get config from nacos serverAddrs %s, namespaceId %s, group %s, dataId %s",
+		cmdOps.NacosAddr, cmdOps.NacosNamespaceID, cmdOps.NacosGroup, cmdOps.NacosDataID))
+	rcm = &cm.NacosConfManager{}
+	properties := make(map[string]interface{}, 8)
+	properties["serverAddrs"] = cmdOps.NacosAddr
+	properties["username"] = cmdOps.NacosUsername
+	properties["password"] = cmdOps.NacosPassword
+	properties["namespaceId"] = cmdOps.NacosNamespaceID
+	properties["group"] = cmdOps.NacosGroup
+	properties["dataId"] = cmdOps.NacosDataID
+	properties["serviceName"] = cmdOps.NacosServiceName
+	properties["logDir"] = logDir
+	err = rcm.Init(properties)
+	return
+}
+
+// runRestore reloads archived objects into ClickHouse, then exits.
+func runRestore() {
+	rcm, err := initRcm()
+	if err != nil {
+		util.Logger.Fatal("rcm.Init failed", zap.Error(err))
+	}
+	var cfg *config.Config
+	if rcm != nil {
+		cfg, err = rcm.GetConfig()
+		rcm.Stop()
+	} else {
+		cfg, err = config.ParseLocalCfgFile(cmdOps.LocalCfgFile)
+	}
+	if err == nil {
+		err = cfg.Normallize(true, "", cmdOps.Credentials)
+	}
+	if err != nil {
+		util.Logger.Fatal("failed to load config", zap.Error(err))
+	}
+	if err = task.Restore(cfg, &restoreOps); err != nil {
+		util.Logger.Fatal("restore failed", zap.Error(err))
+	}
+}
+
 func main() {
+	if restoring {
+		runRestore()
+		return
+	}
 	util.Run("clickhouse_sinker", func() error {
 		// Initialize http server for metrics and debug
 		httpPort := cmdOps.HTTPPort
@@ -111,43 +221,20 @@ func main() {
 			}
 		}()
 
-		var rcm cm.RemoteConfManager
-		var properties map[string]interface{}
-		logDir := "."
-		logPaths := strings.Split(cmdOps.LogPaths, ",")
-		for _, logPath := range logPaths {
-			if logPath != "stdout" && logPath != "stderr" {
-				logDir, _ = filepath.Split(logPath)
-			}
-		}
-		logDir, _ = filepath.Abs(logDir)
-		if cmdOps.NacosDataID != "" {
-			util.Logger.Info(fmt.Sprintf("get config from nacos serverAddrs %s, namespaceId %s, group %s, dataId %s",
-				cmdOps.NacosAddr, cmdOps.NacosNamespaceID, cmdOps.NacosGroup, cmdOps.NacosDataID))
-			rcm = &cm.NacosConfManager{}
-			properties = make(map[string]interface{}, 8)
-			properties["serverAddrs"] = cmdOps.NacosAddr
-			properties["username"] = cmdOps.NacosUsername
-			properties["password"] = cmdOps.NacosPassword
-			properties["namespaceId"] = cmdOps.NacosNamespaceID
-			properties["group"] = cmdOps.NacosGroup
-			properties["dataId"] = cmdOps.NacosDataID
-			properties["serviceName"] = cmdOps.NacosServiceName
-			properties["logDir"] = logDir
-		} else {
-			util.Logger.Info(fmt.Sprintf("get config from local file %s", cmdOps.LocalCfgFile))
+		rcm, err := initRcm()
+		if err != nil {
+			util.Logger.Fatal("rcm.Init failed", zap.Error(err))
 		}
-		if rcm != nil {
-			if err := rcm.Init(properties); err != nil {
+		if rcm != nil && cmdOps.NacosServiceName != "" {
+			if err := rcm.Register(httpHost, httpPort); err != nil {
 				util.Logger.Fatal("rcm.Init failed", zap.Error(err))
 			}
-			if cmdOps.NacosServiceName != "" {
-				if err := rcm.Register(httpHost, httpPort); err != nil {
-					util.Logger.Fatal("rcm.Init failed", zap.Error(err))
-				}
-			}
 		}
 		runner = task.NewSinker(rcm, httpAddr, &cmdOps)
+		mux.Handle("/api/", runner.AdminHandler(adminToken))
+		mux.Handle(input.IngestPathPrefix, input.IngestHandler())
+		mux.HandleFunc("/healthz", runner.Healthz)
+		mux.HandleFunc("/readyz", runner.Readyz)
 		return runner.Init()
 	}, func() error {
 		runner.Run()
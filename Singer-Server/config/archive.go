@@ -0,0 +1,27 @@
+package config
+
+// ArchiveConfig configures the archiver, which copies every batch written to ClickHouse to cold storage.
+// Objects are keyed <Prefix>/<task>/date=YYYY-MM-DD/hour=HH/<id>.<ext> by the UTC event time of their rows.
+type ArchiveConfig struct {
+	Type   string // "s3" for any S3 compatible endpoint, or "local"
+	Format string // "ndjson" (zstd compressed, the default) or "parquet"
+
+	// s3. Credentials fall back to the AWS environment variables, shared credentials file and instance role.
+	Endpoint  string // empty for AWS
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool // required by MinIO and most other S3 compatible stores
+
+	Dir    string // local: root directory of the objects
+	Prefix string
+
+	// TimeColumn is the DateTime column holding the event time of a row, the first DateTime column of a task if
+	// empty. Rows without one are partitioned by the time of the insert.
+	TimeColumn string
+
+	MaxRows       int // rows per object, 100000 if 0
+	FlushInterval int // seconds an object stays open at most, 300 if 0
+	BufferSize    int // batches queued before new ones are dropped, 1000 if 0
+}
@@ -0,0 +1,17 @@
+package config
+
+// DeadLetterConfig configures the dead-letter queue, which keeps the records that fail to transform, parse or
+// insert instead of dropping them. Offsets are committed as usual, the queue never holds consumption back.
+type DeadLetterConfig struct {
+	Type  string // "kafka", "clickhouse" or "file"
+	Topic string // kafka: topic to produce to, on the brokers of Kafka
+	Table string // clickhouse: "db.table" or "table" in DB, created if missing
+	Dir   string // file: directory of the NDJSON files
+
+	MaxFileSize int // file: size in MB before the file is rotated, 100 if 0
+	MaxFiles    int // file: number of rotated files to keep, 10 if 0
+
+	BufferSize    int // entries queued before new ones are dropped, 10000 if 0
+	BatchSize     int // entries written at once, 1000 if 0
+	FlushInterval int // seconds between writes of a partial batch, 5 if 0
+}
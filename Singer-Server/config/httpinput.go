@@ -0,0 +1,12 @@
+package config
+
+// HTTPInputConfig configures the HTTP bulk ingestion endpoint, which tasks with Input "http" consume from instead
+// of Kafka. Clients POST NDJSON or a JSON array to /ingest/<task name>, the response is sent once the records have
+// been written.
+type HTTPInputConfig struct {
+	APIKeys     []string // accepted keys, required unless NoAuth
+	NoAuth      bool     // serve without APIKeys, anyone who reaches the port can ingest
+	MaxBodySize int      // MB of a decompressed request body, 10 if 0
+	MaxPending  int      // records received but not written yet of a consumer group, 4*BufferSize if 0
+	AckTimeout  int      // seconds to wait for the write of a request, 60 if 0
+}
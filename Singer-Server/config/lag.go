@@ -0,0 +1,8 @@
+package config
+
+// LagMonitorConfig configures the lag collector, which compares the offsets committed by every consumer group with
+// the end offsets of its partitions.
+type LagMonitorConfig struct {
+	Interval     int // seconds between collections, 30 if 0
+	StallTimeout int // seconds a committed offset may stay put while the lag grows, 300 if 0
+}
@@ -0,0 +1,22 @@
+package config
+
+// OpenSearchConfig configures the connection to OpenSearch or Elasticsearch, which the tasks whose Output is
+// "opensearch" write to with the _bulk API.
+type OpenSearchConfig struct {
+	Addresses          []string // e.g. "https://node1:9200", used in turn
+	Username           string
+	Password           string
+	InsecureSkipVerify bool
+	Timeout            int // seconds per _bulk request, 30 if 0
+	RetryTimes         int // attempts per batch, documents rejected with 429 or 5xx are sent again, 3 if 0
+	MaxConns           int // concurrent _bulk requests per task, 1 if 0
+}
+
+// IndexConfig tells where a task whose Output is "opensearch" indexes its rows.
+type IndexConfig struct {
+	// Name is a template: %{column} is replaced with the value of a column in lower case, and %{+yyyy.MM.dd} with
+	// the UTC date of TimeField, e.g. "logs-%{log_type}-%{+yyyy.MM.dd}". The date layout takes yyyy, yy, MM, dd and HH.
+	Name      string
+	TimeField string // DateTime column the date comes from, the time of the write if empty
+	IDField   string // column used as document _id, OpenSearch generates one if empty
+}
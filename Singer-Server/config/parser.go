@@ -0,0 +1,11 @@
+package config
+
+// GrokConfig configures the grok parser of a task. Match expressions use the %{PATTERN:field:type} syntax, where
+// type is one of string, int, float or datetime and defaults to string.
+type GrokConfig struct {
+	Patterns    []string          // match expressions, tried in the listed order
+	Definitions map[string]string // user defined patterns, they take precedence over the bundled ones
+	// Lines which match none of the Patterns are stored verbatim in this field. If empty they fail to parse and
+	// are handled like any other malformed message.
+	FallbackField string
+}
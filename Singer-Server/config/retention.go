@@ -0,0 +1,11 @@
+package config
+
+// RetentionConfig declares the TTL of the table of a task. The sinker reconciles it at startup and on config
+// reload with ALTER TABLE ... MODIFY TTL, ON CLUSTER if Clickhouse.Cluster is set. A task without retention
+// leaves the TTL of its table alone, one with neither DeleteDays nor MoveDays removes it.
+type RetentionConfig struct {
+	Column     string // Date or DateTime column the TTL counts from
+	DeleteDays int    // rows older than this are deleted, never if 0
+	MoveDays   int    // rows older than this are moved to Volume, never if 0
+	Volume     string // volume of the storage policy of the table, e.g. "cold"
+}
@@ -0,0 +1,9 @@
+package config
+
+// SpillConfig configures the degraded mode of a task whose batches can't be written to its output after all
+// retries. Such batches are spilled to Dir and consumption of the task's consumer group is paused until they have
+// been replayed. Offsets are committed only once they landed.
+type SpillConfig struct {
+	Dir            string // "spill" if empty
+	ReplayInterval int    // seconds between attempts to replay, 10 if 0
+}
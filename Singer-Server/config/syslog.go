@@ -0,0 +1,13 @@
+package config
+
+// SyslogInputConfig configures the listeners of a task with Input "syslog". TCP and TLS accept RFC 6587
+// octet-counting as well as newline-delimited framing, UDP takes one message per datagram.
+type SyslogInputConfig struct {
+	UDP            string // listen address, no UDP listener if empty
+	TCP            string // listen address, no TCP listener if empty
+	TLS            string // listen address, no TLS listener if empty
+	CertFile       string // server certificate of the TLS listener
+	KeyFile        string
+	CaCertFile     string // CA of client certificates, which are required if set
+	MaxMessageSize int    // bytes, 65536 if 0
+}
@@ -0,0 +1,52 @@
+package config
+
+// TransformConfig is one step of a task's transform chain. Steps run in the
+// listed order against the JSON object decoded from each Kafka record, before
+// the record is handed to the parser. Not every field applies to every type:
+//
+//	add_field:     set Field to Value
+//	rename:        move Field to Target
+//	flatten:       move the members of object Field to the top level, each key prefixed with Prefix
+//	unwrap:        replace object Field with its member Key ("value" if empty)
+//	drop:          remove Fields
+//	regex_extract: match Pattern against string Field and set one field per named group
+type TransformConfig struct {
+	Type    string
+	Field   string
+	Target  string
+	Value   interface{}
+	Prefix  string
+	Key     string
+	Fields  []string
+	Pattern string
+}
+
+// ClassifierConfig configures the log level classifier of a task, which runs after the transform chain.
+// The level is decided by the first of these that yields one: the syslog PRI prefix of Source (if Syslog is set),
+// the HTTP status code in StatusField, the first rule whose Pattern matches Source, and finally Default.
+type ClassifierConfig struct {
+	Field       string // field to write the level to, "log_level" if empty
+	Source      string // field to classify, "message" if empty
+	Syslog      bool
+	StatusField string
+	Rules       []ClassifierRule // builtin rules are used if empty
+	Default     string           // "info" if empty
+}
+
+type ClassifierRule struct {
+	Level   string
+	Pattern string
+}
+
+// HostnameConfig configures where a task takes the hostname of a record from. Sources are tried in order:
+//
+//	field:<name>   a field of the record
+//	key            the Kafka record key
+//	header:<name>  a Kafka record header
+//	static:<value> a fixed value
+//
+// The hostname is set to "unknown" if none of them yields a value.
+type HostnameConfig struct {
+	Field   string // field to write the hostname to, "hostname" if empty
+	Sources []string
+}
@@ -0,0 +1,216 @@
+package dlq
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/statistics"
+	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	TypeKafka      = "kafka"
+	TypeClickHouse = "clickhouse"
+	TypeFile       = "file"
+
+	StageTransform = "transform"
+	StageParse     = "parse"
+	StageWrite     = "write"
+
+	defaultBufferSize    = 10000
+	defaultBatchSize     = 1000
+	defaultFlushInterval = 5
+)
+
+// Entry is a record which didn't make it into its table. Rows rejected by ClickHouse no longer know the Kafka
+// record they were built from, so their Value is the row as a JSON object keyed by column, Partition and Offset
+// are -1, and Ranges tells the offsets of the flush the row was built in.
+type Entry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Task      string    `json:"task"`
+	Stage     string    `json:"stage"`
+	Topic     string    `json:"topic"`
+	Partition int32     `json:"partition"`
+	Offset    int64     `json:"offset"`
+	Ranges    string    `json:"ranges,omitempty"` // "partition:begin-end" by partition, separated by commas
+	Key       []byte    `json:"key"`
+	Value     []byte    `json:"value"`
+	Reason    string    `json:"reason"`
+}
+
+// Writer persists dead-letter entries to a destination.
+type Writer interface {
+	Write(entries []*Entry) error
+	Close() error
+}
+
+type queue struct {
+	typ       string
+	writer    Writer
+	ch        chan *Entry
+	batchSize int
+	interval  time.Duration
+	wg        sync.WaitGroup
+}
+
+var (
+	mux sync.RWMutex
+	q   *queue
+)
+
+// Init (re)creates the dead-letter queue as configured by cfg.DeadLetter. A running queue is flushed and closed
+// first. Without DeadLetter, Put just counts the entries as dropped.
+func Init(cfg *config.Config) (err error) {
+	mux.Lock()
+	defer mux.Unlock()
+	if q != nil {
+		q.close()
+		q = nil
+	}
+	dlCfg := cfg.DeadLetter
+	if dlCfg == nil {
+		return
+	}
+	var w Writer
+	switch dlCfg.Type {
+	case TypeKafka:
+		w, err = newKafkaWriter(&cfg.Kafka, dlCfg)
+	case TypeClickHouse:
+		w, err = newClickHouseWriter(&cfg.Clickhouse, dlCfg)
+	case TypeFile:
+		w, err = newFileWriter(dlCfg)
+	default:
+		err = errors.Newf("unknown dead-letter type %q", dlCfg.Type)
+	}
+	if err != nil {
+		return
+	}
+	q = &queue{
+		typ:       dlCfg.Type,
+		writer:    w,
+		ch:        make(chan *Entry, withDefault(dlCfg.BufferSize, defaultBufferSize)),
+		batchSize: withDefault(dlCfg.BatchSize, defaultBatchSize),
+		interval:  time.Duration(withDefault(dlCfg.FlushInterval, defaultFlushInterval)) * time.Second,
+	}
+	q.wg.Add(1)
+	go q.run()
+	util.Logger.Info("started dead-letter queue", zap.String("type", dlCfg.Type))
+	return
+}
+
+// Close writes the queued entries and closes the destination.
+func Close() {
+	mux.Lock()
+	defer mux.Unlock()
+	if q != nil {
+		q.close()
+		q = nil
+	}
+}
+
+// Enabled tells whether a dead-letter queue is configured.
+func Enabled() bool {
+	mux.RLock()
+	defer mux.RUnlock()
+	return q != nil
+}
+
+// FormatRanges formats the offset ranges of a topic for Entry.Ranges.
+func FormatRanges(ranges map[int32]*model.BatchRange) string {
+	partitions := make([]int32, 0, len(ranges))
+	for p := range ranges {
+		partitions = append(partitions, p)
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+	var buf []byte
+	for i, p := range partitions {
+		if i != 0 {
+			buf = append(buf, ',')
+		}
+		r := ranges[p]
+		buf = strconv.AppendInt(buf, int64(p), 10)
+		buf = append(buf, ':')
+		buf = strconv.AppendInt(buf, r.Begin, 10)
+		buf = append(buf, '-')
+		buf = strconv.AppendInt(buf, r.End, 10)
+	}
+	return string(buf)
+}
+
+// Put queues e without blocking, so a slow or broken destination never holds consumption back. The entry is
+// dropped if there's no dead-letter queue or it is full.
+func Put(e *Entry) {
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+	statistics.DeadLetterTotal.WithLabelValues(e.Task, e.Stage).Inc()
+	mux.RLock()
+	defer mux.RUnlock()
+	if q != nil {
+		select {
+		case q.ch <- e:
+			statistics.DeadLetterQueueLength.Inc()
+			return
+		default:
+		}
+	}
+	statistics.DeadLetterDroppedTotal.WithLabelValues(e.Task).Inc()
+}
+
+func (q *queue) run() {
+	defer q.wg.Done()
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+	batch := make([]*Entry, 0, q.batchSize)
+	for {
+		select {
+		case e, ok := <-q.ch:
+			if !ok {
+				q.write(batch)
+				return
+			}
+			if batch = append(batch, e); len(batch) >= q.batchSize {
+				q.write(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			q.write(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (q *queue) write(batch []*Entry) {
+	if len(batch) == 0 {
+		return
+	}
+	statistics.DeadLetterQueueLength.Sub(float64(len(batch)))
+	if err := q.writer.Write(batch); err != nil {
+		util.Logger.Error("failed to write dead-letter records", zap.String("type", q.typ), zap.Int("records", len(batch)), zap.Error(err))
+		statistics.DeadLetterWriteErrorsTotal.WithLabelValues(q.typ).Inc()
+		for _, e := range batch {
+			statistics.DeadLetterDroppedTotal.WithLabelValues(e.Task).Inc()
+		}
+	}
+}
+
+func (q *queue) close() {
+	close(q.ch)
+	q.wg.Wait()
+	if err := q.writer.Close(); err != nil {
+		util.Logger.Warn("failed to close dead-letter destination", zap.String("type", q.typ), zap.Error(err))
+	}
+}
+
+func withDefault(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,184 @@
+package dlq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/input"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/pool"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	produceTimeout = time.Minute
+
+	defaultMaxFileSize = 100
+	defaultMaxFiles    = 10
+
+	createTableSQL = "CREATE TABLE IF NOT EXISTS `%s`.`%s` (" +
+		"`timestamp` DateTime64(3), `task` LowCardinality(String), `stage` LowCardinality(String), " +
+		"`topic` String, `partition` Int32, `offset` Int64, `ranges` String, `key` String, `value` String, `reason` String" +
+		") ENGINE = MergeTree PARTITION BY toYYYYMMDD(timestamp) ORDER BY (task, timestamp)"
+	insertColumns = "`timestamp`,`task`,`stage`,`topic`,`partition`,`offset`,`ranges`,`key`,`value`,`reason`"
+	numColumns    = 10
+)
+
+var (
+	_ Writer = (*kafkaWriter)(nil)
+	_ Writer = (*clickHouseWriter)(nil)
+	_ Writer = (*fileWriter)(nil)
+)
+
+// kafkaWriter produces the original key and value, the rest of an entry goes to headers.
+type kafkaWriter struct {
+	cl *kgo.Client
+}
+
+func newKafkaWriter(kfkCfg *config.KafkaConfig, dlCfg *config.DeadLetterConfig) (w *kafkaWriter, err error) {
+	if dlCfg.Topic == "" {
+		err = errors.Newf("dead-letter type kafka requires a topic")
+		return
+	}
+	var opts []kgo.Opt
+	if opts, err = input.GetFranzConfig(kfkCfg); err != nil {
+		return
+	}
+	opts = append(opts, kgo.DefaultProduceTopic(dlCfg.Topic))
+	w = &kafkaWriter{}
+	if w.cl, err = kgo.NewClient(opts...); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+func (w *kafkaWriter) Write(entries []*Entry) (err error) {
+	recs := make([]*kgo.Record, len(entries))
+	for i, e := range entries {
+		recs[i] = &kgo.Record{
+			Key:       e.Key,
+			Value:     e.Value,
+			Timestamp: e.Timestamp,
+			Headers: []kgo.RecordHeader{
+				{Key: "dlq.task", Value: []byte(e.Task)},
+				{Key: "dlq.stage", Value: []byte(e.Stage)},
+				{Key: "dlq.topic", Value: []byte(e.Topic)},
+				{Key: "dlq.partition", Value: []byte(strconv.Itoa(int(e.Partition)))},
+				{Key: "dlq.offset", Value: []byte(strconv.FormatInt(e.Offset, 10))},
+				{Key: "dlq.ranges", Value: []byte(e.Ranges)},
+				{Key: "dlq.reason", Value: []byte(e.Reason)},
+			},
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), produceTimeout)
+	defer cancel()
+	if err = w.cl.ProduceSync(ctx, recs...).FirstErr(); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+func (w *kafkaWriter) Close() error {
+	w.cl.Close()
+	return nil
+}
+
+// clickHouseWriter inserts into a table of the configured ClickHouse, which is created on the first write.
+type clickHouseWriter struct {
+	db, table  string
+	prepareSQL string
+	created    bool
+	dbVer      int
+}
+
+func newClickHouseWriter(chCfg *config.ClickHouseConfig, dlCfg *config.DeadLetterConfig) (w *clickHouseWriter, err error) {
+	if dlCfg.Table == "" {
+		err = errors.Newf("dead-letter type clickhouse requires a table")
+		return
+	}
+	w = &clickHouseWriter{db: chCfg.DB, table: dlCfg.Table}
+	if idx := strings.Index(dlCfg.Table, "."); idx > 0 {
+		w.db, w.table = dlCfg.Table[:idx], dlCfg.Table[idx+1:]
+	}
+	w.prepareSQL = fmt.Sprintf("INSERT INTO `%s`.`%s` (%s)", w.db, w.table, insertColumns)
+	if chCfg.Protocol == clickhouse.HTTP.String() {
+		w.prepareSQL += " VALUES (" + strings.TrimSuffix(strings.Repeat("?,", numColumns), ",") + ")"
+	}
+	return
+}
+
+func (w *clickHouseWriter) Write(entries []*Entry) (err error) {
+	var conn *pool.Conn
+	if conn, w.dbVer, err = pool.GetShardConn(0).NextGoodReplica(w.dbVer); err != nil {
+		return
+	}
+	if !w.created {
+		if err = conn.Exec(fmt.Sprintf(createTableSQL, w.db, w.table)); err != nil {
+			return errors.Wrapf(err, "failed to create dead-letter table %s.%s", w.db, w.table)
+		}
+		w.created = true
+	}
+	rows := make(model.Rows, len(entries))
+	for i, e := range entries {
+		rows[i] = &model.Row{e.Timestamp, e.Task, e.Stage, e.Topic, e.Partition, e.Offset, e.Ranges, string(e.Key), string(e.Value), e.Reason}
+	}
+	var bad []pool.RowError
+	if bad, err = conn.Write(w.prepareSQL, rows, 0, numColumns); err == nil && len(bad) != 0 {
+		err = errors.Wrapf(bad[0].Err, "%d dead-letter rows rejected", len(bad))
+	}
+	return
+}
+
+func (w *clickHouseWriter) Close() error {
+	return nil
+}
+
+// fileWriter appends NDJSON to Dir/deadletter.ndjson and rotates it by size. Key and value are base64, as records
+// may be binary.
+type fileWriter struct {
+	lj *lumberjack.Logger
+}
+
+func newFileWriter(dlCfg *config.DeadLetterConfig) (w *fileWriter, err error) {
+	if dlCfg.Dir == "" {
+		err = errors.Newf("dead-letter type file requires a dir")
+		return
+	}
+	if err = os.MkdirAll(dlCfg.Dir, 0o755); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	w = &fileWriter{lj: &lumberjack.Logger{
+		Filename:   filepath.Join(dlCfg.Dir, "deadletter.ndjson"),
+		MaxSize:    withDefault(dlCfg.MaxFileSize, defaultMaxFileSize),
+		MaxBackups: withDefault(dlCfg.MaxFiles, defaultMaxFiles),
+	}}
+	return
+}
+
+func (w *fileWriter) Write(entries []*Entry) (err error) {
+	for _, e := range entries {
+		var bs []byte
+		if bs, err = json.Marshal(e); err != nil {
+			return errors.Wrapf(err, "")
+		}
+		if _, err = w.lj.Write(append(bs, '\n')); err != nil {
+			return errors.Wrapf(err, "")
+		}
+	}
+	return
+}
+
+func (w *fileWriter) Close() error {
+	return w.lj.Close()
+}
@@ -0,0 +1,386 @@
+package input
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/statistics"
+	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+)
+
+const (
+	IngestPathPrefix = "/ingest/"
+
+	defaultMaxBodySize = 10 // MB
+	defaultAckTimeout  = 60
+)
+
+// ingestTasks maps the name of a task to the running HTTPInput of its consumer group.
+var ingestTasks sync.Map
+
+// HTTPInput feeds the records POSTed to the tasks of a consumer group to the fetch channel, as if they were
+// consumed from partition 0 of the task's topic. A request is answered once CommitMessages reported the offset of
+// its last record, i.e. once its records have been written.
+//
+// Offsets live in memory and start over, above those of the previous run, with every Init. Records which weren't
+// written when the consumer restarts, e.g. after a Rewind, aren't delivered again: their requests were answered 503
+// and the clients resend them.
+type HTTPInput struct {
+	cfg        *config.Config
+	grpConfig  *config.GroupConfig
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wgRun      sync.WaitGroup
+	fetch      chan *kgo.Fetches
+	topics     map[string]string // task name -> topic
+	apiKeys    [][]byte
+	maxBody    int64
+	maxPending int64
+	ackTimeout time.Duration
+
+	sendMux sync.Mutex // keeps the offsets of the records sent in order
+
+	mux     sync.Mutex
+	offsets map[string]*ingestOffsets
+	pending int64
+	paused  bool
+	changed chan struct{} // closed and replaced whenever an offset is committed
+}
+
+type ingestOffsets struct {
+	next      int64
+	committed int64
+}
+
+func NewHTTPInput() *HTTPInput {
+	return &HTTPInput{}
+}
+
+func (h *HTTPInput) Init(cfg *config.Config, gCfg *config.GroupConfig, f chan *kgo.Fetches, cleanupFn func()) (err error) {
+	h.cfg = cfg
+	h.grpConfig = gCfg
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	h.fetch = f
+	h.topics = make(map[string]string, len(gCfg.Configs))
+	h.offsets = make(map[string]*ingestOffsets, len(gCfg.Configs))
+	// the deduplication tokens of the batches are derived from the offsets, those of an earlier run must not recur
+	base := time.Now().UnixNano()
+	for name, taskCfg := range gCfg.Configs {
+		if taskCfg.Topic == "" {
+			return errors.Newf("%s: http input needs a topic", name)
+		}
+		if _, ok := h.offsets[taskCfg.Topic]; ok {
+			return errors.Newf("%s: topic %s of http input is used by another task", name, taskCfg.Topic)
+		}
+		h.topics[name] = taskCfg.Topic
+		h.offsets[taskCfg.Topic] = &ingestOffsets{next: base, committed: base - 1}
+	}
+	h.changed = make(chan struct{})
+
+	h.maxBody = defaultMaxBodySize
+	h.maxPending = int64(4 * gCfg.BufferSize)
+	h.ackTimeout = defaultAckTimeout * time.Second
+	httpCfg := cfg.HTTPInput
+	if httpCfg == nil || (len(httpCfg.APIKeys) == 0 && !httpCfg.NoAuth) {
+		return errors.Newf("%s: http input needs APIKeys, or NoAuth to serve without authentication", gCfg.Name)
+	}
+	for _, key := range httpCfg.APIKeys {
+		h.apiKeys = append(h.apiKeys, []byte(key))
+	}
+	if httpCfg.MaxBodySize > 0 {
+		h.maxBody = int64(httpCfg.MaxBodySize)
+	}
+	if httpCfg.MaxPending > 0 {
+		h.maxPending = int64(httpCfg.MaxPending)
+	}
+	if httpCfg.AckTimeout > 0 {
+		h.ackTimeout = time.Duration(httpCfg.AckTimeout) * time.Second
+	}
+	h.maxBody <<= 20
+	return
+}
+
+// Run serves the tasks of the consumer group until Stop.
+func (h *HTTPInput) Run() {
+	h.wgRun.Add(1)
+	defer h.wgRun.Done()
+	for name := range h.topics {
+		ingestTasks.Store(name, h)
+	}
+	util.Logger.Info("serving http ingestion", zap.String("consumer group", h.grpConfig.Name), zap.Int("tasks", len(h.topics)))
+	<-h.ctx.Done()
+	for name := range h.topics {
+		ingestTasks.CompareAndDelete(name, h)
+	}
+	util.Logger.Info("HTTPInput.Run quit due to context has been canceled", zap.String("consumer group", h.grpConfig.Name))
+}
+
+// Pause rejects requests with 429 until Resume.
+func (h *HTTPInput) Pause() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.paused {
+		return
+	}
+	h.paused = true
+	util.Logger.Warn("paused consumer group", zap.String("consumer group", h.grpConfig.Name))
+}
+
+func (h *HTTPInput) Resume() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if !h.paused {
+		return
+	}
+	h.paused = false
+	util.Logger.Info("resumed consumer group", zap.String("consumer group", h.grpConfig.Name))
+}
+
+func (h *HTTPInput) CommitMessages(msg *model.InputMessage) error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	o, ok := h.offsets[msg.Topic]
+	if !ok || msg.Offset <= o.committed {
+		return nil
+	}
+	h.pending -= msg.Offset - o.committed
+	o.committed = msg.Offset
+	statistics.IngestPendingRecords.WithLabelValues(h.grpConfig.Name).Set(float64(h.pending))
+	close(h.changed)
+	h.changed = make(chan struct{})
+	return nil
+}
+
+func (h *HTTPInput) Stop() {
+	h.cancel()
+	h.wgRun.Wait()
+}
+
+func (h *HTTPInput) Description() string {
+	return fmt.Sprint("http input of consumer group ", h.grpConfig.Name)
+}
+
+// IngestHandler serves POSTs to IngestPathPrefix + <task name>.
+func IngestHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, IngestPathPrefix)
+		v, ok := ingestTasks.Load(name)
+		if !ok {
+			http.Error(w, fmt.Sprintf("no http input for task %q", name), http.StatusNotFound)
+			return
+		}
+		code := v.(*HTTPInput).serve(w, r, name)
+		statistics.IngestRequestsTotal.WithLabelValues(name, strconv.Itoa(code)).Inc()
+	})
+}
+
+func (h *HTTPInput) serve(w http.ResponseWriter, r *http.Request, task string) int {
+	fail := func(code int, msg string) int {
+		http.Error(w, msg, code)
+		return code
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return fail(http.StatusMethodNotAllowed, "only POST is supported")
+	}
+	if !h.authorized(r) {
+		return fail(http.StatusUnauthorized, "missing or invalid api key")
+	}
+
+	body := r.Body
+	switch strings.ToLower(r.Header.Get("Content-Encoding")) {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return fail(http.StatusBadRequest, fmt.Sprintf("invalid gzip body: %v", err))
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		return fail(http.StatusUnsupportedMediaType, "unsupported content encoding "+r.Header.Get("Content-Encoding"))
+	}
+	values, err := readValues(http.MaxBytesReader(w, body, h.maxBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return fail(http.StatusRequestEntityTooLarge, fmt.Sprintf("body exceeds %d bytes", h.maxBody))
+		}
+		return fail(http.StatusBadRequest, err.Error())
+	}
+	if len(values) == 0 {
+		return fail(http.StatusBadRequest, "no records in body")
+	}
+
+	n := int64(len(values))
+	h.mux.Lock()
+	full := h.paused || h.pending+n > h.maxPending
+	if !full {
+		h.pending += n
+		statistics.IngestPendingRecords.WithLabelValues(h.grpConfig.Name).Set(float64(h.pending))
+	}
+	h.mux.Unlock()
+	if full {
+		w.Header().Set("Retry-After", strconv.Itoa(h.grpConfig.FlushInterval))
+		return fail(http.StatusTooManyRequests, "ingestion is busy, retry later")
+	}
+
+	last, err := h.send(r.Context(), h.topics[task], values)
+	if err != nil {
+		h.mux.Lock()
+		h.pending -= n
+		statistics.IngestPendingRecords.WithLabelValues(h.grpConfig.Name).Set(float64(h.pending))
+		h.mux.Unlock()
+		return fail(http.StatusServiceUnavailable, err.Error())
+	}
+	statistics.IngestRecordsTotal.WithLabelValues(task).Add(float64(n))
+
+	if code, msg := h.waitCommitted(r.Context(), h.topics[task], last); code != http.StatusOK {
+		return fail(code, msg)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = fmt.Fprintf(w, "{\"accepted\":%d}\n", n)
+	return http.StatusOK
+}
+
+// authorized accepts the key of the X-API-Key header, or of an "ApiKey" or "Bearer" Authorization header. Without
+// keys, which takes NoAuth, it accepts anything.
+func (h *HTTPInput) authorized(r *http.Request) bool {
+	if len(h.apiKeys) == 0 {
+		return true
+	}
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		auth := r.Header.Get("Authorization")
+		for _, scheme := range []string{"ApiKey ", "Bearer "} {
+			if len(auth) > len(scheme) && strings.EqualFold(auth[:len(scheme)], scheme) {
+				key = strings.TrimSpace(auth[len(scheme):])
+				break
+			}
+		}
+	}
+	if key == "" {
+		return false
+	}
+	for _, k := range h.apiKeys {
+		if subtle.ConstantTimeCompare(k, []byte(key)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// readValues reads a JSON array, or a stream of JSON values such as NDJSON.
+func readValues(r io.Reader) (values [][]byte, err error) {
+	br := bufio.NewReader(r)
+	var first byte
+	for {
+		if first, err = br.ReadByte(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		if first != ' ' && first != '\t' && first != '\r' && first != '\n' {
+			break
+		}
+	}
+	if err = br.UnreadByte(); err != nil {
+		return
+	}
+	dec := json.NewDecoder(br)
+	if first == '[' {
+		if _, err = dec.Token(); err != nil {
+			return nil, errors.Wrapf(err, "invalid json array")
+		}
+		for dec.More() {
+			var v json.RawMessage
+			if err = dec.Decode(&v); err != nil {
+				return nil, errors.Wrapf(err, "invalid record %d", len(values))
+			}
+			values = append(values, v)
+		}
+		if _, err = dec.Token(); err != nil {
+			return nil, errors.Wrapf(err, "invalid json array")
+		}
+		return
+	}
+	for {
+		var v json.RawMessage
+		if err = dec.Decode(&v); err != nil {
+			if err == io.EOF {
+				return values, nil
+			}
+			return nil, errors.Wrapf(err, "invalid record %d", len(values))
+		}
+		values = append(values, v)
+	}
+}
+
+// send passes the values to processFetch, it returns the offset of the last one.
+func (h *HTTPInput) send(ctx context.Context, topic string, values [][]byte) (last int64, err error) {
+	h.sendMux.Lock()
+	defer h.sendMux.Unlock()
+	h.mux.Lock()
+	next := h.offsets[topic].next
+	h.mux.Unlock()
+
+	now := time.Now()
+	recs := make([]*kgo.Record, len(values))
+	for i, v := range values {
+		recs[i] = &kgo.Record{Topic: topic, Partition: 0, Offset: next + int64(i), Value: v, Timestamp: now}
+	}
+	fetches := kgo.Fetches{{Topics: []kgo.FetchTopic{{
+		Topic:      topic,
+		Partitions: []kgo.FetchPartition{{Partition: 0, Records: recs}},
+	}}}}
+	select {
+	case h.fetch <- &fetches:
+	case <-h.ctx.Done():
+		return 0, errors.Newf("input of consumer group %s stopped", h.grpConfig.Name)
+	case <-ctx.Done():
+		return 0, errors.Newf("request canceled")
+	}
+	h.mux.Lock()
+	h.offsets[topic].next = next + int64(len(recs))
+	h.mux.Unlock()
+	return next + int64(len(recs)) - 1, nil
+}
+
+func (h *HTTPInput) waitCommitted(ctx context.Context, topic string, offset int64) (code int, msg string) {
+	t := time.NewTimer(h.ackTimeout)
+	defer t.Stop()
+	for {
+		h.mux.Lock()
+		done := h.offsets[topic].committed >= offset
+		changed := h.changed
+		h.mux.Unlock()
+		if done {
+			return http.StatusOK, ""
+		}
+		select {
+		case <-changed:
+		case <-t.C:
+			return http.StatusGatewayTimeout, "records were accepted but not written in time, they may be written later"
+		case <-h.ctx.Done():
+			return http.StatusServiceUnavailable, "input stopped before the records were written, resend them"
+		case <-ctx.Done():
+			return http.StatusServiceUnavailable, "request canceled"
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package input
+
+import (
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+const (
+	InputKafka  = "kafka"
+	InputHTTP   = "http"
+	InputSyslog = "syslog"
+)
+
+// Inputer feeds the records of a consumer group to its fetch channel. Offsets are committed once the records up
+// to them have been written.
+type Inputer interface {
+	Init(cfg *config.Config, gCfg *config.GroupConfig, f chan *kgo.Fetches, cleanupFn func()) error
+	Run()
+	Pause()
+	Resume()
+	CommitMessages(msg *model.InputMessage) error
+	Stop()
+	Description() string
+}
+
+// NewInputer returns the input the tasks of a consumer group share.
+func NewInputer(gCfg *config.GroupConfig) (Inputer, error) {
+	kind, err := groupInput(gCfg)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case InputHTTP:
+		return NewHTTPInput(), nil
+	case InputSyslog:
+		return NewSyslogInput(), nil
+	default:
+		return NewKafkaFranz(), nil
+	}
+}
+
+// IsKafkaGroup tells whether a consumer group consumes from Kafka.
+func IsKafkaGroup(gCfg *config.GroupConfig) bool {
+	kind, _ := groupInput(gCfg)
+	return kind == InputKafka
+}
+
+func groupInput(gCfg *config.GroupConfig) (kind string, err error) {
+	for name, taskCfg := range gCfg.Configs {
+		cur := taskCfg.Input
+		if cur == "" {
+			cur = InputKafka
+		}
+		if cur != InputKafka && cur != InputHTTP && cur != InputSyslog {
+			return "", errors.Newf("%s: unknown input %s", name, cur)
+		}
+		if kind != "" && kind != cur {
+			return "", errors.Newf("consumer group %s mixes %s and %s inputs", gCfg.Name, kind, cur)
+		}
+		kind = cur
+	}
+	if kind == "" {
+		kind = InputKafka
+	}
+	return
+}
@@ -37,6 +37,9 @@ type KafkaFranz struct {
 	wgRun     sync.WaitGroup
 	fetch     chan *kgo.Fetches
 	cleanupFn func()
+
+	pauseMux sync.Mutex
+	resumeCh chan struct{} // non-nil while paused
 }
 
 func NewKafkaFranz() *KafkaFranz {
@@ -149,6 +152,9 @@ func (k *KafkaFranz) Run() {
 	defer k.wgRun.Done()
 LOOP:
 	for {
+		if !k.waitResumed() {
+			break
+		}
 		fetches := k.cl.PollRecords(k.ctx, k.grpConfig.BufferSize)
 		err := fetches.Err()
 		if fetches == nil || fetches.IsClientClosed() || errors.Is(err, context.Canceled) {
@@ -162,20 +168,74 @@ LOOP:
 		util.Logger.Debug("Records fetched", zap.String("records", strconv.Itoa(fetches.NumRecords())), zap.String("consumer group", k.grpConfig.Name))
 
 		t := time.NewTimer(processTimeOut * time.Minute)
-		select {
-		case k.fetch <- &fetches:
-			t.Stop()
-		case <-k.ctx.Done():
-			t.Stop()
-			break LOOP
-		case <-t.C:
-			util.Logger.Fatal(fmt.Sprintf("Sinker abort because group %s was not processing in last %d minutes", k.grpConfig.Name, processTimeOut))
+	SEND:
+		for {
+			select {
+			case k.fetch <- &fetches:
+				t.Stop()
+				break SEND
+			case <-k.ctx.Done():
+				t.Stop()
+				break LOOP
+			case <-t.C:
+				// a paused group waits for the spilled batches of its tasks, however long they take
+				if !k.paused() {
+					util.Logger.Fatal(fmt.Sprintf("Sinker abort because group %s was not processing in last %d minutes", k.grpConfig.Name, processTimeOut))
+				}
+				t.Reset(processTimeOut * time.Minute)
+			}
 		}
 	}
 	k.cl.Close()
 	util.Logger.Info("KafkaFranz.Run quit due to context has been canceled", zap.String("consumer group", k.grpConfig.Name))
 }
 
+// Pause stops polling until Resume. Records which were already polled are still delivered.
+func (k *KafkaFranz) Pause() {
+	k.pauseMux.Lock()
+	defer k.pauseMux.Unlock()
+	if k.resumeCh != nil {
+		return
+	}
+	k.resumeCh = make(chan struct{})
+	k.cl.PauseFetchTopics(k.grpConfig.Topics...)
+	util.Logger.Warn("paused consumer group", zap.String("consumer group", k.grpConfig.Name))
+}
+
+func (k *KafkaFranz) Resume() {
+	k.pauseMux.Lock()
+	defer k.pauseMux.Unlock()
+	if k.resumeCh == nil {
+		return
+	}
+	k.cl.ResumeFetchTopics(k.grpConfig.Topics...)
+	close(k.resumeCh)
+	k.resumeCh = nil
+	util.Logger.Info("resumed consumer group", zap.String("consumer group", k.grpConfig.Name))
+}
+
+func (k *KafkaFranz) paused() bool {
+	k.pauseMux.Lock()
+	defer k.pauseMux.Unlock()
+	return k.resumeCh != nil
+}
+
+// waitResumed blocks while paused, it returns false if the consumer is stopped meanwhile.
+func (k *KafkaFranz) waitResumed() bool {
+	k.pauseMux.Lock()
+	ch := k.resumeCh
+	k.pauseMux.Unlock()
+	if ch == nil {
+		return true
+	}
+	select {
+	case <-ch:
+		return true
+	case <-k.ctx.Done():
+		return false
+	}
+}
+
 func (k *KafkaFranz) CommitMessages(msg *model.InputMessage) error {
 	var err error
 	for i := 0; i < CommitRetries; i++ {
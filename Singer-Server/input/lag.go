@@ -0,0 +1,298 @@
+package input
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/statistics"
+	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultLagInterval     = 30
+	defaultLagStallTimeout = 300
+
+	// weight of the latest observation in the smoothed rates
+	lagRateAlpha = 0.3
+)
+
+// LagCollector periodically compares the committed offsets of the consumer groups with the end offsets of their
+// partitions, and estimates how long each group needs to catch up.
+type LagCollector struct {
+	kfkCfg       config.KafkaConfig
+	lagCfg       config.LagMonitorConfig
+	groups       map[string][]string // consumer group -> sorted topics
+	interval     time.Duration
+	stallTimeout time.Duration
+
+	adm    *kadm.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// accessed by run only
+	parts map[partitionKey]*partitionLag
+}
+
+type partitionKey struct {
+	group     string
+	topic     string
+	partition int32
+}
+
+type partitionLag struct {
+	committed, end int64
+	lag            int64
+	at             time.Time
+	// smoothed messages per second, known after a second observation
+	consumeRate, produceRate float64
+	rated                    bool
+
+	movedAt    time.Time // the committed offset moved last
+	lagAtMoved int64
+	stalled    bool
+}
+
+// NewLagCollector creates a collector of the consumer groups of cfg.
+func NewLagCollector(cfg *config.Config) (lc *LagCollector, err error) {
+	lc = &LagCollector{
+		kfkCfg: cfg.Kafka,
+		lagCfg: *cfg.LagMonitor,
+		groups: lagGroups(cfg),
+		parts:  make(map[partitionKey]*partitionLag),
+	}
+	lc.interval = time.Duration(lc.lagCfg.Interval) * time.Second
+	if lc.interval <= 0 {
+		lc.interval = defaultLagInterval * time.Second
+	}
+	lc.stallTimeout = time.Duration(lc.lagCfg.StallTimeout) * time.Second
+	if lc.stallTimeout <= 0 {
+		lc.stallTimeout = defaultLagStallTimeout * time.Second
+	}
+	var opts []kgo.Opt
+	if opts, err = GetFranzConfig(&cfg.Kafka); err != nil {
+		return
+	}
+	var cl *kgo.Client
+	if cl, err = kgo.NewClient(opts...); err != nil {
+		return nil, errors.Wrapf(err, "")
+	}
+	lc.adm = kadm.NewClient(cl)
+	lc.ctx, lc.cancel = context.WithCancel(context.Background())
+	return
+}
+
+func lagGroups(cfg *config.Config) map[string][]string {
+	groups := make(map[string][]string, len(cfg.Groups))
+	for name, grp := range cfg.Groups {
+		if !IsKafkaGroup(grp) {
+			continue
+		}
+		topics := append([]string(nil), grp.Topics...)
+		sort.Strings(topics)
+		groups[name] = topics
+	}
+	return groups
+}
+
+// Changed tells whether cfg needs another collector.
+func (lc *LagCollector) Changed(cfg *config.Config) bool {
+	return cfg.LagMonitor == nil || !reflect.DeepEqual(*cfg.LagMonitor, lc.lagCfg) ||
+		!reflect.DeepEqual(cfg.Kafka, lc.kfkCfg) || !reflect.DeepEqual(lagGroups(cfg), lc.groups)
+}
+
+// Start collects at once, and then every interval until Stop.
+func (lc *LagCollector) Start() {
+	lc.wg.Add(1)
+	go lc.run()
+}
+
+func (lc *LagCollector) run() {
+	defer lc.wg.Done()
+	ticker := time.NewTicker(lc.interval)
+	defer ticker.Stop()
+	for {
+		lc.collect()
+		select {
+		case <-ticker.C:
+		case <-lc.ctx.Done():
+			return
+		}
+	}
+}
+
+// Stop waits for the collection to quit, and removes the metrics of the collector.
+func (lc *LagCollector) Stop() {
+	lc.cancel()
+	lc.wg.Wait()
+	lc.adm.Close()
+	for key := range lc.parts {
+		lc.forget(key)
+	}
+	for group, topics := range lc.groups {
+		for _, topic := range topics {
+			statistics.ConsumerCatchUpSeconds.DeleteLabelValues(group, topic)
+		}
+	}
+}
+
+func (lc *LagCollector) collect() {
+	for group, topics := range lc.groups {
+		if err := lc.collectGroup(group, topics); err != nil {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			statistics.LagCollectErrorsTotal.WithLabelValues(group).Inc()
+			util.Logger.Warn("failed to collect consumer lag", zap.String("consumer group", group), zap.Error(err))
+		}
+	}
+}
+
+func (lc *LagCollector) collectGroup(group string, topics []string) (err error) {
+	ctx, cancel := context.WithTimeout(lc.ctx, lc.interval)
+	defer cancel()
+	var ends, starts kadm.ListedOffsets
+	var commits kadm.OffsetResponses
+	if ends, err = lc.adm.ListEndOffsets(ctx, topics...); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	if commits, err = lc.adm.FetchOffsetsForTopics(ctx, group, topics...); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	now := time.Now()
+	type topicLag struct {
+		lag                      int64
+		consumeRate, produceRate float64
+		rated                    bool
+	}
+	topicLags := make(map[string]*topicLag, len(topics))
+	seen := make(map[partitionKey]struct{})
+	ends.Each(func(end kadm.ListedOffset) {
+		if err != nil || end.Err != nil || end.Partition < 0 {
+			return
+		}
+		committed := int64(-1)
+		if c, ok := commits.Lookup(end.Topic, end.Partition); ok && c.Err == nil {
+			committed = c.At
+		}
+		if committed < 0 {
+			// nothing committed yet, the group starts from the log start at worst
+			if starts == nil {
+				if starts, err = lc.adm.ListStartOffsets(ctx, topics...); err != nil {
+					err = errors.Wrapf(err, "")
+					return
+				}
+			}
+			start, ok := starts.Lookup(end.Topic, end.Partition)
+			if !ok || start.Err != nil {
+				return
+			}
+			committed = start.Offset
+		}
+		key := partitionKey{group, end.Topic, end.Partition}
+		seen[key] = struct{}{}
+		pl := lc.update(key, committed, end.Offset, now)
+		tl := topicLags[end.Topic]
+		if tl == nil {
+			tl = &topicLag{rated: true}
+			topicLags[end.Topic] = tl
+		}
+		tl.lag += pl.lag
+		tl.consumeRate += pl.consumeRate
+		tl.produceRate += pl.produceRate
+		tl.rated = tl.rated && pl.rated
+	})
+	if err != nil {
+		return
+	}
+	for key := range lc.parts {
+		if _, ok := seen[key]; !ok && key.group == group {
+			lc.forget(key)
+		}
+	}
+	for topic, tl := range topicLags {
+		if !tl.rated {
+			continue
+		}
+		var seconds float64
+		if tl.lag > 0 {
+			if tl.consumeRate > tl.produceRate {
+				seconds = float64(tl.lag) / (tl.consumeRate - tl.produceRate)
+			} else {
+				seconds = math.Inf(1)
+			}
+		}
+		statistics.ConsumerCatchUpSeconds.WithLabelValues(group, topic).Set(seconds)
+	}
+	return
+}
+
+// update records the offsets of a partition, and flags it stalled if its committed offset stayed put for the stall
+// timeout while its lag grew.
+func (lc *LagCollector) update(key partitionKey, committed, end int64, now time.Time) *partitionLag {
+	lag := end - committed
+	if lag < 0 {
+		lag = 0
+	}
+	pl := lc.parts[key]
+	if pl == nil {
+		pl = &partitionLag{movedAt: now, lagAtMoved: lag}
+		lc.parts[key] = pl
+	} else if dt := now.Sub(pl.at).Seconds(); dt > 0 {
+		consumeRate, produceRate := float64(committed-pl.committed)/dt, float64(end-pl.end)/dt
+		if pl.rated {
+			pl.consumeRate = smooth(pl.consumeRate, consumeRate)
+			pl.produceRate = smooth(pl.produceRate, produceRate)
+		} else if consumeRate >= 0 && produceRate >= 0 {
+			pl.consumeRate, pl.produceRate, pl.rated = consumeRate, produceRate, true
+		}
+		if committed != pl.committed {
+			pl.movedAt, pl.lagAtMoved = now, lag
+		}
+	}
+	pl.committed, pl.end, pl.lag, pl.at = committed, end, lag, now
+
+	partition := strconv.Itoa(int(key.partition))
+	statistics.ConsumerLag.WithLabelValues(key.group, key.topic, partition).Set(float64(lag))
+	stalled := now.Sub(pl.movedAt) >= lc.stallTimeout && lag > pl.lagAtMoved
+	if stalled && !pl.stalled {
+		util.Logger.Warn("consumer stalled on partition", zap.String("consumer group", key.group),
+			zap.String("topic", key.topic), zap.Int32("partition", key.partition), zap.Int64("offset", committed),
+			zap.Int64("lag", lag), zap.Duration("since", now.Sub(pl.movedAt)))
+	} else if !stalled && pl.stalled {
+		util.Logger.Info("consumer recovered on partition", zap.String("consumer group", key.group),
+			zap.String("topic", key.topic), zap.Int32("partition", key.partition), zap.Int64("lag", lag))
+	}
+	pl.stalled = stalled
+	var flag float64
+	if stalled {
+		flag = 1
+	}
+	statistics.ConsumerPartitionStalled.WithLabelValues(key.group, key.topic, partition).Set(flag)
+	return pl
+}
+
+func (lc *LagCollector) forget(key partitionKey) {
+	partition := strconv.Itoa(int(key.partition))
+	statistics.ConsumerLag.DeleteLabelValues(key.group, key.topic, partition)
+	statistics.ConsumerPartitionStalled.DeleteLabelValues(key.group, key.topic, partition)
+	delete(lc.parts, key)
+}
+
+func smooth(prev, cur float64) float64 {
+	if cur < 0 {
+		// offsets went back, e.g. after a reset of the group
+		return prev
+	}
+	return lagRateAlpha*cur + (1-lagRateAlpha)*prev
+}
@@ -0,0 +1,465 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/statistics"
+	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+)
+
+const (
+	// SyslogPeerHeader is the header of a syslog record which holds the address of the sender
+	SyslogPeerHeader = "peer_addr"
+
+	defaultSyslogMaxMessageSize = 64 << 10
+	// received messages are passed on at least this often, processFetch batches them further
+	syslogLinger = 100 * time.Millisecond
+)
+
+// SyslogInput feeds the messages received by the syslog listeners of the tasks of a consumer group to the fetch
+// channel, as if they were consumed from partition 0 of the task's topic. The key of a record is the IP of the
+// sender and its SyslogPeerHeader the address, the message is passed on as received. Syslog has no
+// acknowledgement, so offsets aren't committed anywhere.
+type SyslogInput struct {
+	cfg       *config.Config
+	grpConfig *config.GroupConfig
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wgRun     sync.WaitGroup
+	wgConn    sync.WaitGroup // of the listeners and connections
+	fetch     chan *kgo.Fetches
+	recCh     chan *kgo.Record
+	listeners []*syslogListener
+	offsets   map[string]int64 // next offset of a topic
+
+	connMux sync.Mutex
+	conns   map[net.Conn]struct{}
+	closed  bool
+
+	pauseMux sync.Mutex
+	resumeCh chan struct{} // non-nil while paused
+}
+
+type syslogListener struct {
+	task      string
+	topic     string
+	transport string
+	maxSize   int
+	ln        net.Listener   // of TCP and TLS
+	pc        net.PacketConn // of UDP
+}
+
+func NewSyslogInput() *SyslogInput {
+	return &SyslogInput{}
+}
+
+func (s *SyslogInput) Init(cfg *config.Config, gCfg *config.GroupConfig, f chan *kgo.Fetches, cleanupFn func()) (err error) {
+	s.cfg = cfg
+	s.grpConfig = gCfg
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.fetch = f
+	s.recCh = make(chan *kgo.Record, gCfg.BufferSize)
+	s.offsets = make(map[string]int64, len(gCfg.Configs))
+	s.conns = make(map[net.Conn]struct{})
+	for name, taskCfg := range gCfg.Configs {
+		if err = s.listen(name, taskCfg); err != nil {
+			s.closeListeners()
+			return
+		}
+	}
+	return
+}
+
+func (s *SyslogInput) listen(name string, taskCfg *config.TaskConfig) (err error) {
+	sc := taskCfg.Syslog
+	if sc == nil || (sc.UDP == "" && sc.TCP == "" && sc.TLS == "") {
+		return errors.Newf("%s: syslog input needs a listen address", name)
+	}
+	if taskCfg.Topic == "" {
+		return errors.Newf("%s: syslog input needs a topic", name)
+	}
+	if _, ok := s.offsets[taskCfg.Topic]; ok {
+		return errors.Newf("%s: topic %s of syslog input is used by another task", name, taskCfg.Topic)
+	}
+	s.offsets[taskCfg.Topic] = 0
+	maxSize := defaultSyslogMaxMessageSize
+	if sc.MaxMessageSize > 0 {
+		maxSize = sc.MaxMessageSize
+	}
+	newListener := func(transport string) *syslogListener {
+		l := &syslogListener{task: name, topic: taskCfg.Topic, transport: transport, maxSize: maxSize}
+		s.listeners = append(s.listeners, l)
+		return l
+	}
+	if sc.UDP != "" {
+		l := newListener("udp")
+		if l.pc, err = net.ListenPacket("udp", sc.UDP); err != nil {
+			return errors.Wrapf(err, "%s: syslog udp listener", name)
+		}
+	}
+	if sc.TCP != "" {
+		l := newListener("tcp")
+		if l.ln, err = net.Listen("tcp", sc.TCP); err != nil {
+			return errors.Wrapf(err, "%s: syslog tcp listener", name)
+		}
+	}
+	if sc.TLS != "" {
+		var tlsCfg *tls.Config
+		if tlsCfg, err = syslogTLSConfig(sc); err != nil {
+			return errors.Wrapf(err, "%s: syslog tls listener", name)
+		}
+		l := newListener("tls")
+		if l.ln, err = tls.Listen("tcp", sc.TLS, tlsCfg); err != nil {
+			return errors.Wrapf(err, "%s: syslog tls listener", name)
+		}
+	}
+	return
+}
+
+func syslogTLSConfig(sc *config.SyslogInputConfig) (tlsCfg *tls.Config, err error) {
+	var cert tls.Certificate
+	if cert, err = tls.LoadX509KeyPair(sc.CertFile, sc.KeyFile); err != nil {
+		return nil, errors.Wrapf(err, "")
+	}
+	tlsCfg = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if sc.CaCertFile != "" {
+		var pem []byte
+		if pem, err = os.ReadFile(sc.CaCertFile); err != nil {
+			return nil, errors.Wrapf(err, "")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Newf("no certificate in %s", sc.CaCertFile)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return
+}
+
+// Run serves the listeners and passes what they received on until Stop.
+func (s *SyslogInput) Run() {
+	s.wgRun.Add(1)
+	defer s.wgRun.Done()
+	for _, l := range s.listeners {
+		s.wgConn.Add(1)
+		if l.pc != nil {
+			go s.serveUDP(l)
+		} else {
+			go s.serveStream(l)
+		}
+		util.Logger.Info("serving syslog", zap.String("task", l.task), zap.String("transport", l.transport),
+			zap.String("address", l.addr()))
+	}
+
+	var recs []*kgo.Record
+	ticker := time.NewTicker(syslogLinger)
+	defer ticker.Stop()
+LOOP:
+	for {
+		select {
+		case rec := <-s.recCh:
+			if recs = append(recs, rec); len(recs) < s.grpConfig.BufferSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(recs) == 0 {
+				continue
+			}
+		case <-s.ctx.Done():
+			break LOOP
+		}
+		if !s.send(recs) {
+			break LOOP
+		}
+		recs = nil
+	}
+	s.closeListeners()
+	s.wgConn.Wait()
+	util.Logger.Info("SyslogInput.Run quit due to context has been canceled", zap.String("consumer group", s.grpConfig.Name))
+}
+
+// send passes records to processFetch, it returns false if the input is stopped meanwhile.
+func (s *SyslogInput) send(recs []*kgo.Record) bool {
+	byTopic := make(map[string][]*kgo.Record)
+	for _, rec := range recs {
+		rec.Offset = s.offsets[rec.Topic]
+		s.offsets[rec.Topic]++
+		byTopic[rec.Topic] = append(byTopic[rec.Topic], rec)
+	}
+	var fetch kgo.Fetch
+	for topic, topicRecs := range byTopic {
+		fetch.Topics = append(fetch.Topics, kgo.FetchTopic{
+			Topic:      topic,
+			Partitions: []kgo.FetchPartition{{Partition: 0, Records: topicRecs}},
+		})
+	}
+	fetches := kgo.Fetches{fetch}
+
+	// meanwhile the listeners block once recCh is full, which pushes back on TCP senders
+	t := time.NewTicker(processTimeOut * time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case s.fetch <- &fetches:
+			return true
+		case <-s.ctx.Done():
+			return false
+		case <-t.C:
+			util.Logger.Warn(fmt.Sprintf("group %s was not processing in last %d minutes", s.grpConfig.Name, processTimeOut))
+		}
+	}
+}
+
+func (s *SyslogInput) serveStream(l *syslogListener) {
+	defer s.wgConn.Done()
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if s.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			statistics.SyslogErrorsTotal.WithLabelValues(l.task, l.transport).Inc()
+			util.Logger.Warn("failed to accept syslog connection", zap.String("task", l.task), zap.Error(err))
+			select {
+			case <-time.After(time.Second):
+			case <-s.ctx.Done():
+				return
+			}
+			continue
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return
+		}
+		go s.serveConn(l, conn)
+	}
+}
+
+// track registers a connection to be closed by Stop, it returns false if the input is stopping.
+func (s *SyslogInput) track(conn net.Conn) bool {
+	s.connMux.Lock()
+	defer s.connMux.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wgConn.Add(1)
+	return true
+}
+
+func (s *SyslogInput) serveConn(l *syslogListener, conn net.Conn) {
+	statistics.SyslogConnections.WithLabelValues(l.task, l.transport).Inc()
+	defer func() {
+		s.connMux.Lock()
+		delete(s.conns, conn)
+		s.connMux.Unlock()
+		conn.Close()
+		statistics.SyslogConnections.WithLabelValues(l.task, l.transport).Dec()
+		s.wgConn.Done()
+	}()
+	peer := conn.RemoteAddr()
+	r := bufio.NewReader(conn)
+	for {
+		if !s.waitResumed() {
+			return
+		}
+		msg, err := readFrame(r, l.maxSize)
+		if err != nil {
+			if err != io.EOF && s.ctx.Err() == nil {
+				statistics.SyslogErrorsTotal.WithLabelValues(l.task, l.transport).Inc()
+				util.Logger.Warn("closed syslog connection", zap.String("task", l.task), zap.String("peer", peer.String()), zap.Error(err))
+			}
+			return
+		}
+		if len(msg) != 0 && !s.put(l, msg, peer) {
+			return
+		}
+	}
+}
+
+// readFrame reads a message framed by octet counting ("MSG-LEN SP SYSLOG-MSG") or terminated by LF, see RFC 6587.
+// A syslog message starts with "<", so a leading digit can only be a length.
+func readFrame(r *bufio.Reader, maxSize int) (msg []byte, err error) {
+	var b byte
+	if b, err = r.ReadByte(); err != nil {
+		return
+	}
+	if b >= '1' && b <= '9' {
+		n := int(b - '0')
+		for {
+			if b, err = r.ReadByte(); err != nil {
+				return nil, errors.Newf("incomplete octet count")
+			}
+			if b == ' ' {
+				break
+			}
+			if b < '0' || b > '9' || n > maxSize {
+				return nil, errors.Newf("invalid octet count")
+			}
+			n = n*10 + int(b-'0')
+		}
+		if n > maxSize {
+			return nil, errors.Newf("message of %d bytes exceeds %d", n, maxSize)
+		}
+		msg = make([]byte, n)
+		if _, err = io.ReadFull(r, msg); err != nil {
+			return nil, errors.Newf("incomplete message of %d bytes", n)
+		}
+		return
+	}
+	if err = r.UnreadByte(); err != nil {
+		return
+	}
+	for {
+		var frag []byte
+		frag, err = r.ReadSlice('\n')
+		if msg = append(msg, frag...); len(msg) > maxSize+2 {
+			return nil, errors.Newf("message exceeds %d bytes", maxSize)
+		}
+		if err == nil || (err == io.EOF && len(msg) != 0) {
+			return bytes.TrimRight(msg, "\r\n"), nil
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+}
+
+func (s *SyslogInput) serveUDP(l *syslogListener) {
+	defer s.wgConn.Done()
+	buf := make([]byte, l.maxSize)
+	for {
+		if !s.waitResumed() {
+			return
+		}
+		n, peer, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			if s.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			statistics.SyslogErrorsTotal.WithLabelValues(l.task, l.transport).Inc()
+			util.Logger.Warn("failed to read syslog datagram", zap.String("task", l.task), zap.Error(err))
+			continue
+		}
+		msg := bytes.TrimRight(buf[:n], "\r\n")
+		if len(msg) != 0 && !s.put(l, append([]byte(nil), msg...), peer) {
+			return
+		}
+	}
+}
+
+// put queues a message for Run, it returns false if the input is stopped meanwhile. A full queue blocks the
+// readers, which leaves TCP senders to their flow control and UDP datagrams to the socket buffer.
+func (s *SyslogInput) put(l *syslogListener, msg []byte, peer net.Addr) bool {
+	addr := peer.String()
+	ip := addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		ip = host
+	}
+	rec := &kgo.Record{
+		Topic:     l.topic,
+		Key:       []byte(ip),
+		Value:     msg,
+		Headers:   []kgo.RecordHeader{{Key: SyslogPeerHeader, Value: []byte(addr)}},
+		Timestamp: time.Now(),
+	}
+	statistics.SyslogMessagesTotal.WithLabelValues(l.task, l.transport).Inc()
+	select {
+	case s.recCh <- rec:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+func (s *SyslogInput) closeListeners() {
+	for _, l := range s.listeners {
+		if l.ln != nil {
+			l.ln.Close()
+		}
+		if l.pc != nil {
+			l.pc.Close()
+		}
+	}
+	s.connMux.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connMux.Unlock()
+}
+
+// Pause stops reading until Resume. Messages which were already read are still delivered.
+func (s *SyslogInput) Pause() {
+	s.pauseMux.Lock()
+	defer s.pauseMux.Unlock()
+	if s.resumeCh != nil {
+		return
+	}
+	s.resumeCh = make(chan struct{})
+	util.Logger.Warn("paused consumer group", zap.String("consumer group", s.grpConfig.Name))
+}
+
+func (s *SyslogInput) Resume() {
+	s.pauseMux.Lock()
+	defer s.pauseMux.Unlock()
+	if s.resumeCh == nil {
+		return
+	}
+	close(s.resumeCh)
+	s.resumeCh = nil
+	util.Logger.Info("resumed consumer group", zap.String("consumer group", s.grpConfig.Name))
+}
+
+// waitResumed blocks while paused, it returns false if the input is stopped meanwhile.
+func (s *SyslogInput) waitResumed() bool {
+	s.pauseMux.Lock()
+	ch := s.resumeCh
+	s.pauseMux.Unlock()
+	if ch == nil {
+		return true
+	}
+	select {
+	case <-ch:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+// CommitMessages has nothing to do, senders aren't told what has been written.
+func (s *SyslogInput) CommitMessages(msg *model.InputMessage) error {
+	return nil
+}
+
+func (s *SyslogInput) Stop() {
+	s.cancel()
+	s.wgRun.Wait()
+}
+
+func (s *SyslogInput) Description() string {
+	return fmt.Sprint("syslog listeners of consumer group ", s.grpConfig.Name)
+}
+
+func (l *syslogListener) addr() string {
+	if l.pc != nil {
+		return l.pc.LocalAddr().String()
+	}
+	return l.ln.Addr().String()
+}
@@ -12,7 +12,9 @@ import (
 
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/avast/retry-go/v4"
+	"github.com/housepower/clickhouse_sinker/archive"
 	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/dlq"
 	"github.com/housepower/clickhouse_sinker/model"
 	"github.com/housepower/clickhouse_sinker/pool"
 	"github.com/housepower/clickhouse_sinker/statistics"
@@ -62,6 +64,15 @@ type ClickHouse struct {
 	numFlying int32
 	mux       sync.Mutex
 	taskDone  *sync.Cond
+
+	spiller
+
+	sharding *shardingPolicy // nil to write a batch to the shard of its index
+
+	// offsets of the flush in progress, see SetFlushRanges
+	flushTopic    string
+	flushRanges   map[int32]*model.BatchRange
+	flushReinsert bool
 }
 
 type DistTblInfo struct {
@@ -95,10 +106,40 @@ func NewClickHouse(cfg *config.Config, taskCfg *config.TaskConfig) *ClickHouse {
 
 // Init the clickhouse intance
 func (c *ClickHouse) Init() (err error) {
-	return c.initSchema()
+	if err = c.initSchema(); err != nil {
+		return
+	}
+	if err = c.initSharding(); err != nil {
+		return
+	}
+	if err = c.initRetention(); err != nil {
+		return
+	}
+	var dbVer int
+	return c.initSpill(c.cfg, c.taskCfg.Name, func(batch *model.Batch) error {
+		// the cluster may have been rebuilt meanwhile
+		return c.write(batch, pool.GetShardConn(batch.BatchIdx), &dbVer)
+	}, func(batch *model.Batch, err error) bool {
+		if !rejectsData(err) {
+			return false
+		}
+		c.reject(batch, err)
+		return true
+	})
 }
 
-// Drain drains flying batchs
+// Backlog returns the number of batches not written yet, and how many of them are spilled.
+func (c *ClickHouse) Backlog() (flying int32, spilled int) {
+	c.mux.Lock()
+	flying = c.numFlying
+	c.mux.Unlock()
+	spilled = c.numSpilled()
+	flying += int32(spilled)
+	return
+}
+
+// Drain drains flying batchs. Spilled batches are given up rather than waited for, as ClickHouse may not come back
+// soon, and their consumer reads them again from the last committed offsets.
 func (c *ClickHouse) Drain() {
 	c.mux.Lock()
 	for c.numFlying != 0 {
@@ -108,29 +149,77 @@ func (c *ClickHouse) Drain() {
 		c.taskDone.Wait()
 	}
 	c.mux.Unlock()
+	c.dropSpilled()
+}
+
+// Columns returns the columns of the metric table followed by those of the series table, if any.
+func (c *ClickHouse) Columns() []*model.ColumnWithType {
+	return c.Dims
+}
+
+// Close drains flying batches, the connections are shared by all tasks.
+func (c *ClickHouse) Close() {
+	c.Drain()
 }
 
 // Send a batch to clickhouse
 func (c *ClickHouse) Send(batch *model.Batch) {
-	sc := pool.GetShardConn(batch.BatchIdx)
-	if err := sc.SubmitTask(func() {
-		c.loopWrite(batch, sc)
-		batch.Wg.Done()
-		c.mux.Lock()
-		c.numFlying--
-		if c.numFlying == 0 {
-			c.taskDone.Broadcast()
-		}
-		c.mux.Unlock()
-		statistics.WritingPoolBacklog.WithLabelValues(c.taskCfg.Name).Dec()
-	}); err != nil {
+	// the cluster may be rebuilt with another number of shards at any time, tokens and routing agree on one
+	numShards := pool.NumShard()
+	if batch.DedupToken == "" {
+		batch.DedupToken = c.dedupToken(batch, numShards)
+	}
+	if batch.Topic == "" {
+		batch.Topic, batch.Ranges = c.flushTopic, c.flushRanges
+		batch.NoArchive = batch.NoArchive || c.flushReinsert
+	}
+	if c.sharding == nil {
+		c.send(batch)
 		return
 	}
+	for _, b := range c.route(batch, numShards) {
+		c.send(b)
+	}
+}
 
+func (c *ClickHouse) send(batch *model.Batch) {
 	c.mux.Lock()
 	c.numFlying++
 	c.mux.Unlock()
 	statistics.WritingPoolBacklog.WithLabelValues(c.taskCfg.Name).Inc()
+
+	var prev *pool.ShardConn
+	for {
+		sc := pool.GetShardConn(batch.BatchIdx)
+		err := sc.SubmitTask(func() {
+			defer statistics.WritingPoolBacklog.WithLabelValues(c.taskCfg.Name).Dec()
+			if err := c.loopWrite(batch, sc); err != nil {
+				if rejectsData(err) {
+					c.reject(batch, err)
+					c.batchDone(batch)
+					return
+				}
+				// the batch is done once it has been replayed
+				c.spill(batch, err)
+				c.flyingDone()
+				return
+			}
+			c.batchDone(batch)
+		})
+		if err == nil {
+			return
+		}
+		if sc == prev {
+			statistics.WritingPoolBacklog.WithLabelValues(c.taskCfg.Name).Dec()
+			c.spill(batch, err)
+			c.flyingDone()
+			return
+		}
+		// the cluster was rebuilt meanwhile and the writing pool of the retired connection takes no more tasks
+		util.Logger.Warn("failed to submit batch, retrying with the current connection",
+			zap.String("task", c.taskCfg.Name), zap.Error(err))
+		prev = sc
+	}
 }
 
 func (c *ClickHouse) AllowWriteSeries(sid, mid int64) (allowed bool) {
@@ -163,9 +252,9 @@ func (c *ClickHouse) AllowWriteSeries(sid, mid int64) (allowed bool) {
 	return
 }
 
-func (c *ClickHouse) writeSeries(rows model.Rows, conn *pool.Conn) (err error) {
+func (c *ClickHouse) writeSeries(batch *model.Batch, conn *pool.Conn) (err error) {
 	var seriesRows model.Rows
-	for _, row := range rows {
+	for _, row := range *batch.Rows {
 		if len(*row) != c.NumDims {
 			continue
 		}
@@ -173,8 +262,8 @@ func (c *ClickHouse) writeSeries(rows model.Rows, conn *pool.Conn) (err error) {
 	}
 	if len(seriesRows) != 0 {
 		begin := time.Now()
-		var numBad int
-		if numBad, err = writeRows(c.promSerSQL, seriesRows, c.IdxSerID, c.NumDims, conn); err != nil {
+		var bad []pool.RowError
+		if bad, err = writeRows(c.promSerSQL, seriesRows, c.IdxSerID, c.NumDims, conn); err != nil {
 			return
 		}
 		// update c.bmSeries **after** writing series
@@ -190,14 +279,64 @@ func (c *ClickHouse) writeSeries(rows model.Rows, conn *pool.Conn) (err error) {
 		c.seriesQuota.Unlock()
 		util.Logger.Info("ClickHouse.writeSeries succeeded", zap.Int("series", len(seriesRows)), zap.String("task", c.taskCfg.Name))
 		statistics.WriteSeriesSucceed.WithLabelValues(c.taskCfg.Name).Add(float64(len(seriesRows)))
-		if numBad != 0 {
-			statistics.ParseMsgsErrorTotal.WithLabelValues(c.taskCfg.Name).Add(float64(numBad))
+		if len(bad) != 0 {
+			statistics.ParseMsgsErrorTotal.WithLabelValues(c.taskCfg.Name).Add(float64(len(bad)))
+			c.deadLetter(batch, seriesRows, bad, c.IdxSerID, c.NumDims)
 		}
 		statistics.WritingDurations.WithLabelValues(c.taskCfg.Name, c.seriesTbl).Observe(time.Since(begin).Seconds())
 	}
 	return
 }
 
+// deadLetter hands the rows of a batch ClickHouse rejected to the dead-letter queue, as JSON objects keyed by
+// column along with the offsets the batch was built from. Without a dead-letter queue they are logged and dropped.
+func (c *ClickHouse) deadLetter(batch *model.Batch, rows model.Rows, bad []pool.RowError, idxBegin, idxEnd int) {
+	ranges := dlq.FormatRanges(batch.Ranges)
+	enabled := dlq.Enabled()
+	for _, re := range bad {
+		row := (*rows[re.Index])[idxBegin:idxEnd]
+		obj := make(map[string]interface{}, len(row))
+		for i, v := range row {
+			obj[c.Dims[idxBegin+i].Name] = v
+		}
+		value, err := json.Marshal(obj)
+		if err != nil {
+			value = []byte(fmt.Sprint(obj))
+		}
+		if !enabled {
+			util.Logger.Warn("dropped row rejected by ClickHouse, there's no dead-letter queue",
+				zap.String("task", c.taskCfg.Name), zap.String("ranges", ranges), zap.ByteString("row", value),
+				zap.Error(re.Err))
+		}
+		dlq.Put(&dlq.Entry{
+			Task:      c.taskCfg.Name,
+			Stage:     dlq.StageWrite,
+			Topic:     batch.Topic,
+			Partition: -1,
+			Offset:    -1,
+			Ranges:    ranges,
+			Value:     value,
+			Reason:    re.Err.Error(),
+		})
+	}
+}
+
+// reject gives up a batch which ClickHouse refused for its content, see deadLetter.
+func (c *ClickHouse) reject(batch *model.Batch, cause error) {
+	util.Logger.Error("ClickHouse refused batch, gave up its rows",
+		zap.String("task", c.taskCfg.Name), zap.Int("rows", len(*batch.Rows)), zap.Error(cause))
+	bad := make([]pool.RowError, len(*batch.Rows))
+	for i := range bad {
+		bad[i] = pool.RowError{Index: i, Err: cause}
+	}
+	numDims := c.NumDims
+	if c.taskCfg.PrometheusSchema {
+		numDims = c.IdxSerID + 1
+	}
+	statistics.ParseMsgsErrorTotal.WithLabelValues(c.taskCfg.Name).Add(float64(len(bad)))
+	c.deadLetter(batch, *batch.Rows, bad, 0, numDims)
+}
+
 // Write a batch to clickhouse
 func (c *ClickHouse) write(batch *model.Batch, sc *pool.ShardConn, dbVer *int) (err error) {
 	if len(*batch.Rows) == 0 {
@@ -214,32 +353,68 @@ func (c *ClickHouse) write(batch *model.Batch, sc *pool.ShardConn, dbVer *int) (
 	numDims := c.NumDims
 	if c.taskCfg.PrometheusSchema {
 		numDims = c.IdxSerID + 1
-		if err = c.writeSeries(*batch.Rows, conn); err != nil {
+		if err = c.writeSeries(batch, conn); err != nil {
 			return
 		}
 	}
 	begin := time.Now()
-	var numBad int
-	if numBad, err = writeRows(c.prepareSQL, *batch.Rows, 0, numDims, conn); err != nil {
+	var bad []pool.RowError
+	if bad, err = conn.WriteWithToken(c.prepareSQL, *batch.Rows, 0, numDims, batch.DedupToken); err != nil {
 		return
 	}
 	statistics.WritingDurations.WithLabelValues(c.taskCfg.Name, c.TableName).Observe(time.Since(begin).Seconds())
-	if numBad != 0 {
-		statistics.ParseMsgsErrorTotal.WithLabelValues(c.taskCfg.Name).Add(float64(numBad))
+	if len(bad) != 0 {
+		statistics.ParseMsgsErrorTotal.WithLabelValues(c.taskCfg.Name).Add(float64(len(bad)))
+		c.deadLetter(batch, *batch.Rows, bad, 0, numDims)
+	}
+	// a re-insert may have been written and archived before
+	if archive.Enabled() && !batch.NoArchive {
+		c.archiveRows(*batch.Rows, bad, numDims)
 	}
 	statistics.FlushMsgsTotal.WithLabelValues(c.taskCfg.Name).Add(float64(batch.RealSize))
 	return
 }
 
-// LoopWrite will dead loop to write the records
-func (c *ClickHouse) loopWrite(batch *model.Batch, sc *pool.ShardConn) {
+// archiveRows submits the rows which were written, so that the archive matches the table.
+func (c *ClickHouse) archiveRows(rows model.Rows, bad []pool.RowError, numDims int) {
+	var skip func(i int) bool
+	if len(bad) != 0 {
+		rejected := make(map[int]struct{}, len(bad))
+		for _, e := range bad {
+			rejected[e.Index] = struct{}{}
+		}
+		skip = func(i int) bool {
+			_, ok := rejected[i]
+			return ok
+		}
+	}
+	archive.Submit(c.taskCfg.Name, c.Dims[:numDims], rows, skip)
+}
+
+func (c *ClickHouse) batchDone(batch *model.Batch) {
+	batch.Wg.Done()
+	c.flyingDone()
+}
+
+// flyingDone counts a batch out of those being written.
+func (c *ClickHouse) flyingDone() {
+	c.mux.Lock()
+	c.numFlying--
+	if c.numFlying == 0 {
+		c.taskDone.Broadcast()
+	}
+	c.mux.Unlock()
+}
+
+// loopWrite writes the records, retrying up to RetryTimes
+func (c *ClickHouse) loopWrite(batch *model.Batch, sc *pool.ShardConn) (err error) {
 	var retrycount int
 	var dbVer int
 	times := c.cfg.Clickhouse.RetryTimes
 	if times <= 0 {
 		times = 0
 	}
-	if err := retry.Do(
+	if err = retry.Do(
 		func() error { return c.write(batch, sc, &dbVer) },
 		retry.LastErrorOnly(true),
 		retry.Attempts(uint(times)),
@@ -255,8 +430,9 @@ func (c *ClickHouse) loopWrite(batch *model.Batch, sc *pool.ShardConn) {
 			statistics.FlushMsgsErrorTotal.WithLabelValues(c.taskCfg.Name).Add(float64(batch.RealSize))
 		}),
 	); err != nil {
-		util.Logger.Fatal("ClickHouse.loopWrite failed", zap.String("task", c.taskCfg.Name), zap.Error(err))
+		util.Logger.Error("ClickHouse.loopWrite failed", zap.String("task", c.taskCfg.Name), zap.Error(err))
 	}
+	return
 }
 
 func (c *ClickHouse) initSeriesSchema(conn *pool.Conn) (err error) {
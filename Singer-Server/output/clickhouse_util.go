@@ -14,19 +14,28 @@ func shouldReconnect(err error, sc *pool.ShardConn) bool {
 	var exp *clickhouse.Exception
 	if errors.As(err, &exp) {
 		util.Logger.Error("this is an exception from clickhouse-server", zap.String("replica", sc.GetReplica()), zap.Reflect("exception", exp))
-		var replicaSpecific bool
-		for _, ec := range replicaSpecificErrorCodes {
-			if ec == exp.Code {
-				replicaSpecific = true
-				break
-			}
-		}
-		return replicaSpecific
+		return replicaSpecific(exp.Code)
 	}
 	return true
 }
 
-func writeRows(prepareSQL string, rows model.Rows, idxBegin, idxEnd int, conn *pool.Conn) (numBad int, err error) {
+func replicaSpecific(code int32) bool {
+	for _, ec := range replicaSpecificErrorCodes {
+		if ec == code {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectsData tells whether ClickHouse refused a write for what it writes, such as a schema or type mismatch.
+// Writing it again fails the same way on every replica.
+func rejectsData(err error) bool {
+	var exp *clickhouse.Exception
+	return errors.As(err, &exp) && !replicaSpecific(exp.Code)
+}
+
+func writeRows(prepareSQL string, rows model.Rows, idxBegin, idxEnd int, conn *pool.Conn) (bad []pool.RowError, err error) {
 	return conn.Write(prepareSQL, rows, idxBegin, idxEnd)
 }
 
@@ -0,0 +1,49 @@
+package output
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/housepower/clickhouse_sinker/model"
+)
+
+// flushToken derives the insert_deduplication_token of the batch of a shard from the offsets it was built from.
+// The number of shards is part of it, the same offsets route records differently to another number of shards.
+func flushToken(task string, shard int64, numShards int, topic string, ranges map[int32]*model.BatchRange) string {
+	partitions := make([]int32, 0, len(ranges))
+	for p := range ranges {
+		partitions = append(partitions, p)
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+	h := xxhash.New()
+	_, _ = h.WriteString(topic)
+	var buf []byte
+	for _, p := range partitions {
+		r := ranges[p]
+		buf = strconv.AppendInt(buf[:0], int64(p), 10)
+		buf = append(buf, ':')
+		buf = strconv.AppendInt(buf, r.Begin, 10)
+		buf = append(buf, '-')
+		buf = strconv.AppendInt(buf, r.End, 10)
+		buf = append(buf, ',')
+		_, _ = h.Write(buf)
+	}
+	return fmt.Sprintf("%s-%d-%d-%016x", task, shard, numShards, h.Sum64())
+}
+
+// SetFlushRanges sets the offsets of the records being flushed. Send stamps the batches of the flush with them, and
+// with deduplication tokens derived from them. reinsert tells that the flush is cut again at the offsets of one
+// recorded before a restart, which may have been written then. The goroutine which flushes calls it before every
+// flush.
+func (c *ClickHouse) SetFlushRanges(topic string, ranges map[int32]*model.BatchRange, reinsert bool) {
+	c.flushTopic, c.flushRanges, c.flushReinsert = topic, ranges, reinsert
+}
+
+func (c *ClickHouse) dedupToken(batch *model.Batch, numShards int) string {
+	if !c.taskCfg.Deduplicate || len(c.flushRanges) == 0 {
+		return ""
+	}
+	return flushToken(c.taskCfg.Name, batch.BatchIdx, numShards, c.flushTopic, c.flushRanges)
+}
@@ -0,0 +1,460 @@
+package output
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/avast/retry-go/v4"
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/dlq"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/statistics"
+	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultBulkTimeout    = 30
+	defaultBulkRetryTimes = 3
+)
+
+var (
+	indexFieldRegexp = regexp.MustCompile(`%\{([^}]+)\}`)
+	dateLayout       = strings.NewReplacer("yyyy", "2006", "yy", "06", "MM", "01", "dd", "02", "HH", "15")
+)
+
+// OpenSearch writes the batches of a task to OpenSearch or Elasticsearch with the _bulk API. A row is indexed as a
+// document keyed by column name.
+type OpenSearch struct {
+	Dims    []*model.ColumnWithType // replaced under mux, never modified in place
+	cfg     *config.Config
+	taskCfg *config.TaskConfig
+
+	client    *http.Client
+	nextAddr  uint32
+	index     []indexPart
+	idxTime   int // column of IndexConfig.TimeField, -1 if none
+	idxID     int // column of IndexConfig.IDField, -1 if none
+	extraDims []*model.ColumnWithType
+	pool      *util.WorkerPool
+	// putDeadLetter is dlq.Put, tests replace it to see what is dead-lettered
+	putDeadLetter func(e *dlq.Entry)
+
+	numFlying int32
+	mux       sync.Mutex
+	taskDone  *sync.Cond
+
+	spiller
+}
+
+// indexPart is a piece of the index name template: literal text, the value of a column, or the date.
+type indexPart struct {
+	text   string
+	column int // -1 for text and date
+	layout string
+}
+
+type bulkResponse struct {
+	Errors bool
+	Items  []map[string]struct {
+		Status int
+		Error  json.RawMessage
+	}
+}
+
+// NewOpenSearch new an OpenSearch instance
+func NewOpenSearch(cfg *config.Config, taskCfg *config.TaskConfig) *OpenSearch {
+	o := &OpenSearch{cfg: cfg, taskCfg: taskCfg, putDeadLetter: dlq.Put}
+	o.taskDone = sync.NewCond(&o.mux)
+	return o
+}
+
+// Init the OpenSearch instance
+func (o *OpenSearch) Init() (err error) {
+	osCfg := o.cfg.OpenSearch
+	if osCfg == nil || len(osCfg.Addresses) == 0 {
+		return errors.Newf("%s: output is opensearch, but no OpenSearch address is configured", o.taskCfg.Name)
+	}
+	if o.taskCfg.Index == nil || o.taskCfg.Index.Name == "" {
+		return errors.Newf("%s: output is opensearch, but it has no index", o.taskCfg.Name)
+	}
+	if o.taskCfg.AutoSchema || o.taskCfg.PrometheusSchema {
+		return errors.Newf("%s: output opensearch supports neither autoSchema nor prometheusSchema", o.taskCfg.Name)
+	}
+	o.mux.Lock()
+	dims := make([]*model.ColumnWithType, 0, len(o.taskCfg.Dims)+len(o.extraDims))
+	for _, dim := range o.taskCfg.Dims {
+		dims = append(dims, &model.ColumnWithType{
+			Name:       dim.Name,
+			Type:       model.WhichType(dim.Type),
+			SourceName: dim.SourceName,
+		})
+	}
+	// columns added by ChangeSchema, documents need no mapping change
+	o.Dims = append(dims, o.extraDims...)
+	o.mux.Unlock()
+
+	idxCfg := o.taskCfg.Index
+	if o.idxTime, err = o.column(idxCfg.TimeField); err != nil {
+		return
+	}
+	if o.idxID, err = o.column(idxCfg.IDField); err != nil {
+		return
+	}
+	if o.index, err = o.parseIndex(idxCfg.Name); err != nil {
+		return
+	}
+
+	timeout := osCfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultBulkTimeout
+	}
+	maxConns := osCfg.MaxConns
+	if maxConns <= 0 {
+		maxConns = 1
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: osCfg.InsecureSkipVerify}
+	transport.MaxIdleConnsPerHost = maxConns
+	o.client = &http.Client{Transport: transport, Timeout: time.Duration(timeout) * time.Second}
+	if o.pool == nil {
+		o.pool = util.NewWorkerPool(maxConns, 1)
+	}
+	if err = o.initSpill(o.cfg, o.taskCfg.Name, o.replayBatch, nil); err != nil {
+		return
+	}
+	util.Logger.Info("writing to opensearch", zap.String("task", o.taskCfg.Name), zap.String("index", idxCfg.Name),
+		zap.Strings("addresses", osCfg.Addresses))
+	return
+}
+
+// Columns returns the configured columns followed by those added by ChangeSchema.
+func (o *OpenSearch) Columns() []*model.ColumnWithType {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return o.Dims
+}
+
+func (o *OpenSearch) column(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	for i, dim := range o.Dims {
+		if dim.Name == name {
+			return i, nil
+		}
+	}
+	return -1, errors.Newf("%s: index column %s is not among the dims", o.taskCfg.Name, name)
+}
+
+func (o *OpenSearch) parseIndex(tmpl string) (parts []indexPart, err error) {
+	last := 0
+	for _, m := range indexFieldRegexp.FindAllStringSubmatchIndex(tmpl, -1) {
+		if m[0] > last {
+			parts = append(parts, indexPart{text: tmpl[last:m[0]], column: -1})
+		}
+		name := tmpl[m[2]:m[3]]
+		if strings.HasPrefix(name, "+") {
+			parts = append(parts, indexPart{column: -1, layout: dateLayout.Replace(name[1:])})
+		} else {
+			var idx int
+			if idx, err = o.column(name); err != nil {
+				return
+			}
+			parts = append(parts, indexPart{column: idx})
+		}
+		last = m[1]
+	}
+	if last < len(tmpl) {
+		parts = append(parts, indexPart{text: tmpl[last:], column: -1})
+	}
+	return
+}
+
+// indexName fills the index name template with the values of a row.
+func (o *OpenSearch) indexName(row *model.Row, now time.Time) string {
+	var sb strings.Builder
+	for _, p := range o.index {
+		switch {
+		case p.column >= 0:
+			if v := (*row)[p.column]; v != nil {
+				sb.WriteString(strings.ToLower(fmt.Sprint(v)))
+			} else {
+				sb.WriteString("unknown")
+			}
+		case p.layout != "":
+			ts := now
+			if o.idxTime >= 0 {
+				if t, ok := (*row)[o.idxTime].(time.Time); ok {
+					ts = t
+				}
+			}
+			sb.WriteString(ts.UTC().Format(p.layout))
+		default:
+			sb.WriteString(p.text)
+		}
+	}
+	return sb.String()
+}
+
+// Drain drains flying batchs. Spilled batches are given up, their consumer reads them again from the last
+// committed offsets.
+func (o *OpenSearch) Drain() {
+	o.mux.Lock()
+	for o.numFlying != 0 {
+		util.Logger.Debug("draining flying batches",
+			zap.String("task", o.taskCfg.Name),
+			zap.Int32("pending", o.numFlying))
+		o.taskDone.Wait()
+	}
+	o.mux.Unlock()
+	o.dropSpilled()
+}
+
+// Close drains flying batches and stops the writers of the task.
+func (o *OpenSearch) Close() {
+	o.Drain()
+	if o.pool != nil {
+		o.pool.StopWait()
+		o.pool = nil
+	}
+	if o.client != nil {
+		o.client.CloseIdleConnections()
+	}
+}
+
+// Send a batch to OpenSearch
+func (o *OpenSearch) Send(batch *model.Batch) {
+	if err := o.pool.Submit(func() {
+		defer statistics.WritingPoolBacklog.WithLabelValues(o.taskCfg.Name).Dec()
+		if err := o.loopWrite(batch); err != nil {
+			// the batch is done once it has been replayed
+			o.spill(batch, err)
+		} else {
+			batch.Wg.Done()
+		}
+		o.mux.Lock()
+		o.numFlying--
+		if o.numFlying == 0 {
+			o.taskDone.Broadcast()
+		}
+		o.mux.Unlock()
+	}); err != nil {
+		return
+	}
+
+	o.mux.Lock()
+	o.numFlying++
+	o.mux.Unlock()
+	statistics.WritingPoolBacklog.WithLabelValues(o.taskCfg.Name).Inc()
+}
+
+// ChangeSchema adds the new keys to the columns. Documents carry their own fields, the index mapping is left to
+// OpenSearch. Writers and replays may be reading the columns meanwhile, so they are swapped for a longer copy.
+func (o *OpenSearch) ChangeSchema(newKeys *sync.Map) (err error) {
+	maxDims := math.MaxInt16
+	if o.taskCfg.DynamicSchema.MaxDims > 0 {
+		maxDims = o.taskCfg.DynamicSchema.MaxDims
+	}
+	dims := o.Columns()
+	dims = dims[:len(dims):len(dims)]
+	var added []*model.ColumnWithType
+	newKeys.Range(func(key, value interface{}) bool {
+		if len(dims) >= maxDims {
+			util.Logger.Warn("number of columns reaches upper limit", zap.Int("limit", maxDims), zap.Int("current", len(dims)))
+			return false
+		}
+		strKey, _ := key.(string)
+		dim := &model.ColumnWithType{
+			Name:       strKey,
+			Type:       &model.TypeInfo{Type: value.(int), Nullable: !o.taskCfg.DynamicSchema.NotNullable},
+			SourceName: util.GetSourceName(o.taskCfg.Parser, strKey),
+		}
+		dims = append(dims, dim)
+		added = append(added, dim)
+		return true
+	})
+	o.mux.Lock()
+	o.Dims = dims
+	o.extraDims = append(o.extraDims, added...)
+	o.mux.Unlock()
+	util.Logger.Info("added columns", zap.String("task", o.taskCfg.Name), zap.Int("columns", len(added)))
+	return
+}
+
+// loopWrite writes the rows, sending them again up to RetryTimes while the request fails or documents are rejected
+// with 429 or 5xx. On error batch.Rows is left to the rows still to write. Only documents rejected for their
+// content go to the dead-letter queue.
+func (o *OpenSearch) loopWrite(batch *model.Batch) (err error) {
+	times := o.cfg.OpenSearch.RetryTimes
+	if times <= 0 {
+		times = defaultBulkRetryTimes
+	}
+	rows := *batch.Rows
+	var retrycount int
+	err = retry.Do(
+		func() (err error) {
+			rows, err = o.bulk(rows)
+			return
+		},
+		retry.LastErrorOnly(true),
+		retry.Attempts(uint(times)),
+		retry.Delay(time.Second),
+		retry.OnRetry(func(n uint, err error) {
+			retrycount++
+			util.Logger.Error("flush batch failed",
+				zap.String("task", o.taskCfg.Name),
+				zap.String("group", batch.GroupId),
+				zap.Int("try", retrycount),
+				zap.Error(err))
+			statistics.FlushMsgsErrorTotal.WithLabelValues(o.taskCfg.Name).Add(float64(len(rows)))
+		}),
+	)
+	if err != nil {
+		util.Logger.Error("OpenSearch.loopWrite failed", zap.String("task", o.taskCfg.Name), zap.Int("rows", len(rows)), zap.Error(err))
+		batch.Rows = &rows
+		return
+	}
+	statistics.FlushMsgsTotal.WithLabelValues(o.taskCfg.Name).Add(float64(batch.RealSize))
+	return
+}
+
+// replayBatch writes a spilled batch once more.
+func (o *OpenSearch) replayBatch(batch *model.Batch) (err error) {
+	var rows model.Rows
+	if rows, err = o.bulk(*batch.Rows); err != nil {
+		batch.Rows = &rows
+		return
+	}
+	statistics.FlushMsgsTotal.WithLabelValues(o.taskCfg.Name).Add(float64(batch.RealSize))
+	return
+}
+
+// bulk indexes rows and returns those to send again.
+func (o *OpenSearch) bulk(rows model.Rows) (retryRows model.Rows, err error) {
+	if len(rows) == 0 {
+		return
+	}
+	now := time.Now()
+	dims := o.Columns()
+	var body bytes.Buffer
+	sent := make(model.Rows, 0, len(rows))
+	for _, row := range rows {
+		meta := map[string]string{"_index": o.indexName(row, now)}
+		if o.idxID >= 0 && (*row)[o.idxID] != nil {
+			meta["_id"] = fmt.Sprint((*row)[o.idxID])
+		}
+		var action, doc []byte
+		if action, err = json.Marshal(map[string]interface{}{"index": meta}); err == nil {
+			doc, err = json.Marshal(bulkDocument(dims, row))
+		}
+		if err != nil {
+			// no later attempt can encode it either, e.g. a NaN
+			statistics.ParseMsgsErrorTotal.WithLabelValues(o.taskCfg.Name).Inc()
+			o.deadLetter(dims, row, err.Error())
+			continue
+		}
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(doc)
+		body.WriteByte('\n')
+		sent = append(sent, row)
+	}
+	err = nil
+	if rows = sent; len(rows) == 0 {
+		return
+	}
+
+	osCfg := o.cfg.OpenSearch
+	addr := osCfg.Addresses[int(atomic.AddUint32(&o.nextAddr, 1))%len(osCfg.Addresses)]
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodPost, strings.TrimSuffix(addr, "/")+"/_bulk", &body); err != nil {
+		return rows, errors.Wrapf(err, "")
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if osCfg.Username != "" {
+		req.SetBasicAuth(osCfg.Username, osCfg.Password)
+	}
+	begin := time.Now()
+	var resp *http.Response
+	if resp, err = o.client.Do(req); err != nil {
+		return rows, errors.Wrapf(err, "")
+	}
+	defer resp.Body.Close()
+	var data []byte
+	if data, err = io.ReadAll(resp.Body); err != nil {
+		return rows, errors.Wrapf(err, "")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return rows, errors.Newf("%s/_bulk returned %s: %s", addr, resp.Status, truncate(data, 512))
+	}
+	statistics.WritingDurations.WithLabelValues(o.taskCfg.Name, o.taskCfg.Index.Name).Observe(time.Since(begin).Seconds())
+
+	var br bulkResponse
+	if err = json.Unmarshal(data, &br); err != nil {
+		return rows, errors.Wrapf(err, "")
+	}
+	if !br.Errors {
+		return
+	}
+	var numBad int
+	for i, item := range br.Items {
+		if i >= len(rows) {
+			break
+		}
+		for _, res := range item {
+			switch {
+			case res.Status == http.StatusTooManyRequests || res.Status >= 500:
+				retryRows = append(retryRows, rows[i])
+			case res.Status >= 300:
+				numBad++
+				o.deadLetter(dims, rows[i], string(res.Error))
+			}
+		}
+	}
+	if numBad != 0 {
+		statistics.ParseMsgsErrorTotal.WithLabelValues(o.taskCfg.Name).Add(float64(numBad))
+		util.Logger.Warn(fmt.Sprintf("bulk rejected %d documents of %d due to invalid content", numBad, len(rows)),
+			zap.String("task", o.taskCfg.Name))
+	}
+	if len(retryRows) != 0 {
+		err = errors.Newf("bulk rejected %d documents of %d with 429 or 5xx", len(retryRows), len(rows))
+	}
+	return
+}
+
+func bulkDocument(dims []*model.ColumnWithType, row *model.Row) map[string]interface{} {
+	doc := make(map[string]interface{}, len(dims))
+	for i, dim := range dims {
+		if i < len(*row) && (*row)[i] != nil {
+			doc[dim.Name] = (*row)[i]
+		}
+	}
+	return doc
+}
+
+func (o *OpenSearch) deadLetter(dims []*model.ColumnWithType, row *model.Row, reason string) {
+	value, err := json.Marshal(bulkDocument(dims, row))
+	if err != nil {
+		value = []byte(fmt.Sprint(*row))
+	}
+	o.putDeadLetter(&dlq.Entry{Task: o.taskCfg.Name, Stage: dlq.StageWrite, Value: value, Reason: reason})
+}
+
+func truncate(data []byte, n int) string {
+	if len(data) > n {
+		return string(data[:n]) + "..."
+	}
+	return string(data)
+}
@@ -0,0 +1,335 @@
+package output
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/dlq"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type bulkAction struct {
+	Index struct {
+		Index string `json:"_index"`
+		ID    string `json:"_id"`
+	}
+}
+
+// bulkRequest is a _bulk request received by the test server.
+type bulkRequest struct {
+	actions []bulkAction
+	docs    []map[string]interface{}
+}
+
+// bulkServer answers each _bulk request with the item statuses respond returns, or fails the whole request with
+// the status it returns along with nil.
+type bulkServer struct {
+	*httptest.Server
+	mux      sync.Mutex
+	requests []bulkRequest
+}
+
+func newBulkServer(t *testing.T, respond func(n int, req bulkRequest) (status int, items []int)) *bulkServer {
+	s := &bulkServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_bulk", r.URL.Path)
+		assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+		var req bulkRequest
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var action bulkAction
+			var doc map[string]interface{}
+			if !assert.NoError(t, json.Unmarshal(scanner.Bytes(), &action)) || !assert.True(t, scanner.Scan()) ||
+				!assert.NoError(t, json.Unmarshal(scanner.Bytes(), &doc)) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			req.actions = append(req.actions, action)
+			req.docs = append(req.docs, doc)
+		}
+		s.mux.Lock()
+		s.requests = append(s.requests, req)
+		n := len(s.requests)
+		s.mux.Unlock()
+
+		status, items := respond(n, req)
+		if items == nil {
+			w.WriteHeader(status)
+			_, _ = io.WriteString(w, `{"error":"unavailable"}`)
+			return
+		}
+		var br bulkResponse
+		for _, st := range items {
+			item := struct {
+				Status int
+				Error  json.RawMessage
+			}{Status: st}
+			if st >= 300 {
+				item.Error = json.RawMessage(fmt.Sprintf(`{"type":"status_%d"}`, st))
+			}
+			br.Errors = br.Errors || st >= 300
+			br.Items = append(br.Items, map[string]struct {
+				Status int
+				Error  json.RawMessage
+			}{"index": item})
+		}
+		assert.NoError(t, json.NewEncoder(w).Encode(br))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *bulkServer) received() []bulkRequest {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]bulkRequest(nil), s.requests...)
+}
+
+type testPauser struct {
+	paused, resumed, rewound int32
+}
+
+func (p *testPauser) Pause()  { atomic.AddInt32(&p.paused, 1) }
+func (p *testPauser) Resume() { atomic.AddInt32(&p.resumed, 1) }
+func (p *testPauser) Rewind() { atomic.AddInt32(&p.rewound, 1) }
+
+func TestMain(m *testing.M) {
+	util.Logger = zap.NewNop()
+	os.Exit(m.Run())
+}
+
+func newTestOpenSearch(t *testing.T, addr string, retryTimes int) *OpenSearch {
+	cfg := &config.Config{
+		OpenSearch: &config.OpenSearchConfig{Addresses: []string{addr}, RetryTimes: retryTimes},
+		Spill:      &config.SpillConfig{Dir: t.TempDir(), ReplayInterval: 1},
+	}
+	taskCfg := &config.TaskConfig{
+		Name:   t.Name(),
+		Output: OutputOpenSearch,
+		Index:  &config.IndexConfig{Name: "logs-%{service}-%{+yyyy.MM.dd}", TimeField: "time", IDField: "id"},
+	}
+	for _, dim := range [][2]string{{"id", "String"}, {"service", "Nullable(String)"}, {"time", "DateTime"}, {"msg", "String"}} {
+		taskCfg.Dims = append(taskCfg.Dims, struct {
+			Name       string
+			Type       string
+			SourceName string
+		}{Name: dim[0], Type: dim[1], SourceName: dim[0]})
+	}
+	o := NewOpenSearch(cfg, taskCfg)
+	require.NoError(t, o.Init())
+	t.Cleanup(o.Close)
+	return o
+}
+
+// deadLetters collects what an output dead-letters, in place of the dead-letter queue of the process.
+type deadLetters struct {
+	mux     sync.Mutex
+	entries []dlq.Entry
+}
+
+func collectDeadLetters(o *OpenSearch) *deadLetters {
+	d := &deadLetters{}
+	o.putDeadLetter = func(e *dlq.Entry) {
+		d.mux.Lock()
+		defer d.mux.Unlock()
+		d.entries = append(d.entries, *e)
+	}
+	return d
+}
+
+func (d *deadLetters) get() []dlq.Entry {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return append([]dlq.Entry(nil), d.entries...)
+}
+
+func testBatch(rows ...*model.Row) *model.Batch {
+	batch := &model.Batch{Rows: (*model.Rows)(&rows), RealSize: len(rows), Wg: &sync.WaitGroup{}}
+	batch.Wg.Add(1)
+	return batch
+}
+
+func testRow(id string, service interface{}, ts time.Time) *model.Row {
+	return &model.Row{id, service, ts, "message " + id}
+}
+
+// batchDone returns a channel which is closed once the batch is done.
+func batchDone(batch *model.Batch) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		batch.Wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+func waitBatch(t *testing.T, batch *model.Batch, timeout time.Duration) {
+	select {
+	case <-batchDone(batch):
+	case <-time.After(timeout):
+		t.Fatal("batch not done in time")
+	}
+}
+
+func TestOpenSearchBulk(t *testing.T) {
+	srv := newBulkServer(t, func(n int, req bulkRequest) (int, []int) {
+		items := make([]int, len(req.docs))
+		for i := range items {
+			items[i] = http.StatusCreated
+		}
+		return http.StatusOK, items
+	})
+	o := newTestOpenSearch(t, srv.URL, 0)
+
+	ts := time.Date(2024, 5, 6, 23, 30, 0, 0, time.FixedZone("", -3600))
+	batch := testBatch(testRow("1", "API", ts), testRow("2", nil, ts))
+	o.Send(batch)
+	waitBatch(t, batch, 5*time.Second)
+
+	reqs := srv.received()
+	require.Len(t, reqs, 1)
+	require.Len(t, reqs[0].actions, 2)
+	// column values are lowered, the date is the UTC one of the time column
+	require.Equal(t, "logs-api-2024.05.07", reqs[0].actions[0].Index.Index)
+	require.Equal(t, "1", reqs[0].actions[0].Index.ID)
+	require.Equal(t, "logs-unknown-2024.05.07", reqs[0].actions[1].Index.Index)
+	require.Equal(t, "2", reqs[0].actions[1].Index.ID)
+
+	require.Equal(t, "API", reqs[0].docs[0]["service"])
+	require.Equal(t, "message 1", reqs[0].docs[0]["msg"])
+	require.Equal(t, ts.Format(time.RFC3339Nano), reqs[0].docs[0]["time"])
+	// nil values are left out of the document
+	require.NotContains(t, reqs[0].docs[1], "service")
+	require.Equal(t, "2", reqs[0].docs[1]["id"])
+}
+
+func TestOpenSearchItemRetry(t *testing.T) {
+	srv := newBulkServer(t, func(n int, req bulkRequest) (int, []int) {
+		if n == 1 {
+			return http.StatusOK, []int{http.StatusCreated, http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusBadRequest}
+		}
+		items := make([]int, len(req.docs))
+		for i := range items {
+			items[i] = http.StatusCreated
+		}
+		return http.StatusOK, items
+	})
+	o := newTestOpenSearch(t, srv.URL, 2)
+	dead := collectDeadLetters(o)
+
+	now := time.Now()
+	batch := testBatch(testRow("1", "a", now), testRow("2", "a", now), testRow("3", "a", now), testRow("4", "a", now))
+	o.Send(batch)
+	waitBatch(t, batch, 10*time.Second)
+
+	reqs := srv.received()
+	require.Len(t, reqs, 2)
+	// only the documents rejected with 429 or 5xx are sent again
+	require.Len(t, reqs[1].docs, 2)
+	require.Equal(t, "2", reqs[1].actions[0].Index.ID)
+	require.Equal(t, "3", reqs[1].actions[1].Index.ID)
+
+	entries := dead.get()
+	require.Len(t, entries, 1)
+	require.Equal(t, dlq.StageWrite, entries[0].Stage)
+	require.Equal(t, `{"type":"status_400"}`, entries[0].Reason)
+	var doc map[string]interface{}
+	require.NoError(t, json.Unmarshal(entries[0].Value, &doc))
+	require.Equal(t, "4", doc["id"])
+}
+
+func TestOpenSearchSpill(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	srv := newBulkServer(t, func(n int, req bulkRequest) (int, []int) {
+		if down.Load() {
+			return http.StatusServiceUnavailable, nil
+		}
+		items := make([]int, len(req.docs))
+		for i := range items {
+			items[i] = http.StatusCreated
+		}
+		return http.StatusOK, items
+	})
+	o := newTestOpenSearch(t, srv.URL, 1)
+	dead := collectDeadLetters(o)
+	p := &testPauser{}
+	o.SetPauser(p)
+
+	batch := testBatch(testRow("1", "a", time.Now()), testRow("2", "a", time.Now()))
+	done := batchDone(batch)
+	o.Send(batch)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&p.paused) == 1 }, 5*time.Second, 10*time.Millisecond)
+	// the write and two replays failed
+	require.Eventually(t, func() bool { return len(srv.received()) >= 3 }, 5*time.Second, 10*time.Millisecond)
+	// a spilled batch isn't done, so that its offsets aren't committed
+	select {
+	case <-done:
+		t.Fatal("spilled batch done before it was written")
+	default:
+	}
+	require.Equal(t, int32(0), atomic.LoadInt32(&p.resumed))
+
+	down.Store(false)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch not done in time")
+	}
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&p.resumed) == 1 }, 5*time.Second, 10*time.Millisecond)
+	reqs := srv.received()
+	require.Len(t, reqs[len(reqs)-1].docs, 2)
+	require.Empty(t, dead.get())
+}
+
+func TestOpenSearchChangeSchema(t *testing.T) {
+	srv := newBulkServer(t, func(n int, req bulkRequest) (int, []int) {
+		items := make([]int, len(req.docs))
+		for i := range items {
+			items[i] = http.StatusCreated
+		}
+		return http.StatusOK, items
+	})
+	o := newTestOpenSearch(t, srv.URL, 0)
+	dims := o.Columns()
+
+	// batches are written while the columns change
+	var batches []*model.Batch
+	for i := 0; i < 10; i++ {
+		batch := testBatch(testRow(fmt.Sprint(i), "a", time.Now()))
+		batches = append(batches, batch)
+		o.Send(batch)
+	}
+	var newKeys sync.Map
+	newKeys.Store("level", model.String)
+	require.NoError(t, o.ChangeSchema(&newKeys))
+	for _, batch := range batches {
+		waitBatch(t, batch, 5*time.Second)
+	}
+	require.Len(t, dims, 4, "columns returned before are left as they were")
+	cols := o.Columns()
+	require.Len(t, cols, 5)
+	require.Equal(t, "level", cols[4].Name)
+
+	row := testRow("x", "a", time.Now())
+	*row = append(*row, "warn")
+	batch := testBatch(row)
+	o.Send(batch)
+	waitBatch(t, batch, 5*time.Second)
+	reqs := srv.received()
+	require.Equal(t, "warn", reqs[len(reqs)-1].docs[0]["level"])
+}
@@ -0,0 +1,583 @@
+package output
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avast/retry-go/v4"
+	"github.com/housepower/clickhouse_sinker/archive"
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/dlq"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/statistics"
+	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/shopspring/decimal"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPgSchema       = "public"
+	defaultPgMaxConns     = 4
+	defaultPgRetryTimes   = 3
+	defaultChunkInterval  = "7 days"
+	selectPgColumnsSQL    = `SELECT column_name, udt_name, is_nullable FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2 ORDER BY ordinal_position`
+	createHypertableSQL   = `SELECT create_hypertable($1::regclass, $2::name, chunk_time_interval => $3::interval, if_not_exists => TRUE, migrate_data => TRUE)`
+	pgDataExceptionClass  = "22"
+	pgIntegrityErrorClass = "23"
+)
+
+// Postgres writes the batches of a task to a PostgreSQL table with COPY, optionally a TimescaleDB hypertable.
+type Postgres struct {
+	Dims    []*model.ColumnWithType
+	cfg     *config.Config
+	taskCfg *config.TaskConfig
+	pgCfg   *config.PostgresConfig
+	schema  string
+	table   pgx.Identifier
+	columns []string
+
+	db   *pgxpool.Pool
+	pool *util.WorkerPool
+
+	numFlying int32
+	mux       sync.Mutex
+	taskDone  *sync.Cond
+
+	spiller
+}
+
+// NewPostgres new a Postgres instance
+func NewPostgres(cfg *config.Config, taskCfg *config.TaskConfig) *Postgres {
+	p := &Postgres{cfg: cfg, taskCfg: taskCfg, pgCfg: cfg.Postgres}
+	p.taskDone = sync.NewCond(&p.mux)
+	return p
+}
+
+// Init the Postgres instance
+func (p *Postgres) Init() (err error) {
+	if p.pgCfg == nil || p.pgCfg.DSN == "" {
+		return errors.Newf("%s: output is postgres, but no PostgreSQL DSN is configured", p.taskCfg.Name)
+	}
+	if p.taskCfg.PrometheusSchema {
+		return errors.Newf("%s: output postgres doesn't support prometheusSchema", p.taskCfg.Name)
+	}
+	p.schema = p.pgCfg.Schema
+	if p.schema == "" {
+		p.schema = defaultPgSchema
+	}
+	p.table = pgx.Identifier{p.schema, p.taskCfg.TableName}
+
+	if p.db == nil {
+		var poolCfg *pgxpool.Config
+		if poolCfg, err = pgxpool.ParseConfig(p.pgCfg.DSN); err != nil {
+			return errors.Wrapf(err, "%s: invalid PostgreSQL DSN", p.taskCfg.Name)
+		}
+		poolCfg.MaxConns = defaultPgMaxConns
+		if p.pgCfg.MaxConns > 0 {
+			poolCfg.MaxConns = int32(p.pgCfg.MaxConns)
+		}
+		if p.db, err = pgxpool.NewWithConfig(context.Background(), poolCfg); err != nil {
+			return errors.Wrapf(err, "")
+		}
+		p.pool = util.NewWorkerPool(int(poolCfg.MaxConns), 1)
+	}
+
+	if err = p.initSchema(); err != nil {
+		return
+	}
+	if p.taskCfg.Hypertable != nil {
+		if err = p.initHypertable(); err != nil {
+			return
+		}
+	}
+	p.columns = make([]string, len(p.Dims))
+	for i, dim := range p.Dims {
+		p.columns[i] = dim.Name
+	}
+	if err = p.initSpill(p.cfg, p.taskCfg.Name, p.replayBatch, nil); err != nil {
+		return
+	}
+	util.Logger.Info("writing to postgres", zap.String("task", p.taskCfg.Name), zap.String("table", p.table.Sanitize()),
+		zap.Strings("columns", p.columns))
+	return
+}
+
+// initSchema reads the columns of the table if autoSchema is set, otherwise it creates the table of the dims if
+// it doesn't exist.
+func (p *Postgres) initSchema() (err error) {
+	ctx := context.Background()
+	if !p.taskCfg.AutoSchema {
+		p.Dims = make([]*model.ColumnWithType, 0, len(p.taskCfg.Dims))
+		defs := make([]string, 0, len(p.taskCfg.Dims))
+		for _, dim := range p.taskCfg.Dims {
+			col := &model.ColumnWithType{
+				Name:       dim.Name,
+				Type:       model.WhichType(dim.Type),
+				SourceName: dim.SourceName,
+			}
+			var typ string
+			if typ, err = pgType(col.Type); err != nil {
+				return errors.Wrapf(err, "%s: column %s", p.taskCfg.Name, dim.Name)
+			}
+			p.Dims = append(p.Dims, col)
+			defs = append(defs, pgx.Identifier{dim.Name}.Sanitize()+" "+typ)
+		}
+		query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", p.table.Sanitize(), strings.Join(defs, ", "))
+		util.Logger.Info(fmt.Sprintf("executing sql=> %s", query), zap.String("task", p.taskCfg.Name))
+		if _, err = p.db.Exec(ctx, query); err != nil {
+			return errors.Wrapf(err, "")
+		}
+		return
+	}
+
+	var rows pgx.Rows
+	if rows, err = p.db.Query(ctx, selectPgColumnsSQL, p.schema, p.taskCfg.TableName); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	defer rows.Close()
+	p.Dims = make([]*model.ColumnWithType, 0, 10)
+	for rows.Next() {
+		var name, udtName, isNullable string
+		if err = rows.Scan(&name, &udtName, &isNullable); err != nil {
+			return errors.Wrapf(err, "")
+		}
+		if util.StringContains(p.taskCfg.ExcludeColumns, name) {
+			continue
+		}
+		var typ *model.TypeInfo
+		if typ, err = modelType(udtName); err != nil {
+			return errors.Wrapf(err, "%s: column %s", p.taskCfg.Name, name)
+		}
+		typ.Nullable = isNullable == "YES"
+		p.Dims = append(p.Dims, &model.ColumnWithType{Name: name, Type: typ, SourceName: util.GetSourceName(p.taskCfg.Parser, name)})
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	if len(p.Dims) == 0 {
+		return errors.Wrapf(ErrTblNotExist, "%s", p.table.Sanitize())
+	}
+	return
+}
+
+func (p *Postgres) initHypertable() (err error) {
+	ht := p.taskCfg.Hypertable
+	interval := ht.ChunkInterval
+	if interval == "" {
+		interval = defaultChunkInterval
+	}
+	util.Logger.Info(fmt.Sprintf("executing sql=> %s", createHypertableSQL), zap.String("task", p.taskCfg.Name),
+		zap.String("table", p.table.Sanitize()), zap.String("timeColumn", ht.TimeColumn), zap.String("chunkInterval", interval))
+	if _, err = p.db.Exec(context.Background(), createHypertableSQL, p.table.Sanitize(), ht.TimeColumn, interval); err != nil {
+		return errors.Wrapf(err, "%s: failed to create hypertable, is the timescaledb extension installed?", p.taskCfg.Name)
+	}
+	return
+}
+
+// pgType returns the PostgreSQL type of a column type.
+func pgType(typ *model.TypeInfo) (string, error) {
+	var name string
+	switch typ.Type {
+	case model.Bool:
+		name = "boolean"
+	case model.Int8, model.Int16, model.UInt8:
+		name = "smallint"
+	case model.Int32, model.UInt16:
+		name = "integer"
+	case model.Int64, model.UInt32:
+		name = "bigint"
+	case model.UInt64:
+		name = "numeric(20)"
+	case model.Float32:
+		name = "real"
+	case model.Float64:
+		name = "double precision"
+	case model.Decimal:
+		name = "numeric"
+	case model.DateTime:
+		name = "timestamptz"
+	case model.String:
+		name = "text"
+	case model.Object, model.Map:
+		name = "jsonb"
+	case model.IPv4, model.IPv6:
+		name = "inet"
+	case model.UUID:
+		name = "uuid"
+	default:
+		return "", errors.Newf("unsupported column type %s", model.GetTypeName(typ.Type))
+	}
+	if typ.Array {
+		name += "[]"
+	}
+	if !typ.Nullable {
+		name += " NOT NULL"
+	}
+	return name, nil
+}
+
+// modelType returns the column type of a PostgreSQL type, as named by information_schema.columns.udt_name.
+func modelType(udtName string) (*model.TypeInfo, error) {
+	typ := &model.TypeInfo{}
+	if strings.HasPrefix(udtName, "_") {
+		typ.Array = true
+		udtName = udtName[1:]
+	}
+	switch udtName {
+	case "bool":
+		typ.Type = model.Bool
+	case "int2":
+		typ.Type = model.Int16
+	case "int4":
+		typ.Type = model.Int32
+	case "int8":
+		typ.Type = model.Int64
+	case "float4":
+		typ.Type = model.Float32
+	case "float8":
+		typ.Type = model.Float64
+	case "numeric":
+		typ.Type = model.Decimal
+	case "timestamptz", "timestamp", "date":
+		typ.Type = model.DateTime
+	case "text", "varchar", "bpchar":
+		typ.Type = model.String
+	case "json", "jsonb":
+		typ.Type = model.Object
+	case "inet":
+		typ.Type = model.IPv6
+	case "uuid":
+		typ.Type = model.UUID
+	default:
+		return nil, errors.Newf("unsupported PostgreSQL type %s", udtName)
+	}
+	return typ, nil
+}
+
+// Columns returns the columns of the table.
+func (p *Postgres) Columns() []*model.ColumnWithType {
+	return p.Dims
+}
+
+// Drain drains flying batchs. Spilled batches are given up, their consumer reads them again from the last
+// committed offsets.
+func (p *Postgres) Drain() {
+	p.mux.Lock()
+	for p.numFlying != 0 {
+		util.Logger.Debug("draining flying batches",
+			zap.String("task", p.taskCfg.Name),
+			zap.Int32("pending", p.numFlying))
+		p.taskDone.Wait()
+	}
+	p.mux.Unlock()
+	p.dropSpilled()
+}
+
+// Close drains flying batches and closes the connections of the task.
+func (p *Postgres) Close() {
+	p.Drain()
+	if p.pool != nil {
+		p.pool.StopWait()
+		p.pool = nil
+	}
+	if p.db != nil {
+		p.db.Close()
+		p.db = nil
+	}
+}
+
+// Send a batch to PostgreSQL
+func (p *Postgres) Send(batch *model.Batch) {
+	if err := p.pool.Submit(func() {
+		defer statistics.WritingPoolBacklog.WithLabelValues(p.taskCfg.Name).Dec()
+		if err := p.loopWrite(batch); err != nil {
+			// the batch is done once it has been replayed
+			p.spill(batch, err)
+		} else {
+			batch.Wg.Done()
+		}
+		p.mux.Lock()
+		p.numFlying--
+		if p.numFlying == 0 {
+			p.taskDone.Broadcast()
+		}
+		p.mux.Unlock()
+	}); err != nil {
+		return
+	}
+
+	p.mux.Lock()
+	p.numFlying++
+	p.mux.Unlock()
+	statistics.WritingPoolBacklog.WithLabelValues(p.taskCfg.Name).Inc()
+}
+
+// ChangeSchema adds the new keys as nullable columns, existing rows have no value for them.
+func (p *Postgres) ChangeSchema(newKeys *sync.Map) (err error) {
+	maxDims := math.MaxInt16
+	if p.taskCfg.DynamicSchema.MaxDims > 0 {
+		maxDims = p.taskCfg.DynamicSchema.MaxDims
+	}
+	newKeysQuota := maxDims - len(p.Dims)
+	if newKeysQuota <= 0 {
+		util.Logger.Warn("number of columns reaches upper limit", zap.Int("limit", maxDims), zap.Int("current", len(p.Dims)))
+		return
+	}
+
+	var i int
+	var alters []string
+	newKeys.Range(func(key, value interface{}) bool {
+		i++
+		if i > newKeysQuota {
+			util.Logger.Warn("number of columns reaches upper limit", zap.Int("limit", maxDims), zap.Int("current", i))
+			return false
+		}
+		strKey, _ := key.(string)
+		intVal := value.(int)
+		var strVal string
+		switch intVal {
+		case model.Bool, model.Int64, model.Float64, model.String, model.DateTime, model.Object:
+			strVal, _ = pgType(&model.TypeInfo{Type: intVal, Nullable: true})
+		default:
+			err = errors.Newf("%s: BUG: unsupported column type %s", p.taskCfg.Name, model.GetTypeName(intVal))
+			return false
+		}
+		alters = append(alters, fmt.Sprintf("ADD COLUMN IF NOT EXISTS %s %s", pgx.Identifier{strKey}.Sanitize(), strVal))
+		return true
+	})
+	if err != nil || len(alters) == 0 {
+		return
+	}
+	sort.Strings(alters)
+	query := fmt.Sprintf("ALTER TABLE %s %s", p.table.Sanitize(), strings.Join(alters, ", "))
+	util.Logger.Info(fmt.Sprintf("executing sql=> %s", query), zap.String("task", p.taskCfg.Name))
+	if _, err = p.db.Exec(context.Background(), query); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+// loopWrite copies the rows, retrying up to RetryTimes. On error batch.Rows is left to the rows still to write.
+// Only rows the table rejects for their content go to the dead-letter queue.
+func (p *Postgres) loopWrite(batch *model.Batch) (err error) {
+	times := p.pgCfg.RetryTimes
+	if times <= 0 {
+		times = defaultPgRetryTimes
+	}
+	rows := *batch.Rows
+	var retrycount int
+	err = retry.Do(
+		func() (err error) {
+			rows, err = p.writeRows(rows)
+			return
+		},
+		retry.LastErrorOnly(true),
+		retry.Attempts(uint(times)),
+		retry.Delay(time.Second),
+		retry.OnRetry(func(n uint, err error) {
+			retrycount++
+			util.Logger.Error("flush batch failed",
+				zap.String("task", p.taskCfg.Name),
+				zap.String("group", batch.GroupId),
+				zap.Int("try", retrycount),
+				zap.Error(err))
+			statistics.FlushMsgsErrorTotal.WithLabelValues(p.taskCfg.Name).Add(float64(len(rows)))
+		}),
+	)
+	if err != nil {
+		util.Logger.Error("Postgres.loopWrite failed", zap.String("task", p.taskCfg.Name), zap.Int("rows", len(rows)), zap.Error(err))
+		batch.Rows = &rows
+		return
+	}
+	statistics.FlushMsgsTotal.WithLabelValues(p.taskCfg.Name).Add(float64(batch.RealSize))
+	return
+}
+
+// replayBatch writes a spilled batch once more.
+func (p *Postgres) replayBatch(batch *model.Batch) (err error) {
+	var rows model.Rows
+	if rows, err = p.writeRows(*batch.Rows); err != nil {
+		batch.Rows = &rows
+		return
+	}
+	statistics.FlushMsgsTotal.WithLabelValues(p.taskCfg.Name).Add(float64(batch.RealSize))
+	return
+}
+
+// writeRows copies the rows and returns those still to write on error.
+func (p *Postgres) writeRows(rows model.Rows) (left model.Rows, err error) {
+	rows, values := p.prepare(rows)
+	if err = p.write(values); err == nil {
+		return
+	}
+	if !isPgDataError(err) {
+		return rows, err
+	}
+	// find the rows the table rejects
+	return p.writeBisect(rows, values, err)
+}
+
+// prepare converts the rows to the values to copy. Rows with a value pgx can't take go to the dead-letter queue.
+func (p *Postgres) prepare(rows model.Rows) (kept model.Rows, values [][]interface{}) {
+	values = make([][]interface{}, 0, len(rows))
+	var numBad int
+	for _, row := range rows {
+		vals, err := p.values(row)
+		if err != nil {
+			numBad++
+			p.deadLetter(row, err.Error())
+			continue
+		}
+		kept = append(kept, row)
+		values = append(values, vals)
+	}
+	if numBad != 0 {
+		statistics.ParseMsgsErrorTotal.WithLabelValues(p.taskCfg.Name).Add(float64(numBad))
+		util.Logger.Warn(fmt.Sprintf("writeRows skipped %d rows of %d due to invalid content", numBad, len(rows)),
+			zap.String("task", p.taskCfg.Name))
+	}
+	return
+}
+
+func (p *Postgres) write(values [][]interface{}) (err error) {
+	if len(values) == 0 {
+		return
+	}
+	begin := time.Now()
+	if _, err = p.db.CopyFrom(context.Background(), p.table, p.columns, pgx.CopyFromRows(values)); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	statistics.WritingDurations.WithLabelValues(p.taskCfg.Name, p.taskCfg.TableName).Observe(time.Since(begin).Seconds())
+	return
+}
+
+// writeBisect finds the rows the table rejects after it rejected a batch, so that only they are dropped. It halves
+// a rejected range until the bad rows are alone, which takes a few copies for a few bad rows. On any other error it
+// returns the rows still to write. err is why the batch was rejected.
+func (p *Postgres) writeBisect(rows model.Rows, values [][]interface{}, err error) (model.Rows, error) {
+	var numBad int
+	defer func() {
+		if numBad == 0 {
+			return
+		}
+		statistics.ParseMsgsErrorTotal.WithLabelValues(p.taskCfg.Name).Add(float64(numBad))
+		util.Logger.Warn(fmt.Sprintf("writeRows skipped %d rows of %d due to invalid content", numBad, len(rows)),
+			zap.String("task", p.taskCfg.Name))
+	}()
+	type span struct {
+		begin, end int
+		rejected   bool
+	}
+	// contiguous ranges in order, the first one begins at the first row not handled yet
+	spans := []span{{0, len(rows), true}}
+	for len(spans) != 0 {
+		s := spans[0]
+		if !s.rejected {
+			if err = p.write(values[s.begin:s.end]); err == nil {
+				spans = spans[1:]
+				continue
+			}
+			if !isPgDataError(err) {
+				return rows[s.begin:], err
+			}
+			spans[0].rejected = true
+			continue
+		}
+		if s.end-s.begin == 1 {
+			numBad++
+			p.deadLetter(rows[s.begin], err.Error())
+			spans = spans[1:]
+			continue
+		}
+		mid := (s.begin + s.end) / 2
+		spans = append([]span{{s.begin, mid, false}, {mid, s.end, false}}, spans[1:]...)
+	}
+	return nil, nil
+}
+
+// values converts the values of a row which pgx doesn't encode as they are.
+func (p *Postgres) values(row *model.Row) (vals []interface{}, err error) {
+	vals = make([]interface{}, len(p.Dims))
+	for i, dim := range p.Dims {
+		if i >= len(*row) || (*row)[i] == nil {
+			continue
+		}
+		v := (*row)[i]
+		if dim.Type.Type == model.Map {
+			// pgx would encode the maps as empty objects
+			vals[i] = archive.JSONValue(v)
+			continue
+		}
+		if dim.Type.Array {
+			vals[i] = v
+			continue
+		}
+		switch val := v.(type) {
+		case decimal.Decimal:
+			var n pgtype.Numeric
+			if err = n.Scan(val.String()); err != nil {
+				return nil, errors.Wrapf(err, "column %s", dim.Name)
+			}
+			v = n
+		case uint64:
+			v = pgtype.Numeric{Int: new(big.Int).SetUint64(val), Valid: true}
+		case string:
+			switch dim.Type.Type {
+			case model.IPv4, model.IPv6:
+				var addr netip.Addr
+				if addr, err = netip.ParseAddr(val); err != nil {
+					return nil, errors.Wrapf(err, "column %s", dim.Name)
+				}
+				v = addr
+			case model.UUID:
+				var id pgtype.UUID
+				if err = id.Scan(val); err != nil {
+					return nil, errors.Wrapf(err, "column %s", dim.Name)
+				}
+				v = id
+			}
+		}
+		vals[i] = v
+	}
+	return
+}
+
+func (p *Postgres) deadLetter(row *model.Row, reason string) {
+	obj := make(map[string]interface{}, len(p.Dims))
+	for i, dim := range p.Dims {
+		if i < len(*row) {
+			obj[dim.Name] = archive.JSONValue((*row)[i])
+		}
+	}
+	value, err := json.Marshal(obj)
+	if err != nil {
+		value = []byte(fmt.Sprint(obj))
+	}
+	dlq.Put(&dlq.Entry{Task: p.taskCfg.Name, Stage: dlq.StageWrite, Value: value, Reason: reason})
+}
+
+// isPgDataError tells whether PostgreSQL rejected the content of the rows, which writing them again doesn't help.
+func isPgDataError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || len(pgErr.Code) < 2 {
+		return false
+	}
+	switch pgErr.Code[:2] {
+	case pgDataExceptionClass, pgIntegrityErrorClass:
+		return true
+	}
+	return false
+}
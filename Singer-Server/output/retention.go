@@ -0,0 +1,150 @@
+package output
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/pool"
+	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const maxRetentionChanges = 10
+
+// RetentionStatus is the TTL of a table managed by a task, and its latest changes.
+type RetentionStatus struct {
+	Task    string
+	TTL     string
+	Changes []RetentionChange
+}
+
+type RetentionChange struct {
+	Time   time.Time
+	Before string
+	After  string
+}
+
+// db.table -> *RetentionStatus
+var retentionStatuses sync.Map
+
+func init() {
+	expvar.Publish("Retention", expvar.Func(func() interface{} {
+		result := make(map[string]RetentionStatus)
+		retentionStatuses.Range(func(key, value interface{}) bool {
+			result[key.(string)] = *value.(*RetentionStatus)
+			return true
+		})
+		return result
+	}))
+}
+
+// retentionTTL returns the TTL expression of rCfg the way ClickHouse shows it in system.tables, so that an
+// unchanged retention doesn't alter the table again. An empty expression means no TTL.
+func retentionTTL(rCfg *config.RetentionConfig) (ttl string, err error) {
+	if rCfg.DeleteDays < 0 || rCfg.MoveDays < 0 {
+		return "", errors.Newf("retention days must not be negative")
+	}
+	if rCfg.DeleteDays == 0 && rCfg.MoveDays == 0 {
+		return
+	}
+	if rCfg.Column == "" {
+		return "", errors.Newf("retention requires a column")
+	}
+	base := fmt.Sprintf("toDateTime(`%s`)", rCfg.Column)
+	var rules []string
+	if rCfg.MoveDays > 0 {
+		if rCfg.Volume == "" {
+			return "", errors.Newf("retention moveDays requires a volume")
+		}
+		if rCfg.DeleteDays > 0 && rCfg.DeleteDays <= rCfg.MoveDays {
+			return "", errors.Newf("retention deleteDays must be greater than moveDays")
+		}
+		rules = append(rules, fmt.Sprintf("%s + toIntervalDay(%d) TO VOLUME '%s'", base, rCfg.MoveDays, rCfg.Volume))
+	}
+	if rCfg.DeleteDays > 0 {
+		rules = append(rules, fmt.Sprintf("%s + toIntervalDay(%d)", base, rCfg.DeleteDays))
+	}
+	return strings.Join(rules, ", "), nil
+}
+
+// tableTTL returns the TTL clause of engine_full, or empty if the table has no TTL.
+func tableTTL(engineFull string) string {
+	idx := strings.Index(engineFull, " TTL ")
+	if idx < 0 {
+		return ""
+	}
+	ttl := engineFull[idx+len(" TTL "):]
+	if idx = strings.Index(ttl, " SETTINGS "); idx >= 0 {
+		ttl = ttl[:idx]
+	}
+	return strings.TrimSpace(ttl)
+}
+
+func sameTTL(ttl1, ttl2 string) bool {
+	return strings.ReplaceAll(ttl1, "`", "") == strings.ReplaceAll(ttl2, "`", "")
+}
+
+// initRetention makes the TTL of the table match the retention of the task.
+func (c *ClickHouse) initRetention() (err error) {
+	rCfg := c.taskCfg.Retention
+	if rCfg == nil {
+		return
+	}
+	var want string
+	if want, err = retentionTTL(rCfg); err != nil {
+		return errors.Wrapf(err, "task %s", c.taskCfg.Name)
+	}
+
+	var conn *pool.Conn
+	if conn, _, err = pool.GetShardConn(0).NextGoodReplica(0); err != nil {
+		return
+	}
+	query := fmt.Sprintf("SELECT engine_full FROM system.tables WHERE database = '%s' AND name = '%s'", c.dbName, c.TableName)
+	var engineFull string
+	if err = conn.QueryRow(query).Scan(&engineFull); err != nil {
+		return errors.Wrapf(err, "failed to get the TTL of %s.%s", c.dbName, c.TableName)
+	}
+	cur := tableTTL(engineFull)
+
+	key := c.dbName + "." + c.TableName
+	// statuses are replaced rather than changed, the debug endpoint reads them concurrently
+	status := &RetentionStatus{Task: c.taskCfg.Name, TTL: cur}
+	if v, ok := retentionStatuses.Load(key); ok {
+		status.Changes = v.(*RetentionStatus).Changes
+	}
+	if sameTTL(cur, want) {
+		retentionStatuses.Store(key, status)
+		return
+	}
+
+	var onCluster string
+	if c.cfg.Clickhouse.Cluster != "" {
+		onCluster = fmt.Sprintf("ON CLUSTER `%s`", c.cfg.Clickhouse.Cluster)
+	}
+	if want == "" {
+		query = fmt.Sprintf("ALTER TABLE `%s`.`%s` %s REMOVE TTL", c.dbName, c.TableName, onCluster)
+	} else {
+		query = fmt.Sprintf("ALTER TABLE `%s`.`%s` %s MODIFY TTL %s", c.dbName, c.TableName, onCluster, want)
+	}
+	util.Logger.Info(fmt.Sprintf("executing sql=> %s", query), zap.String("task", c.taskCfg.Name))
+	if err = conn.Exec(query); err != nil {
+		retentionStatuses.Store(key, status)
+		return errors.Wrapf(err, "failed to change the TTL of %s", key)
+	}
+	util.Logger.Info("changed table TTL", zap.String("task", c.taskCfg.Name), zap.String("table", key),
+		zap.String("before", cur), zap.String("after", want))
+	status.TTL = want
+	changes := append([]RetentionChange(nil), status.Changes...)
+	changes = append(changes, RetentionChange{Time: time.Now(), Before: cur, After: want})
+	if n := len(changes); n > maxRetentionChanges {
+		changes = changes[n-maxRetentionChanges:]
+	}
+	status.Changes = changes
+	retentionStatuses.Store(key, status)
+	return
+}
@@ -0,0 +1,179 @@
+package output
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/thanos-io/thanos/pkg/errors"
+)
+
+// shardingPolicy routes a row to the shard of xxHash64(key columns) % shards, which is where a Distributed table
+// with that sharding expression and equal shard weights puts it. Values are hashed the way ClickHouse hashes the
+// column types String, Bool, (U)Int8-64, Float32/64 and DateTime. Other types hash their string form, which a
+// Distributed table doesn't match.
+type shardingPolicy struct {
+	cols  []int
+	types []*model.TypeInfo
+}
+
+func (c *ClickHouse) initSharding() (err error) {
+	c.sharding = nil
+	if c.taskCfg.ShardingKey == "" {
+		return
+	}
+	numDims := c.NumDims
+	if c.taskCfg.PrometheusSchema {
+		numDims = c.IdxSerID + 1
+	}
+	policy := &shardingPolicy{}
+	for _, name := range strings.Split(c.taskCfg.ShardingKey, ",") {
+		name = strings.TrimSpace(name)
+		idx := -1
+		for i, dim := range c.Dims[:numDims] {
+			if dim.Name == name {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return errors.Newf("%s: sharding key column %s not found in %s.%s", c.taskCfg.Name, name, c.dbName, c.TableName)
+		}
+		policy.cols = append(policy.cols, idx)
+		policy.types = append(policy.types, c.Dims[idx].Type)
+	}
+	c.sharding = policy
+	return
+}
+
+// shard returns the shard of a row. A row with a NULL key goes to the first shard.
+func (p *shardingPolicy) shard(row *model.Row, numShards int) int {
+	var h uint64
+	var buf []byte
+	for i, idx := range p.cols {
+		if idx >= len(*row) || (*row)[idx] == nil {
+			return 0
+		}
+		buf = appendHashed(buf[:0], p.types[i], (*row)[idx])
+		cur := xxhash.Sum64(buf)
+		if i == 0 {
+			h = cur
+			continue
+		}
+		// how ClickHouse combines the hashes of the arguments of xxHash64
+		var pair [16]byte
+		binary.LittleEndian.PutUint64(pair[:8], h)
+		binary.LittleEndian.PutUint64(pair[8:], cur)
+		h = xxhash.Sum64(pair[:])
+	}
+	return int(h % uint64(numShards))
+}
+
+// appendHashed appends the bytes ClickHouse hashes for a value of the column type.
+func appendHashed(buf []byte, typ *model.TypeInfo, val interface{}) []byte {
+	if typ.Array || typ.MapKey != nil {
+		return append(buf, fmt.Sprint(val)...)
+	}
+	switch v := val.(type) {
+	case string:
+		return append(buf, v...)
+	case []byte:
+		return append(buf, v...)
+	case time.Time:
+		if typ.Type == model.DateTime {
+			return binary.LittleEndian.AppendUint32(buf, uint32(v.Unix()))
+		}
+	case float32:
+		return binary.LittleEndian.AppendUint32(buf, math.Float32bits(v))
+	case float64:
+		if typ.Type == model.Float32 {
+			return binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(v)))
+		}
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(v))
+	case bool:
+		if v {
+			return append(buf, 1)
+		}
+		return append(buf, 0)
+	}
+	if u, ok := toUint64(val); ok {
+		switch typ.Type {
+		case model.Bool, model.Int8, model.UInt8:
+			return append(buf, byte(u))
+		case model.Int16, model.UInt16:
+			return binary.LittleEndian.AppendUint16(buf, uint16(u))
+		case model.Int32, model.UInt32:
+			return binary.LittleEndian.AppendUint32(buf, uint32(u))
+		case model.Int64, model.UInt64:
+			return binary.LittleEndian.AppendUint64(buf, u)
+		}
+	}
+	return append(buf, fmt.Sprint(val)...)
+}
+
+func toUint64(val interface{}) (u uint64, ok bool) {
+	switch v := val.(type) {
+	case int:
+		return uint64(v), true
+	case int8:
+		return uint64(v), true
+	case int16:
+		return uint64(v), true
+	case int32:
+		return uint64(v), true
+	case int64:
+		return uint64(v), true
+	case uint:
+		return uint64(v), true
+	case uint8:
+		return uint64(v), true
+	case uint16:
+		return uint64(v), true
+	case uint32:
+		return uint64(v), true
+	case uint64:
+		return v, true
+	}
+	return 0, false
+}
+
+// route splits a batch into batches of the shards its rows hash to. They share the WaitGroup of the batch.
+func (c *ClickHouse) route(batch *model.Batch, numShards int) []*model.Batch {
+	if numShards <= 1 || len(*batch.Rows) == 0 {
+		return []*model.Batch{batch}
+	}
+	buckets := make([]model.Rows, numShards)
+	for _, row := range *batch.Rows {
+		s := c.sharding.shard(row, numShards)
+		buckets[s] = append(buckets[s], row)
+	}
+	var batches []*model.Batch
+	for s := range buckets {
+		if len(buckets[s]) == 0 {
+			continue
+		}
+		rows := buckets[s]
+		b := &model.Batch{
+			Rows:      &rows,
+			BatchIdx:  int64(s),
+			RealSize:  len(rows),
+			Wg:        batch.Wg,
+			GroupId:   batch.GroupId,
+			Topic:     batch.Topic,
+			Ranges:    batch.Ranges,
+			NoArchive: batch.NoArchive,
+		}
+		if batch.DedupToken != "" {
+			b.DedupToken = fmt.Sprintf("%s-%d", batch.DedupToken, s)
+		}
+		batches = append(batches, b)
+	}
+	// RealSize counts messages, which may be more than rows
+	batches[0].RealSize += batch.RealSize - len(*batch.Rows)
+	batch.Wg.Add(len(batches) - 1)
+	return batches
+}
@@ -0,0 +1,47 @@
+package output
+
+import (
+	"sync"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/thanos-io/thanos/pkg/errors"
+)
+
+// Outputs a task may write to, see TaskConfig.Output.
+const (
+	OutputClickHouse = "clickhouse"
+	OutputOpenSearch = "opensearch"
+	OutputPostgres   = "postgres"
+)
+
+// Sink is where a task writes its batches to.
+type Sink interface {
+	// Init prepares the sink, Columns are known once it returns.
+	Init() error
+	// Columns returns the columns of the rows of the batches, in order.
+	Columns() []*model.ColumnWithType
+	// Send writes a batch asynchronously, batch.Wg is done once it has been written.
+	Send(batch *model.Batch)
+	// Drain waits for all batches sent to be written, and gives up those spilled.
+	Drain()
+	// SetPauser sets what to pause while batches which failed all retries are spilled.
+	SetPauser(p Pauser)
+	// ChangeSchema adds the columns newKeys maps to their type.
+	ChangeSchema(newKeys *sync.Map) error
+	// Close drains the sink and releases what it holds.
+	Close()
+}
+
+// NewSink returns the sink of a task, ClickHouse unless its Output says otherwise.
+func NewSink(cfg *config.Config, taskCfg *config.TaskConfig) (Sink, error) {
+	switch taskCfg.Output {
+	case "", OutputClickHouse:
+		return NewClickHouse(cfg, taskCfg), nil
+	case OutputOpenSearch:
+		return NewOpenSearch(cfg, taskCfg), nil
+	case OutputPostgres:
+		return NewPostgres(cfg, taskCfg), nil
+	}
+	return nil, errors.Newf("%s: unknown output %s", taskCfg.Name, taskCfg.Output)
+}
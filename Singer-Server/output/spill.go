@@ -0,0 +1,269 @@
+package output
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/statistics"
+	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/shopspring/decimal"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSpillDir       = "spill"
+	defaultReplayInterval = 10
+)
+
+// spill files left by a previous process are removed once, their offsets were never committed
+var cleanedSpillDirs sync.Map
+
+func init() {
+	// concrete types of row values other than the builtin ones
+	gob.Register(time.Time{})
+	gob.Register([]time.Time{})
+	gob.Register(decimal.Decimal{})
+	gob.Register([]decimal.Decimal{})
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+// Pauser pauses and resumes the consumption which feeds a task. Rewind makes it consume again from the last
+// committed offsets, the records of spilled batches which were given up haven't been written.
+type Pauser interface {
+	Pause()
+	Resume()
+	Rewind()
+}
+
+type spilledBatch struct {
+	batch *model.Batch
+	path  string // empty if the rows are kept in memory
+}
+
+// spiller takes over the batches a sink failed to write after all retries, keeps the consumer paused meanwhile and
+// replays them in order. Sinks embed it and call initSpill from Init.
+type spiller struct {
+	cfg  *config.Config
+	task string
+	// replayFn writes a spilled batch once more, it may leave batch.Rows to what is still to write on error.
+	replayFn func(batch *model.Batch) error
+	// rejectFn gives up a batch whose replay failed in a way no later replay can succeed, and reports true.
+	// It may be nil.
+	rejectFn func(batch *model.Batch, err error) bool
+
+	// held while a batch is replayed, so that dropSpilled doesn't give up a batch which is being written
+	replayMux sync.Mutex
+	spillMux  sync.Mutex
+	spilled   []*spilledBatch
+	replaying bool
+	pauser    Pauser
+	paused    bool
+}
+
+// SetPauser sets what to pause while the task has spilled batches, and moves a pending pause over to it.
+func (s *spiller) SetPauser(p Pauser) {
+	s.spillMux.Lock()
+	defer s.spillMux.Unlock()
+	if s.paused && s.pauser != nil {
+		s.pauser.Resume()
+		p.Pause()
+	}
+	s.pauser = p
+}
+
+// numSpilled returns the number of spilled batches.
+func (s *spiller) numSpilled() int {
+	s.spillMux.Lock()
+	defer s.spillMux.Unlock()
+	return len(s.spilled)
+}
+
+func (s *spiller) spillDir() string {
+	dir := defaultSpillDir
+	if s.cfg.Spill != nil && s.cfg.Spill.Dir != "" {
+		dir = s.cfg.Spill.Dir
+	}
+	return filepath.Join(dir, s.task)
+}
+
+func (s *spiller) initSpill(cfg *config.Config, task string, replayFn func(batch *model.Batch) error,
+	rejectFn func(batch *model.Batch, err error) bool) (err error) {
+	s.cfg, s.task, s.replayFn, s.rejectFn = cfg, task, replayFn, rejectFn
+	dir := s.spillDir()
+	if _, loaded := cleanedSpillDirs.LoadOrStore(dir, nil); !loaded {
+		if err = os.RemoveAll(dir); err != nil {
+			return errors.Wrapf(err, "failed to remove stale spill files in %s", dir)
+		}
+	}
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+// spill takes over a batch which failed all retries. The rows go to disk, or stay in memory if they can't be
+// encoded, and the consumer is paused until all spilled batches of the task have been replayed. The caller no
+// longer counts a spilled batch as flying, so that Drain doesn't wait for it.
+func (s *spiller) spill(batch *model.Batch, cause error) {
+	sb := &spilledBatch{batch: batch}
+	path := filepath.Join(s.spillDir(), fmt.Sprintf("%d-%d.gob", time.Now().UnixNano(), batch.BatchIdx))
+	if err := writeSpillFile(path, *batch.Rows); err != nil {
+		util.Logger.Error("failed to spill batch to disk, keeping it in memory",
+			zap.String("task", s.task), zap.String("path", path), zap.Error(err))
+		statistics.SpillErrorsTotal.WithLabelValues(s.task).Inc()
+	} else {
+		sb.path = path
+		batch.Rows = nil
+	}
+
+	s.spillMux.Lock()
+	s.spilled = append(s.spilled, sb)
+	start := !s.replaying
+	s.replaying = true
+	if !s.paused && s.pauser != nil {
+		s.pauser.Pause()
+		s.paused = true
+	}
+	s.spillMux.Unlock()
+
+	statistics.SpilledBatches.WithLabelValues(s.task).Inc()
+	util.Logger.Warn("spilled batch and paused consumption until it can be written",
+		zap.String("task", s.task), zap.Int("rows", batch.RealSize), zap.Error(cause))
+	if start {
+		go s.replay()
+	}
+}
+
+// dropSpilled gives up the spilled batches, after rewinding the consumer so that their offsets aren't committed.
+func (s *spiller) dropSpilled() {
+	s.replayMux.Lock()
+	defer s.replayMux.Unlock()
+	s.spillMux.Lock()
+	spilled := s.spilled
+	s.spilled = nil
+	if s.pauser != nil {
+		if len(spilled) != 0 {
+			s.pauser.Rewind()
+		}
+		if s.paused {
+			s.pauser.Resume()
+		}
+	}
+	s.paused = false
+	s.spillMux.Unlock()
+	if len(spilled) == 0 {
+		return
+	}
+
+	for _, sb := range spilled {
+		removeSpillFile(sb)
+		statistics.SpilledBatches.WithLabelValues(s.task).Dec()
+		sb.batch.Wg.Done()
+	}
+	util.Logger.Warn("gave up spilled batches, they will be consumed again",
+		zap.String("task", s.task), zap.Int("batches", len(spilled)))
+}
+
+// replay writes the spilled batches in order until they succeed, then resumes the consumer.
+func (s *spiller) replay() {
+	interval := defaultReplayInterval
+	if s.cfg.Spill != nil && s.cfg.Spill.ReplayInterval > 0 {
+		interval = s.cfg.Spill.ReplayInterval
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		s.replayMux.Lock()
+		s.spillMux.Lock()
+		if len(s.spilled) == 0 {
+			s.replaying = false
+			if s.paused && s.pauser != nil {
+				s.pauser.Resume()
+			}
+			s.paused = false
+			s.spillMux.Unlock()
+			s.replayMux.Unlock()
+			util.Logger.Info("replayed all spilled batches, resumed consumption", zap.String("task", s.task))
+			return
+		}
+		sb := s.spilled[0]
+		s.spillMux.Unlock()
+
+		err := s.replayBatch(sb)
+		if err != nil && (s.rejectFn == nil || !s.rejectFn(sb.batch, err)) {
+			s.replayMux.Unlock()
+			util.Logger.Warn("failed to replay spilled batch, will retry later", zap.String("task", s.task), zap.Error(err))
+			<-ticker.C
+			continue
+		}
+		s.spillMux.Lock()
+		s.spilled = s.spilled[1:]
+		s.spillMux.Unlock()
+		s.replayMux.Unlock()
+		removeSpillFile(sb)
+		statistics.SpilledBatches.WithLabelValues(s.task).Dec()
+		sb.batch.Wg.Done()
+	}
+}
+
+func (s *spiller) replayBatch(sb *spilledBatch) (err error) {
+	if sb.batch.Rows == nil {
+		var rows model.Rows
+		if rows, err = readSpillFile(sb.path); err != nil {
+			return
+		}
+		sb.batch.Rows = &rows
+	}
+	return s.replayFn(sb.batch)
+}
+
+func removeSpillFile(sb *spilledBatch) {
+	if sb.path != "" {
+		if err := os.Remove(sb.path); err != nil {
+			util.Logger.Warn("failed to remove spill file", zap.String("path", sb.path), zap.Error(err))
+		}
+		sb.path = ""
+	}
+}
+
+func writeSpillFile(path string, rows model.Rows) (err error) {
+	var f *os.File
+	if f, err = os.Create(path); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	w := bufio.NewWriter(f)
+	if err = gob.NewEncoder(w).Encode(rows); err == nil {
+		if err = w.Flush(); err == nil {
+			err = f.Sync()
+		}
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+func readSpillFile(path string) (rows model.Rows, err error) {
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		return nil, errors.Wrapf(err, "")
+	}
+	defer f.Close()
+	if err = gob.NewDecoder(bufio.NewReader(f)).Decode(&rows); err != nil {
+		err = errors.Wrapf(err, "failed to decode spill file %s", path)
+	}
+	return
+}
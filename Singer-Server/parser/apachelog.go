@@ -0,0 +1,369 @@
+package parser
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/thanos-io/thanos/pkg/errors"
+)
+
+const (
+	ApacheFormatCommon   = "common"
+	ApacheFormatCombined = "combined"
+	ApacheFormatError    = "error"
+
+	apacheTimeLayout = "02/Jan/2006:15:04:05 -0700"
+)
+
+var (
+	_ Parser = (*ApacheLogParser)(nil)
+
+	// ApacheFormats are the predefined LogFormat strings, nginx's default "combined" log_format is the same.
+	ApacheFormats = map[string]string{
+		ApacheFormatCommon:   `%h %l %u %t "%r" %>s %b`,
+		ApacheFormatCombined: `%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-Agent}i"`,
+	}
+
+	// [Wed Oct 11 14:32:52.123456 2000] [core:error] [pid 1234:tid 5678] [client 127.0.0.1:5555] AH00123: message
+	apacheErrorRe = regexp.MustCompile(`^\[([^\]]+)\] \[(?:([^:\]]+):)?([^\]]+)\](?: \[pid (\d+)(?::tid (\d+))?\])?(?: \[client ([^\]]+)\])? ?(.*)$`)
+	// 2023/01/02 15:04:05 [error] 1234#5678: *9 message, client: 127.0.0.1, server: localhost
+	nginxErrorRe     = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}) \[(\w+)\] (\d+)#(\d+): (?:\*\d+ )?(.*)$`)
+	nginxClientRe    = regexp.MustCompile(`, client: ([^,]+)`)
+	apacheErrCodeRe  = regexp.MustCompile(`^(AH\d+): `)
+	apacheErrLayouts = []string{"Mon Jan 02 15:04:05.000000 2006", "Mon Jan 02 15:04:05 2006", "Mon Jan _2 15:04:05 2006"}
+)
+
+const (
+	captureString = iota
+	captureInt
+	captureBytes
+	captureLatencyMicros
+	captureLatencySeconds
+	captureTime
+	captureRequest
+)
+
+type logCapture struct {
+	name string
+	kind int
+}
+
+// logFormat is an access log format compiled to a regular expression.
+type logFormat struct {
+	re       *regexp.Regexp
+	captures []logCapture
+}
+
+// ApacheLogParser parses Apache httpd and nginx access logs in the Common, Combined or a custom LogFormat, as
+// well as their error logs. Access log lines are split into typed fields: remote_addr, ident, remote_user,
+// timestamp, method, path, protocol, status (Int64), bytes (Int64), referer, user_agent and latency (Float64,
+// seconds), plus one field per other directive. Error log lines are split into timestamp, module, log_level,
+// pid, tid, remote_addr, remote_port, error_code and message.
+type ApacheLogParser struct {
+	pp     *Pool
+	format *logFormat
+}
+
+// compileLogFormat compiles either a predefined format name or a LogFormat string. Both Apache (%h, %>s,
+// %{User-Agent}i, ...) and nginx ($remote_addr, $status, $http_user_agent, ...) notations are accepted. The
+// error log format compiles to nil.
+func compileLogFormat(format string) (lf *logFormat, err error) {
+	if format == "" {
+		format = ApacheFormatCombined
+	}
+	if format == ApacheFormatError {
+		return
+	}
+	if f, ok := ApacheFormats[format]; ok {
+		format = f
+	}
+	lf = &logFormat{}
+	var sb strings.Builder
+	sb.WriteString("^")
+	quoted := false
+	for i := 0; i < len(format); {
+		var capt logCapture
+		var pattern string
+		var n int
+		switch {
+		case format[i] == '%' && i+1 < len(format) && format[i+1] == '%':
+			sb.WriteString("%")
+			i += 2
+			continue
+		case format[i] == '%':
+			if capt, n, err = parseApacheDirective(format[i:]); err != nil {
+				return
+			}
+		case format[i] == '$' && i+1 < len(format) && isVarChar(format[i+1]):
+			capt, n = parseNginxVariable(format[i:])
+		default:
+			if format[i] == '"' {
+				quoted = !quoted
+			}
+			sb.WriteString(regexp.QuoteMeta(format[i : i+1]))
+			i++
+			continue
+		}
+		switch {
+		case capt.kind == captureTime && !quoted && i > 0 && format[i-1] == '[':
+			pattern = `([^\]]+)`
+		case capt.kind == captureTime && !quoted:
+			pattern = `\[([^\]]+)\]`
+		case quoted:
+			pattern = `((?:[^"\\]|\\.)*)`
+		case capt.kind == captureInt || capt.kind == captureBytes:
+			pattern = `(\d+|-)`
+		case capt.kind == captureLatencyMicros || capt.kind == captureLatencySeconds:
+			pattern = `(\d+(?:\.\d+)?|-)`
+		default:
+			pattern = `(\S+)`
+		}
+		sb.WriteString(pattern)
+		lf.captures = append(lf.captures, capt)
+		i += n
+	}
+	sb.WriteString("$")
+	if lf.re, err = regexp.Compile(sb.String()); err != nil {
+		err = errors.Wrapf(err, "LogFormat %q", format)
+	}
+	return
+}
+
+// parseApacheDirective parses one "%..." directive of a LogFormat, returning the capture and the length consumed.
+func parseApacheDirective(s string) (capt logCapture, n int, err error) {
+	i := 1
+	var arg string
+	// modifiers such as "<", ">" and status code conditions
+	for i < len(s) && (s[i] == '<' || s[i] == '>' || s[i] == '!' || s[i] == ',' || (s[i] >= '0' && s[i] <= '9')) {
+		i++
+	}
+	if i < len(s) && s[i] == '{' {
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			err = errors.Newf("unterminated LogFormat directive %q", s)
+			return
+		}
+		arg = s[i+1 : i+end]
+		i += end + 1
+	}
+	if i >= len(s) {
+		err = errors.Newf("incomplete LogFormat directive %q", s)
+		return
+	}
+	n = i + 1
+	switch s[i] {
+	case 'h', 'a':
+		capt = logCapture{name: "remote_addr"}
+	case 'A':
+		capt = logCapture{name: "local_addr"}
+	case 'l':
+		capt = logCapture{name: "ident"}
+	case 'u':
+		capt = logCapture{name: "remote_user"}
+	case 't':
+		capt = logCapture{name: "timestamp", kind: captureTime}
+	case 'r':
+		capt = logCapture{name: "request", kind: captureRequest}
+	case 'm':
+		capt = logCapture{name: "method"}
+	case 'U':
+		capt = logCapture{name: "path"}
+	case 'q':
+		capt = logCapture{name: "query"}
+	case 'H':
+		capt = logCapture{name: "protocol"}
+	case 's':
+		capt = logCapture{name: "status", kind: captureInt}
+	case 'b', 'B':
+		capt = logCapture{name: "bytes", kind: captureBytes}
+	case 'I':
+		capt = logCapture{name: "bytes_in", kind: captureBytes}
+	case 'O':
+		capt = logCapture{name: "bytes_out", kind: captureBytes}
+	case 'D':
+		capt = logCapture{name: "latency", kind: captureLatencyMicros}
+	case 'T':
+		capt = logCapture{name: "latency", kind: captureLatencySeconds}
+	case 'v', 'V':
+		capt = logCapture{name: "server_name"}
+	case 'p':
+		capt = logCapture{name: "port", kind: captureInt}
+	case 'P':
+		capt = logCapture{name: "pid", kind: captureInt}
+	case 'X':
+		capt = logCapture{name: "connection_status"}
+	case 'i':
+		capt = logCapture{name: headerField(arg)}
+	default:
+		err = errors.Newf("unsupported LogFormat directive %q", s[:n])
+	}
+	return
+}
+
+// parseNginxVariable parses one "$name" variable of a log_format, returning the capture and the length consumed.
+func parseNginxVariable(s string) (capt logCapture, n int) {
+	n = 1
+	for n < len(s) && isVarChar(s[n]) {
+		n++
+	}
+	name := s[1:n]
+	switch name {
+	case "time_local":
+		capt = logCapture{name: "timestamp", kind: captureTime}
+	case "request":
+		capt = logCapture{name: "request", kind: captureRequest}
+	case "request_method":
+		capt = logCapture{name: "method"}
+	case "server_protocol":
+		capt = logCapture{name: "protocol"}
+	case "request_uri", "uri":
+		capt = logCapture{name: "path"}
+	case "status":
+		capt = logCapture{name: "status", kind: captureInt}
+	case "body_bytes_sent", "bytes_sent":
+		capt = logCapture{name: "bytes", kind: captureBytes}
+	case "request_length":
+		capt = logCapture{name: "bytes_in", kind: captureBytes}
+	case "request_time":
+		capt = logCapture{name: "latency", kind: captureLatencySeconds}
+	default:
+		if strings.HasPrefix(name, "http_") {
+			capt = logCapture{name: headerField(name[5:])}
+		} else {
+			capt = logCapture{name: name}
+		}
+	}
+	return
+}
+
+func isVarChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func headerField(header string) string {
+	return strings.ReplaceAll(strings.ToLower(header), "-", "_")
+}
+
+func (p *ApacheLogParser) Parse(bs []byte) (metric model.Metric, err error) {
+	line := strings.TrimRight(string(bs), " \t\r\n")
+	var fields map[string]interface{}
+	if p.format == nil {
+		fields, err = p.parseError(line)
+	} else {
+		fields, err = p.parseAccess(line)
+	}
+	if err != nil {
+		return
+	}
+	metric = &MapMetric{pp: p.pp, fields: fields}
+	return
+}
+
+func (p *ApacheLogParser) parseAccess(line string) (fields map[string]interface{}, err error) {
+	match := p.format.re.FindStringSubmatch(line)
+	if match == nil {
+		err = errors.Newf("access log line doesn't match LogFormat")
+		return
+	}
+	fields = make(map[string]interface{}, len(p.format.captures)+2)
+	for i, capt := range p.format.captures {
+		val := match[i+1]
+		switch capt.kind {
+		case captureInt:
+			if n, e := strconv.ParseInt(val, 10, 64); e == nil {
+				fields[capt.name] = n
+			}
+		case captureBytes:
+			// "-" means no bytes were sent
+			n, _ := strconv.ParseInt(val, 10, 64)
+			fields[capt.name] = n
+		case captureLatencyMicros:
+			if f, e := strconv.ParseFloat(val, 64); e == nil {
+				fields[capt.name] = f / 1e6
+			}
+		case captureLatencySeconds:
+			if f, e := strconv.ParseFloat(val, 64); e == nil {
+				fields[capt.name] = f
+			}
+		case captureTime:
+			if t, e := time.ParseInLocation(apacheTimeLayout, val, p.pp.timeZone); e == nil {
+				fields[capt.name] = t.UTC()
+			} else if t, e := p.pp.ParseDateTime(capt.name, val); e == nil {
+				fields[capt.name] = t
+			}
+		case captureRequest:
+			method, rest, _ := strings.Cut(val, " ")
+			path, proto, found := strings.Cut(rest, " ")
+			if !found || method == "" {
+				fields["path"] = val
+				continue
+			}
+			fields["method"] = method
+			fields["path"] = path
+			fields["protocol"] = proto
+		default:
+			if val != "-" {
+				fields[capt.name] = strings.ReplaceAll(val, `\"`, `"`)
+			}
+		}
+	}
+	return
+}
+
+func (p *ApacheLogParser) parseError(line string) (fields map[string]interface{}, err error) {
+	fields = make(map[string]interface{}, 9)
+	var client, msg string
+	if m := apacheErrorRe.FindStringSubmatch(line); m != nil {
+		for _, layout := range apacheErrLayouts {
+			if t, e := time.ParseInLocation(layout, m[1], p.pp.timeZone); e == nil {
+				fields["timestamp"] = t.UTC()
+				break
+			}
+		}
+		if m[2] != "" {
+			fields["module"] = m[2]
+		}
+		fields["log_level"] = m[3]
+		if pid, e := strconv.ParseInt(m[4], 10, 64); e == nil {
+			fields["pid"] = pid
+		}
+		if tid, e := strconv.ParseInt(m[5], 10, 64); e == nil {
+			fields["tid"] = tid
+		}
+		client, msg = m[6], m[7]
+		if c := apacheErrCodeRe.FindStringSubmatch(msg); c != nil {
+			fields["error_code"] = c[1]
+			msg = msg[len(c[0]):]
+		}
+	} else if m := nginxErrorRe.FindStringSubmatch(line); m != nil {
+		if t, e := time.ParseInLocation("2006/01/02 15:04:05", m[1], p.pp.timeZone); e == nil {
+			fields["timestamp"] = t.UTC()
+		}
+		fields["log_level"] = m[2]
+		pid, _ := strconv.ParseInt(m[3], 10, 64)
+		tid, _ := strconv.ParseInt(m[4], 10, 64)
+		fields["pid"], fields["tid"] = pid, tid
+		msg = m[5]
+		if c := nginxClientRe.FindStringSubmatch(msg); c != nil {
+			client = c[1]
+		}
+	} else {
+		err = errors.Newf("error log line is neither in Apache nor nginx format")
+		return
+	}
+	if client != "" {
+		host, port := client, ""
+		if idx := strings.LastIndexByte(client, ':'); idx > 0 && !strings.HasSuffix(client, "]") {
+			host, port = client[:idx], client[idx+1:]
+		}
+		fields["remote_addr"] = strings.Trim(host, "[]")
+		if n, e := strconv.ParseInt(port, 10, 64); e == nil {
+			fields["remote_port"] = n
+		}
+	}
+	fields["message"] = msg
+	return
+}
@@ -0,0 +1,201 @@
+package parser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApacheLogParser(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		line    string
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name: "combined by default",
+			line: `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav)"`,
+			want: map[string]interface{}{
+				"remote_addr": "127.0.0.1",
+				"remote_user": "frank",
+				"timestamp":   time.Date(2000, 10, 10, 20, 55, 36, 0, time.UTC),
+				"method":      "GET",
+				"path":        "/apache_pb.gif",
+				"protocol":    "HTTP/1.0",
+				"status":      int64(200),
+				"bytes":       int64(2326),
+				"referer":     "http://www.example.com/start.html",
+				"user_agent":  "Mozilla/4.08 [en] (Win98; I ;Nav)",
+			},
+		},
+		{
+			name:   "common without bytes",
+			format: ApacheFormatCommon,
+			line:   `10.0.0.1 - - [10/Oct/2000:13:55:36 +0000] "POST /login HTTP/1.1" 304 -`,
+			want: map[string]interface{}{
+				"remote_addr": "10.0.0.1",
+				"timestamp":   time.Date(2000, 10, 10, 13, 55, 36, 0, time.UTC),
+				"method":      "POST",
+				"path":        "/login",
+				"protocol":    "HTTP/1.1",
+				"status":      int64(304),
+				"bytes":       int64(0),
+			},
+		},
+		{
+			name: "escaped quotes",
+			line: `10.0.0.1 - - [10/Oct/2000:13:55:36 +0000] "GET / HTTP/1.1" 200 5 "-" "say \"hi\""`,
+			want: map[string]interface{}{
+				"remote_addr": "10.0.0.1",
+				"timestamp":   time.Date(2000, 10, 10, 13, 55, 36, 0, time.UTC),
+				"method":      "GET",
+				"path":        "/",
+				"protocol":    "HTTP/1.1",
+				"status":      int64(200),
+				"bytes":       int64(5),
+				"user_agent":  `say "hi"`,
+			},
+		},
+		{
+			name:   "malformed request line",
+			format: ApacheFormatCommon,
+			line:   `10.0.0.1 - - [10/Oct/2000:13:55:36 +0000] "garbage" 400 0`,
+			want: map[string]interface{}{
+				"remote_addr": "10.0.0.1",
+				"timestamp":   time.Date(2000, 10, 10, 13, 55, 36, 0, time.UTC),
+				"path":        "garbage",
+				"status":      int64(400),
+				"bytes":       int64(0),
+			},
+		},
+		{
+			name:   "custom apache format",
+			format: `%h %>s %D "%{X-Request-Id}i"`,
+			line:   `1.2.3.4 500 1500 "abc"`,
+			want: map[string]interface{}{
+				"remote_addr":  "1.2.3.4",
+				"status":       int64(500),
+				"latency":      0.0015,
+				"x_request_id": "abc",
+			},
+		},
+		{
+			name:   "nginx format",
+			format: `$remote_addr [$time_local] "$request" $status $request_time "$http_user_agent" $upstream_addr`,
+			line:   `1.2.3.4 [10/Oct/2000:13:55:36 +0000] "GET / HTTP/2.0" 200 0.012 "curl/8.0" 10.0.0.2:8080`,
+			want: map[string]interface{}{
+				"remote_addr":   "1.2.3.4",
+				"timestamp":     time.Date(2000, 10, 10, 13, 55, 36, 0, time.UTC),
+				"method":        "GET",
+				"path":          "/",
+				"protocol":      "HTTP/2.0",
+				"status":        int64(200),
+				"latency":       0.012,
+				"user_agent":    "curl/8.0",
+				"upstream_addr": "10.0.0.2:8080",
+			},
+		},
+		{
+			name:    "line not matching the format",
+			format:  ApacheFormatCommon,
+			line:    `not an access log line`,
+			wantErr: true,
+		},
+		{
+			name:   "apache error",
+			format: ApacheFormatError,
+			line:   `[Wed Oct 11 14:32:52.123456 2000] [core:error] [pid 1234:tid 5678] [client 127.0.0.1:5555] AH00123: File does not exist: /var/www/favicon.ico`,
+			want: map[string]interface{}{
+				"timestamp":   time.Date(2000, 10, 11, 14, 32, 52, 123456000, time.UTC),
+				"module":      "core",
+				"log_level":   "error",
+				"pid":         int64(1234),
+				"tid":         int64(5678),
+				"remote_addr": "127.0.0.1",
+				"remote_port": int64(5555),
+				"error_code":  "AH00123",
+				"message":     "File does not exist: /var/www/favicon.ico",
+			},
+		},
+		{
+			name:   "apache 2.2 error",
+			format: ApacheFormatError,
+			line:   `[Wed Oct 11 14:32:52 2000] [error] [client 10.0.0.1] client denied by server configuration`,
+			want: map[string]interface{}{
+				"timestamp":   time.Date(2000, 10, 11, 14, 32, 52, 0, time.UTC),
+				"log_level":   "error",
+				"remote_addr": "10.0.0.1",
+				"message":     "client denied by server configuration",
+			},
+		},
+		{
+			name:   "apache error of an ipv6 client",
+			format: ApacheFormatError,
+			line:   `[Wed Oct 11 14:32:52.000001 2000] [authz_core:error] [pid 1] [client ::1:40000] AH01630: client denied`,
+			want: map[string]interface{}{
+				"timestamp":   time.Date(2000, 10, 11, 14, 32, 52, 1000, time.UTC),
+				"module":      "authz_core",
+				"log_level":   "error",
+				"pid":         int64(1),
+				"remote_addr": "::1",
+				"remote_port": int64(40000),
+				"error_code":  "AH01630",
+				"message":     "client denied",
+			},
+		},
+		{
+			name:   "nginx error",
+			format: ApacheFormatError,
+			line:   `2023/01/02 15:04:05 [error] 1234#5678: *9 open() "/x" failed, client: 127.0.0.1, server: localhost`,
+			want: map[string]interface{}{
+				"timestamp":   time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC),
+				"log_level":   "error",
+				"pid":         int64(1234),
+				"tid":         int64(5678),
+				"remote_addr": "127.0.0.1",
+				"message":     `open() "/x" failed, client: 127.0.0.1, server: localhost`,
+			},
+		},
+		{
+			name:    "neither apache nor nginx error",
+			format:  ApacheFormatError,
+			line:    `something went wrong`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pp, err := NewParserPool("apachelog", nil, "", "UTC", 0, "", WithLogFormat(tt.format))
+			require.NoError(t, err)
+			fields, err := parseFields(t, pp, tt.line)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, fields)
+		})
+	}
+}
+
+func TestCompileLogFormatErrors(t *testing.T) {
+	for _, format := range []string{`%h %{Referer`, `%h %Z`, `%h %`} {
+		t.Run(format, func(t *testing.T) {
+			_, err := NewParserPool("apachelog", nil, "", "UTC", 0, "", WithLogFormat(format))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestTaskOptionsLogFormat(t *testing.T) {
+	pp, err := NewParserPool("apachelog", nil, "", "UTC", 0, "", TaskOptions(&config.TaskConfig{LogFormat: ApacheFormatCommon})...)
+	require.NoError(t, err)
+	// a line without referer and user agent only matches the common format
+	_, err = parseFields(t, pp, `10.0.0.1 - - [10/Oct/2000:13:55:36 +0000] "GET / HTTP/1.1" 200 5`)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,193 @@
+package parser
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/thanos-io/thanos/pkg/errors"
+)
+
+const (
+	grokTypeString   = "string"
+	grokTypeInt      = "int"
+	grokTypeFloat    = "float"
+	grokTypeDateTime = "datetime"
+
+	grokMaxDepth = 32
+	// prefix of the names of the groups captures are compiled to, user patterns must not name groups like this
+	grokGroupPrefix = "__grok_"
+)
+
+var (
+	_ Parser = (*GrokParser)(nil)
+
+	ErrGrokNoMatch = errors.Newf("line doesn't match any grok pattern")
+
+	grokRef = regexp.MustCompile(`%\{(\w+)(?::([\w.@-]+))?(?::(\w+))?\}`)
+)
+
+type grokCapture struct {
+	field string
+	typ   string
+}
+
+// grokExpr is a match expression compiled to a regexp. Go doesn't accept arbitrary group names, so captures are
+// named __grok_0, __grok_1, ... and mapped back to fields.
+type grokExpr struct {
+	re       *regexp.Regexp
+	captures map[string]grokCapture
+}
+
+type grokSettings struct {
+	patterns    []string
+	definitions map[string]string
+	fallback    string
+}
+
+type grok struct {
+	exprs    []*grokExpr
+	fallback string
+}
+
+// GrokParser parses text lines with grok match expressions. The named captures of the first expression which
+// matches become the fields of the metric, converted according to their type hints.
+type GrokParser struct {
+	pp *Pool
+}
+
+func compileGrok(patterns []string, definitions map[string]string, fallback string) (g *grok, err error) {
+	if len(patterns) == 0 {
+		err = errors.Newf("grok parser requires at least one pattern")
+		return
+	}
+	library := make(map[string]string, len(GrokPatterns)+len(definitions))
+	for name, pattern := range GrokPatterns {
+		library[name] = pattern
+	}
+	for name, pattern := range definitions {
+		library[name] = pattern
+	}
+	g = &grok{fallback: fallback}
+	for _, pattern := range patterns {
+		expr := &grokExpr{captures: make(map[string]grokCapture)}
+		var expanded string
+		if expanded, err = expr.expand(pattern, library, 0); err != nil {
+			return
+		}
+		if expr.re, err = regexp.Compile(expanded); err != nil {
+			err = errors.Wrapf(err, "failed to compile grok pattern %q", pattern)
+			return
+		}
+		// plain named groups of user patterns are taken as string fields
+		numTyped, numReserved := len(expr.captures), 0
+		for _, name := range expr.re.SubexpNames() {
+			if strings.HasPrefix(name, grokGroupPrefix) {
+				numReserved++
+			} else if _, ok := expr.captures[name]; name != "" && !ok {
+				expr.captures[name] = grokCapture{field: name, typ: grokTypeString}
+			}
+		}
+		if numReserved != numTyped {
+			err = errors.Newf("grok pattern %q names a group with the reserved prefix %s", pattern, grokGroupPrefix)
+			return
+		}
+		g.exprs = append(g.exprs, expr)
+	}
+	return
+}
+
+func (e *grokExpr) expand(pattern string, library map[string]string, depth int) (expanded string, err error) {
+	if depth > grokMaxDepth {
+		err = errors.Newf("grok pattern %q nests too deep, is it recursive?", pattern)
+		return
+	}
+	expanded = grokRef.ReplaceAllStringFunc(pattern, func(ref string) string {
+		if err != nil {
+			return ""
+		}
+		m := grokRef.FindStringSubmatch(ref)
+		def, ok := library[m[1]]
+		if !ok {
+			err = errors.Newf("unknown grok pattern %q", m[1])
+			return ""
+		}
+		var sub string
+		if sub, err = e.expand(def, library, depth+1); err != nil {
+			return ""
+		}
+		if m[2] == "" {
+			return "(?:" + sub + ")"
+		}
+		typ := m[3]
+		switch typ {
+		case "":
+			typ = grokTypeString
+		case grokTypeString, grokTypeInt, grokTypeFloat, grokTypeDateTime:
+		default:
+			err = errors.Newf("unknown type %q of grok capture %q", typ, m[2])
+			return ""
+		}
+		group := grokGroupPrefix + strconv.Itoa(len(e.captures))
+		e.captures[group] = grokCapture{field: m[2], typ: typ}
+		return "(?P<" + group + ">" + sub + ")"
+	})
+	return
+}
+
+func (p *GrokParser) Parse(bs []byte) (metric model.Metric, err error) {
+	line := strings.TrimRight(string(bs), "\r\n")
+	g := p.pp.grok
+	for _, expr := range g.exprs {
+		match := expr.re.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		fields := make(map[string]interface{}, len(expr.captures))
+		for i, name := range expr.re.SubexpNames() {
+			capt, ok := expr.captures[name]
+			// an optional group which didn't participate leaves the field out
+			if !ok || match[i] == "" {
+				continue
+			}
+			if fields[capt.field], err = p.convert(capt, match[i]); err != nil {
+				return
+			}
+		}
+		metric = &MapMetric{pp: p.pp, fields: fields}
+		return
+	}
+	if g.fallback == "" {
+		err = ErrGrokNoMatch
+		return
+	}
+	metric = &MapMetric{pp: p.pp, fields: map[string]interface{}{g.fallback: line}}
+	return
+}
+
+func (p *GrokParser) convert(capt grokCapture, s string) (v interface{}, err error) {
+	switch capt.typ {
+	case grokTypeInt:
+		if v, err = strconv.ParseInt(s, 10, 64); err != nil {
+			err = errors.Wrapf(err, "grok capture %s", capt.field)
+		}
+	case grokTypeFloat:
+		if v, err = strconv.ParseFloat(s, 64); err != nil {
+			err = errors.Wrapf(err, "grok capture %s", capt.field)
+		}
+	case grokTypeDateTime:
+		// neither HTTPDATE nor TIMESTAMP_ISO8601 are among the generic layouts
+		if t, e := time.Parse(apacheTimeLayout, s); e == nil {
+			v = t.UTC()
+		} else if t, e := time.Parse(time.RFC3339Nano, s); e == nil {
+			v = t.UTC()
+		} else if v, err = p.pp.ParseDateTime(capt.field, s); err != nil {
+			err = errors.Wrapf(err, "grok capture %s", capt.field)
+		}
+	default:
+		v = s
+	}
+	return
+}
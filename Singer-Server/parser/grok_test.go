@@ -0,0 +1,141 @@
+package parser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGrokParser(t *testing.T) {
+	tests := []struct {
+		name        string
+		patterns    []string
+		definitions map[string]string
+		fallback    string
+		line        string
+		want        map[string]interface{}
+		noMatch     bool
+		wantErr     bool
+	}{
+		{
+			name:     "typed captures",
+			patterns: []string{`%{IPORHOST:client} %{WORD:method} %{URIPATHPARAM:path} %{NUMBER:bytes:int} %{NUMBER:duration:float}`},
+			line:     "55.3.244.1 GET /index.html?x=1 15824 0.043",
+			want: map[string]interface{}{
+				"client":   "55.3.244.1",
+				"method":   "GET",
+				"path":     "/index.html?x=1",
+				"bytes":    int64(15824),
+				"duration": 0.043,
+			},
+		},
+		{
+			name:     "datetime captures",
+			patterns: []string{`%{TIMESTAMP_ISO8601:ts:datetime} \[%{HTTPDATE:received:datetime}\] %{LOGLEVEL:level} %{GREEDYDATA:message}`},
+			line:     "2024-01-02T03:04:05.5+01:00 [10/Oct/2000:13:55:36 -0700] ERROR disk full",
+			want: map[string]interface{}{
+				"ts":       time.Date(2024, 1, 2, 2, 4, 5, 5e8, time.UTC),
+				"received": time.Date(2000, 10, 10, 20, 55, 36, 0, time.UTC),
+				"level":    "ERROR",
+				"message":  "disk full",
+			},
+		},
+		{
+			name:     "first matching pattern",
+			patterns: []string{`%{INT:code:int} %{GREEDYDATA:message}`, `%{WORD:level}: %{GREEDYDATA:message}`},
+			line:     "warning: low memory\n",
+			want:     map[string]interface{}{"level": "warning", "message": "low memory"},
+		},
+		{
+			name:        "user definitions",
+			patterns:    []string{`%{TICKET:ticket} %{WORD:state}`},
+			definitions: map[string]string{"TICKET": `[A-Z]{3}-%{POSINT}`, "WORD": `[a-z]+`},
+			line:        "OPS-42 closed",
+			want:        map[string]interface{}{"ticket": "OPS-42", "state": "closed"},
+		},
+		{
+			name:     "plain named groups next to typed captures",
+			patterns: []string{`%{INT:g0:int} (?P<g1>\w+) (?P<user>\w+)`},
+			line:     "7 login alice",
+			want:     map[string]interface{}{"g0": int64(7), "g1": "login", "user": "alice"},
+		},
+		{
+			name:     "optional capture left out",
+			patterns: []string{`%{WORD:action}(?: %{INT:count:int})?`},
+			line:     "reset",
+			want:     map[string]interface{}{"action": "reset"},
+		},
+		{
+			name:     "fallback field",
+			patterns: []string{`%{INT:code:int}`},
+			fallback: "raw",
+			line:     "no code here",
+			want:     map[string]interface{}{"raw": "no code here"},
+		},
+		{
+			name:     "no match",
+			patterns: []string{`%{INT:code:int}`},
+			line:     "no code here",
+			noMatch:  true,
+		},
+		{
+			name:     "unconvertible capture",
+			patterns: []string{`%{DATA:n:int}$`},
+			line:     "abc",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pp, err := NewParserPool("grok", nil, "", "UTC", 0, "", WithGrok(tt.patterns, tt.definitions, tt.fallback))
+			require.NoError(t, err)
+			fields, err := parseFields(t, pp, tt.line)
+			switch {
+			case tt.noMatch:
+				assert.ErrorIs(t, err, ErrGrokNoMatch)
+			case tt.wantErr:
+				assert.Error(t, err)
+			default:
+				require.NoError(t, err)
+				assert.Equal(t, tt.want, fields)
+			}
+		})
+	}
+}
+
+func TestCompileGrokErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		patterns    []string
+		definitions map[string]string
+	}{
+		{name: "no pattern"},
+		{name: "unknown pattern", patterns: []string{`%{NOSUCHPATTERN:x}`}},
+		{name: "unknown type", patterns: []string{`%{INT:x:bool}`}},
+		{name: "recursive definition", patterns: []string{`%{LOOP:x}`}, definitions: map[string]string{"LOOP": `a%{LOOP}`}},
+		{name: "invalid regexp", patterns: []string{`%{INT:x} (`}},
+		{name: "reserved group name", patterns: []string{`%{INT:x:int} (?P<__grok_0>\w+)`}},
+		{name: "reserved group name without captures", patterns: []string{`(?P<__grok_7>\w+)`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewParserPool("grok", nil, "", "UTC", 0, "", WithGrok(tt.patterns, tt.definitions, ""))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestTaskOptionsGrok(t *testing.T) {
+	taskCfg := &config.TaskConfig{Grok: &config.GrokConfig{Patterns: []string{`%{INT:n:int}`}, FallbackField: "raw"}}
+	pp, err := NewParserPool("grok", nil, "", "UTC", 0, "", TaskOptions(taskCfg)...)
+	require.NoError(t, err)
+	fields, err := parseFields(t, pp, "12")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"n": int64(12)}, fields)
+	fields, err = parseFields(t, pp, "twelve")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"raw": "twelve"}, fields)
+}
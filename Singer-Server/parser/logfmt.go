@@ -0,0 +1,98 @@
+package parser
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/thanos-io/thanos/pkg/errors"
+)
+
+var _ Parser = (*LogfmtParser)(nil)
+
+// LogfmtParser parses logfmt lines such as `level=info msg="request done" status=200 took=0.25 cached`.
+// Bare values are typed so that dynamicSchema picks sensible columns: integers become Int64, other numbers Float64,
+// true and false Bool, and a key without "=" is a true flag. Quoted values always stay strings.
+// If a key repeats, the last value wins.
+type LogfmtParser struct {
+	pp *Pool
+}
+
+func (p *LogfmtParser) Parse(bs []byte) (metric model.Metric, err error) {
+	line := strings.TrimRight(string(bs), "\r\n")
+	fields := make(map[string]interface{})
+	for i := 0; i < len(line); {
+		if line[i] <= ' ' {
+			i++
+			continue
+		}
+		start := i
+		for i < len(line) && line[i] > ' ' && line[i] != '=' && line[i] != '"' {
+			i++
+		}
+		if i == start {
+			err = errors.Newf("logfmt: unexpected %q at column %d", line[i], i)
+			return
+		}
+		key := line[start:i]
+		if i == len(line) || line[i] != '=' {
+			fields[key] = true
+			continue
+		}
+		i++
+		if i < len(line) && line[i] == '"' {
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				err = errors.Newf("logfmt: unterminated quoted value of key %s", key)
+				return
+			}
+			var val string
+			if val, err = strconv.Unquote(line[i : end+1]); err != nil {
+				err = errors.Wrapf(err, "logfmt: invalid quoted value of key %s", key)
+				return
+			}
+			fields[key] = val
+			i = end + 1
+			continue
+		}
+		start = i
+		for i < len(line) && line[i] > ' ' {
+			i++
+		}
+		fields[key] = logfmtValue(line[start:i])
+	}
+	if len(fields) == 0 {
+		err = errors.Newf("logfmt: no key=value pairs in message")
+		return
+	}
+	metric = &MapMetric{pp: p.pp, fields: fields}
+	return
+}
+
+func logfmtValue(s string) interface{} {
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "":
+		return s
+	}
+	// strconv.ParseFloat also accepts "inf", "nan" and hex, which are words in a log line
+	if c := s[0]; (c < '0' || c > '9') && c != '-' && c != '+' && c != '.' {
+		return s
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !strings.ContainsAny(s, "xXpP_") {
+		return f
+	}
+	return s
+}
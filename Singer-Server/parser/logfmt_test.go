@@ -0,0 +1,64 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogfmtParser(t *testing.T) {
+	pp, err := NewParserPool("logfmt", nil, "", "UTC", 0, "")
+	require.NoError(t, err)
+	tests := []struct {
+		name    string
+		line    string
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name: "typed values",
+			line: "level=info msg=\"request done\" status=200 took=0.25 cached ok=false ratio=-1e3\n",
+			want: map[string]interface{}{
+				"level":  "info",
+				"msg":    "request done",
+				"status": int64(200),
+				"took":   0.25,
+				"cached": true,
+				"ok":     false,
+				"ratio":  -1000.0,
+			},
+		},
+		{
+			name: "quoted values stay strings",
+			line: `a="200" b="true" c="say \"hi\"" d=""`,
+			want: map[string]interface{}{"a": "200", "b": "true", "c": `say "hi"`, "d": ""},
+		},
+		{
+			name: "words that parse as numbers",
+			line: "a=inf b=NaN c=0x1p3 d=1_000 e=12ab f=-",
+			want: map[string]interface{}{"a": "inf", "b": "NaN", "c": "0x1p3", "d": "1_000", "e": "12ab", "f": "-"},
+		},
+		{
+			name: "empty value and repeated key",
+			line: "\tk= k=v2  empty=\r\n",
+			want: map[string]interface{}{"k": "v2", "empty": ""},
+		},
+		{name: "empty line", line: " \n", wantErr: true},
+		{name: "missing key", line: "a=1 =2", wantErr: true},
+		{name: "quote in key", line: `a"b=1`, wantErr: true},
+		{name: "unterminated quote", line: `msg="oops`, wantErr: true},
+		{name: "invalid escape", line: `msg="\q"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, err := parseFields(t, pp, tt.line)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, fields)
+		})
+	}
+}
@@ -0,0 +1,435 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/constraints"
+
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/shopspring/decimal"
+	"go.uber.org/zap"
+)
+
+var _ model.Metric = (*MapMetric)(nil)
+
+// MapMetric is the metric of parsers which decode text lines instead of json. Values are kept typed as
+// string, int64, float64, bool, time.Time or map[string]interface{}, so that GetNewKeys is able to
+// detect the column type the same way as FastjsonMetric.
+type MapMetric struct {
+	pp     *Pool
+	fields map[string]interface{}
+}
+
+func NewMapMetric(pp *Pool, fields map[string]interface{}) *MapMetric {
+	return &MapMetric{pp: pp, fields: fields}
+}
+
+func (c *MapMetric) GetString(key string, nullable bool) (val interface{}) {
+	return mapGetString(c.fields[key], nullable)
+}
+
+func (c *MapMetric) GetBool(key string, nullable bool) (val interface{}) {
+	switch v := c.fields[key].(type) {
+	case bool:
+		val = v
+	case string:
+		if b, err := strconv.ParseBool(v); err == nil {
+			val = b
+		} else {
+			val = getDefaultBool(nullable)
+		}
+	default:
+		val = getDefaultBool(nullable)
+	}
+	return
+}
+
+func (c *MapMetric) GetDecimal(key string, nullable bool) (val interface{}) {
+	if f, ok := anyToFloat64(c.fields[key]); ok {
+		val = decimal.NewFromFloat(f)
+	} else {
+		val = getDefaultDecimal(nullable)
+	}
+	return
+}
+
+func (c *MapMetric) GetInt8(key string, nullable bool) (val interface{}) {
+	return MapGetInt[int8](c.fields[key], nullable, math.MinInt8, math.MaxInt8)
+}
+
+func (c *MapMetric) GetInt16(key string, nullable bool) (val interface{}) {
+	return MapGetInt[int16](c.fields[key], nullable, math.MinInt16, math.MaxInt16)
+}
+
+func (c *MapMetric) GetInt32(key string, nullable bool) (val interface{}) {
+	return MapGetInt[int32](c.fields[key], nullable, math.MinInt32, math.MaxInt32)
+}
+
+func (c *MapMetric) GetInt64(key string, nullable bool) (val interface{}) {
+	return MapGetInt[int64](c.fields[key], nullable, math.MinInt64, math.MaxInt64)
+}
+
+func (c *MapMetric) GetUint8(key string, nullable bool) (val interface{}) {
+	return MapGetUint[uint8](c.fields[key], nullable, math.MaxUint8)
+}
+
+func (c *MapMetric) GetUint16(key string, nullable bool) (val interface{}) {
+	return MapGetUint[uint16](c.fields[key], nullable, math.MaxUint16)
+}
+
+func (c *MapMetric) GetUint32(key string, nullable bool) (val interface{}) {
+	return MapGetUint[uint32](c.fields[key], nullable, math.MaxUint32)
+}
+
+func (c *MapMetric) GetUint64(key string, nullable bool) (val interface{}) {
+	return MapGetUint[uint64](c.fields[key], nullable, math.MaxUint64)
+}
+
+func (c *MapMetric) GetFloat32(key string, nullable bool) (val interface{}) {
+	return MapGetFloat[float32](c.fields[key], nullable, math.MaxFloat32)
+}
+
+func (c *MapMetric) GetFloat64(key string, nullable bool) (val interface{}) {
+	return MapGetFloat[float64](c.fields[key], nullable, math.MaxFloat64)
+}
+
+func MapGetInt[T constraints.Signed](v interface{}, nullable bool, min, max int64) (val interface{}) {
+	val2, ok := anyToInt64(v)
+	if !ok {
+		val = getDefaultInt[T](nullable)
+	} else if val2 < min {
+		val = T(min)
+	} else if val2 > max {
+		val = T(max)
+	} else {
+		val = T(val2)
+	}
+	return
+}
+
+func MapGetUint[T constraints.Unsigned](v interface{}, nullable bool, max uint64) (val interface{}) {
+	val2, ok := anyToInt64(v)
+	if !ok {
+		val = getDefaultInt[T](nullable)
+	} else if val2 < 0 {
+		val = T(0)
+	} else if uint64(val2) > max {
+		val = T(max)
+	} else {
+		val = T(val2)
+	}
+	return
+}
+
+func MapGetFloat[T constraints.Float](v interface{}, nullable bool, max float64) (val interface{}) {
+	val2, ok := anyToFloat64(v)
+	if !ok {
+		val = getDefaultFloat[T](nullable)
+	} else if val2 > max {
+		val = T(max)
+	} else {
+		val = T(val2)
+	}
+	return
+}
+
+func (c *MapMetric) GetDateTime(key string, nullable bool) (val interface{}) {
+	return c.getDateTime(key, c.fields[key], nullable)
+}
+
+func (c *MapMetric) getDateTime(sourcename string, v interface{}, nullable bool) (val interface{}) {
+	switch t := v.(type) {
+	case time.Time:
+		val = t.UTC()
+	case int64:
+		val = UnixFloat(float64(t), c.pp.timeUnit)
+	case float64:
+		val = UnixFloat(t, c.pp.timeUnit)
+	case string:
+		var err error
+		if val, err = c.pp.ParseDateTime(sourcename, t); err != nil {
+			val = getDefaultDateTime(nullable)
+		}
+	default:
+		val = getDefaultDateTime(nullable)
+	}
+	return
+}
+
+func (c *MapMetric) GetObject(key string, nullable bool) (val interface{}) {
+	if m, ok := c.fields[key].(map[string]interface{}); ok {
+		return m
+	}
+	return EmpytObject
+}
+
+func (c *MapMetric) GetArray(key string, typ int) (val interface{}) {
+	array, _ := c.fields[key].([]interface{})
+	switch typ {
+	case model.Bool:
+		arr := make([]bool, 0, len(array))
+		for _, e := range array {
+			b, _ := e.(bool)
+			arr = append(arr, b)
+		}
+		val = arr
+	case model.Int8:
+		val = mapIntArray[int8](array, math.MinInt8, math.MaxInt8)
+	case model.Int16:
+		val = mapIntArray[int16](array, math.MinInt16, math.MaxInt16)
+	case model.Int32:
+		val = mapIntArray[int32](array, math.MinInt32, math.MaxInt32)
+	case model.Int64:
+		val = mapIntArray[int64](array, math.MinInt64, math.MaxInt64)
+	case model.UInt8:
+		val = mapUintArray[uint8](array, math.MaxUint8)
+	case model.UInt16:
+		val = mapUintArray[uint16](array, math.MaxUint16)
+	case model.UInt32:
+		val = mapUintArray[uint32](array, math.MaxUint32)
+	case model.UInt64:
+		val = mapUintArray[uint64](array, math.MaxUint64)
+	case model.Float32:
+		val = mapFloatArray[float32](array, math.MaxFloat32)
+	case model.Float64:
+		val = mapFloatArray[float64](array, math.MaxFloat64)
+	case model.Decimal:
+		arr := make([]decimal.Decimal, 0, len(array))
+		for _, e := range array {
+			f, _ := anyToFloat64(e)
+			arr = append(arr, decimal.NewFromFloat(f))
+		}
+		val = arr
+	case model.String:
+		arr := make([]string, 0, len(array))
+		for _, e := range array {
+			arr = append(arr, mapGetString(e, false).(string))
+		}
+		val = arr
+	case model.DateTime:
+		arr := make([]time.Time, 0, len(array))
+		for _, e := range array {
+			arr = append(arr, c.getDateTime(key, e, false).(time.Time))
+		}
+		val = arr
+	case model.Object:
+		arr := make([]map[string]interface{}, 0, len(array))
+		for _, e := range array {
+			if m, ok := e.(map[string]interface{}); ok {
+				arr = append(arr, m)
+			}
+		}
+		val = arr
+	default:
+		util.Logger.Fatal(fmt.Sprintf("LOGIC ERROR: unsupported array type %v", typ))
+	}
+	return
+}
+
+func (c *MapMetric) GetMap(key string, typeinfo *model.TypeInfo) (val interface{}) {
+	m := model.NewOrderedMap()
+	obj, _ := c.fields[key].(map[string]interface{})
+	fj := &FastjsonMetric{pp: c.pp}
+	for k, v := range obj {
+		m.Put(fj.castMapKeyByType([]byte(k), typeinfo.MapKey), c.castMapValueByType(k, v, typeinfo.MapValue))
+	}
+	return m
+}
+
+func (c *MapMetric) castMapValueByType(sourcename string, v interface{}, typeinfo *model.TypeInfo) (val interface{}) {
+	if typeinfo.Array {
+		sub := &MapMetric{pp: c.pp, fields: map[string]interface{}{sourcename: v}}
+		return sub.GetArray(sourcename, typeinfo.Type)
+	}
+	switch typeinfo.Type {
+	case model.Bool:
+		sub := &MapMetric{pp: c.pp, fields: map[string]interface{}{sourcename: v}}
+		val = sub.GetBool(sourcename, typeinfo.Nullable)
+	case model.Int8:
+		val = MapGetInt[int8](v, typeinfo.Nullable, math.MinInt8, math.MaxInt8)
+	case model.Int16:
+		val = MapGetInt[int16](v, typeinfo.Nullable, math.MinInt16, math.MaxInt16)
+	case model.Int32:
+		val = MapGetInt[int32](v, typeinfo.Nullable, math.MinInt32, math.MaxInt32)
+	case model.Int64:
+		val = MapGetInt[int64](v, typeinfo.Nullable, math.MinInt64, math.MaxInt64)
+	case model.UInt8:
+		val = MapGetUint[uint8](v, typeinfo.Nullable, math.MaxUint8)
+	case model.UInt16:
+		val = MapGetUint[uint16](v, typeinfo.Nullable, math.MaxUint16)
+	case model.UInt32:
+		val = MapGetUint[uint32](v, typeinfo.Nullable, math.MaxUint32)
+	case model.UInt64:
+		val = MapGetUint[uint64](v, typeinfo.Nullable, math.MaxUint64)
+	case model.Float32:
+		val = MapGetFloat[float32](v, typeinfo.Nullable, math.MaxFloat32)
+	case model.Float64:
+		val = MapGetFloat[float64](v, typeinfo.Nullable, math.MaxFloat64)
+	case model.Decimal:
+		if f, ok := anyToFloat64(v); ok {
+			val = decimal.NewFromFloat(f)
+		} else {
+			val = getDefaultDecimal(typeinfo.Nullable)
+		}
+	case model.DateTime:
+		val = c.getDateTime(sourcename, v, typeinfo.Nullable)
+	case model.String:
+		val = mapGetString(v, typeinfo.Nullable)
+	case model.Object:
+		if m, ok := v.(map[string]interface{}); ok {
+			val = m
+		} else {
+			val = EmpytObject
+		}
+	default:
+		util.Logger.Fatal("LOGIC ERROR: reached switch default condition")
+	}
+	return
+}
+
+func (c *MapMetric) GetNewKeys(knownKeys, newKeys, warnKeys *sync.Map, white, black *regexp.Regexp, partition int, offset int64) (foundNew bool) {
+	for strKey, v := range c.fields {
+		if _, loaded := knownKeys.LoadOrStore(strKey, nil); !loaded {
+			if (white == nil || white.MatchString(strKey)) &&
+				(black == nil || !black.MatchString(strKey)) {
+				if typ := mapDetectType(v); typ != model.Unknown && typ != model.Object {
+					newKeys.Store(strKey, typ)
+					foundNew = true
+				} else if _, loaded = warnKeys.LoadOrStore(strKey, nil); !loaded {
+					util.Logger.Warn("MapMetric.GetNewKeys ignored new key due to unsupported type of dynamic column", zap.Int("partition", partition), zap.Int64("offset", offset), zap.String("key", strKey), zap.Any("value", v))
+				}
+			} else if _, loaded = warnKeys.LoadOrStore(strKey, nil); !loaded {
+				util.Logger.Warn("MapMetric.GetNewKeys ignored new key due to white/black list setting", zap.Int("partition", partition), zap.Int64("offset", offset), zap.String("key", strKey), zap.Any("value", v))
+				knownKeys.Store(strKey, nil)
+			}
+		}
+	}
+	return
+}
+
+// mapDetectType is the counterpart of fjDetectType for typed values. Arrays are not supported as dynamic columns.
+func mapDetectType(v interface{}) (typ int) {
+	typ = model.Unknown
+	switch val := v.(type) {
+	case bool:
+		typ = model.Bool
+	case int64:
+		typ = model.Int64
+	case float64:
+		typ = model.Float64
+	case time.Time:
+		typ = model.DateTime
+	case string:
+		typ = model.String
+		if _, layout := parseInLocation(val, time.Local); layout != "" {
+			typ = model.DateTime
+		}
+	case map[string]interface{}:
+		typ = model.Object
+	}
+	return
+}
+
+func mapGetString(v interface{}, nullable bool) (val interface{}) {
+	switch s := v.(type) {
+	case nil:
+		if nullable {
+			return
+		}
+		val = ""
+	case string:
+		val = s
+	case time.Time:
+		val = s.UTC().Format(time.RFC3339Nano)
+	case map[string]interface{}, []interface{}:
+		bs, _ := json.Marshal(s)
+		val = string(bs)
+	default:
+		val = fmt.Sprint(s)
+	}
+	return
+}
+
+func anyToInt64(v interface{}) (i int64, ok bool) {
+	switch val := v.(type) {
+	case int64:
+		return val, true
+	case float64:
+		return int64(val), true
+	case bool:
+		if val {
+			i = 1
+		}
+		return i, true
+	case string:
+		var err error
+		if i, err = strconv.ParseInt(val, 10, 64); err == nil {
+			return i, true
+		}
+	}
+	return
+}
+
+func anyToFloat64(v interface{}) (f float64, ok bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case int64:
+		return float64(val), true
+	case string:
+		var err error
+		if f, err = strconv.ParseFloat(val, 64); err == nil {
+			return f, true
+		}
+	}
+	return
+}
+
+func mapIntArray[T constraints.Signed](a []interface{}, min, max int64) (arr []T) {
+	arr = make([]T, 0, len(a))
+	for _, e := range a {
+		val2, _ := anyToInt64(e)
+		if val2 < min {
+			val2 = min
+		} else if val2 > max {
+			val2 = max
+		}
+		arr = append(arr, T(val2))
+	}
+	return
+}
+
+func mapUintArray[T constraints.Unsigned](a []interface{}, max uint64) (arr []T) {
+	arr = make([]T, 0, len(a))
+	for _, e := range a {
+		val2, _ := anyToInt64(e)
+		if val2 < 0 {
+			val2 = 0
+		}
+		if uint64(val2) > max {
+			arr = append(arr, T(max))
+		} else {
+			arr = append(arr, T(val2))
+		}
+	}
+	return
+}
+
+func mapFloatArray[T constraints.Float](a []interface{}, max float64) (arr []T) {
+	arr = make([]T, 0, len(a))
+	for _, e := range a {
+		val2, _ := anyToFloat64(e)
+		if val2 > max {
+			val2 = max
+		}
+		arr = append(arr, T(val2))
+	}
+	return
+}
@@ -0,0 +1,522 @@
+package parser
+
+import (
+	"bytes"
+	"math"
+	"regexp"
+	"strconv"
+
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	OtlpLogs    = "otlp_logs"
+	OtlpMetrics = "otlp_metrics"
+
+	otlpNameKey = "__name__"
+	// a field of ExportMetricsServiceRequest OTLP doesn't define, which its unmarshalers skip
+	otlpSampleField protowire.Number = protowire.MaxValidNumber
+)
+
+var (
+	_ Splitter = (*OtlpLogsParser)(nil)
+	_ Splitter = (*OtlpMetricsParser)(nil)
+
+	otlpInvalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+	otlpSampleTag         = protowire.AppendTag(nil, otlpSampleField, protowire.VarintType)
+)
+
+// Splitter is implemented by parsers whose messages carry many records, such as OTLP export requests. Parse of
+// such a parser only accepts messages which carry exactly one record, so the consumer splits the others first and
+// puts each part to the task.
+type Splitter interface {
+	Split(bs []byte) (msgs [][]byte, err error)
+}
+
+// NewSplitter returns the Splitter of the named parser, or nil if its messages carry one record each.
+func NewSplitter(name string) Splitter {
+	switch name {
+	case OtlpLogs:
+		return &OtlpLogsParser{}
+	case OtlpMetrics:
+		return &OtlpMetricsParser{}
+	}
+	return nil
+}
+
+// otlpSample is a Prometheus style sample of OTLP metrics.
+type otlpSample struct {
+	name   string
+	ts     pcommon.Timestamp
+	value  float64
+	labels map[string]interface{}
+}
+
+// OtlpLogsParser parses ExportLogsServiceRequest messages, in either the otlp_proto or the otlp_json encoding of
+// the OpenTelemetry Kafka exporter. Each log record becomes one metric with the fields timestamp,
+// observed_timestamp, severity_number, severity_text, body, trace_id, span_id, trace_flags, service_name,
+// scope_name, scope_version, resource_attributes, scope_attributes and log_attributes. The attributes are maps.
+type OtlpLogsParser struct {
+	pp *Pool
+}
+
+// OtlpMetricsParser parses ExportMetricsServiceRequest messages into Prometheus style samples, which fit the
+// metric and series tables of PrometheusSchema. Each sample has the fields __name__, timestamp and value, plus one
+// string field per resource and data point attribute, named like Prometheus labels. Histograms and summaries are
+// expanded to their _bucket (with le), _sum and _count, or quantile, _sum and _count series. Exponential
+// histograms only yield _sum and _count.
+type OtlpMetricsParser struct {
+	pp *Pool
+}
+
+// isOtlpJSON tells the otlp_json from the otlp_proto encoding. The first byte of a protobuf export request is the
+// tag of field 1, which is never '{'.
+func isOtlpJSON(bs []byte) bool {
+	bs = bytes.TrimLeft(bs, " \t\r\n")
+	return len(bs) != 0 && bs[0] == '{'
+}
+
+func parseSingle(metrics []model.Metric, err error) (model.Metric, error) {
+	if err != nil {
+		return nil, err
+	}
+	if len(metrics) != 1 {
+		return nil, errors.Newf("OTLP message carries %d records, expected 1", len(metrics))
+	}
+	return metrics[0], nil
+}
+
+func (p *OtlpLogsParser) Parse(bs []byte) (metric model.Metric, err error) {
+	return parseSingle(p.parseBatch(bs))
+}
+
+// Split cuts a message into one export request per log record, in the otlp_proto encoding.
+func (p *OtlpLogsParser) Split(bs []byte) (msgs [][]byte, err error) {
+	var logs plog.Logs
+	if logs, err = unmarshalOtlpLogs(bs); err != nil {
+		return
+	}
+	if logs.LogRecordCount() <= 1 {
+		return [][]byte{bs}, nil
+	}
+	msgs = make([][]byte, 0, logs.LogRecordCount())
+	var marshaler plog.ProtoMarshaler
+	rls := logs.ResourceLogs()
+	for i := 0; i < rls.Len(); i++ {
+		rl := rls.At(i)
+		sls := rl.ScopeLogs()
+		for j := 0; j < sls.Len(); j++ {
+			sl := sls.At(j)
+			lrs := sl.LogRecords()
+			for k := 0; k < lrs.Len(); k++ {
+				part := plog.NewLogs()
+				prl := part.ResourceLogs().AppendEmpty()
+				rl.Resource().CopyTo(prl.Resource())
+				prl.SetSchemaUrl(rl.SchemaUrl())
+				psl := prl.ScopeLogs().AppendEmpty()
+				sl.Scope().CopyTo(psl.Scope())
+				psl.SetSchemaUrl(sl.SchemaUrl())
+				lrs.At(k).CopyTo(psl.LogRecords().AppendEmpty())
+				var msg []byte
+				if msg, err = marshaler.MarshalLogs(part); err != nil {
+					err = errors.Wrapf(err, "failed to marshal OTLP logs")
+					return
+				}
+				msgs = append(msgs, msg)
+			}
+		}
+	}
+	return
+}
+
+func unmarshalOtlpLogs(bs []byte) (logs plog.Logs, err error) {
+	if isOtlpJSON(bs) {
+		logs, err = (&plog.JSONUnmarshaler{}).UnmarshalLogs(bs)
+	} else {
+		logs, err = (&plog.ProtoUnmarshaler{}).UnmarshalLogs(bs)
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "failed to unmarshal OTLP logs")
+	}
+	return
+}
+
+func (p *OtlpLogsParser) parseBatch(bs []byte) (metrics []model.Metric, err error) {
+	var logs plog.Logs
+	if logs, err = unmarshalOtlpLogs(bs); err != nil {
+		return
+	}
+	metrics = make([]model.Metric, 0, logs.LogRecordCount())
+	rls := logs.ResourceLogs()
+	for i := 0; i < rls.Len(); i++ {
+		rl := rls.At(i)
+		resAttrs := otlpAttributes(rl.Resource().Attributes())
+		serviceName, _ := resAttrs["service.name"].(string)
+		sls := rl.ScopeLogs()
+		for j := 0; j < sls.Len(); j++ {
+			sl := sls.At(j)
+			scope := sl.Scope()
+			scopeAttrs := otlpAttributes(scope.Attributes())
+			lrs := sl.LogRecords()
+			for k := 0; k < lrs.Len(); k++ {
+				lr := lrs.At(k)
+				ts := lr.Timestamp()
+				if ts == 0 {
+					ts = lr.ObservedTimestamp()
+				}
+				fields := map[string]interface{}{
+					"timestamp":           ts.AsTime(),
+					"observed_timestamp":  lr.ObservedTimestamp().AsTime(),
+					"severity_number":     int64(lr.SeverityNumber()),
+					"severity_text":       lr.SeverityText(),
+					"body":                lr.Body().AsString(),
+					"trace_flags":         int64(lr.Flags()),
+					"service_name":        serviceName,
+					"scope_name":          scope.Name(),
+					"scope_version":       scope.Version(),
+					"resource_attributes": resAttrs,
+					"scope_attributes":    scopeAttrs,
+					"log_attributes":      otlpAttributes(lr.Attributes()),
+				}
+				if tid := lr.TraceID(); !tid.IsEmpty() {
+					fields["trace_id"] = tid.String()
+				}
+				if sid := lr.SpanID(); !sid.IsEmpty() {
+					fields["span_id"] = sid.String()
+				}
+				metrics = append(metrics, &MapMetric{pp: p.pp, fields: fields})
+			}
+		}
+	}
+	return
+}
+
+func (p *OtlpMetricsParser) Parse(bs []byte) (metric model.Metric, err error) {
+	var samples []otlpSample
+	if samples, err = otlpSamples(bs); err != nil {
+		return
+	}
+	if idx, ok := otlpSampleIndex(bs); ok {
+		if idx >= uint64(len(samples)) {
+			return nil, errors.Newf("OTLP message carries %d samples, sample %d requested", len(samples), idx)
+		}
+		samples = samples[idx : idx+1]
+	}
+	metrics := make([]model.Metric, len(samples))
+	for i, s := range samples {
+		fields := s.labels
+		fields[otlpNameKey] = s.name
+		fields["timestamp"] = s.ts.AsTime()
+		fields["value"] = s.value
+		metrics[i] = &MapMetric{pp: p.pp, fields: fields}
+	}
+	return parseSingle(metrics, nil)
+}
+
+// Split cuts a message into one export request per data point, in the otlp_proto encoding. Each part keeps the
+// resource, scope and metric of its data point, with the type, temporality and monotonicity. A data point which
+// expands to several samples, such as a histogram, yields a part per sample, each with the index of its sample
+// appended in otlpSampleField.
+func (p *OtlpMetricsParser) Split(bs []byte) (msgs [][]byte, err error) {
+	var md pmetric.Metrics
+	if md, err = unmarshalOtlpMetrics(bs); err != nil {
+		return
+	}
+	var marshaler pmetric.ProtoMarshaler
+	rms := md.ResourceMetrics()
+	for i := 0; i < rms.Len(); i++ {
+		rm := rms.At(i)
+		sms := rm.ScopeMetrics()
+		for j := 0; j < sms.Len(); j++ {
+			sm := sms.At(j)
+			ms := sm.Metrics()
+			for k := 0; k < ms.Len(); k++ {
+				m := ms.At(k)
+				for d := 0; d < otlpNumDataPoints(m); d++ {
+					part := pmetric.NewMetrics()
+					prm := part.ResourceMetrics().AppendEmpty()
+					rm.Resource().CopyTo(prm.Resource())
+					prm.SetSchemaUrl(rm.SchemaUrl())
+					psm := prm.ScopeMetrics().AppendEmpty()
+					sm.Scope().CopyTo(psm.Scope())
+					psm.SetSchemaUrl(sm.SchemaUrl())
+					numSamples := otlpCopyDataPoint(m, d, psm.Metrics().AppendEmpty())
+					if numSamples == 0 {
+						continue
+					}
+					var msg []byte
+					if msg, err = marshaler.MarshalMetrics(part); err != nil {
+						err = errors.Wrapf(err, "failed to marshal OTLP metrics")
+						return
+					}
+					if numSamples == 1 {
+						msgs = append(msgs, msg)
+						continue
+					}
+					for s := 0; s < numSamples; s++ {
+						indexed := append(msg[:len(msg):len(msg)], otlpSampleTag...)
+						msgs = append(msgs, protowire.AppendVarint(indexed, uint64(s)))
+					}
+				}
+			}
+		}
+	}
+	if len(msgs) <= 1 {
+		return [][]byte{bs}, nil
+	}
+	return
+}
+
+// otlpSampleIndex returns the index of the sample a part of Split stands for.
+func otlpSampleIndex(bs []byte) (idx uint64, ok bool) {
+	if isOtlpJSON(bs) {
+		return
+	}
+	for len(bs) != 0 {
+		num, typ, n := protowire.ConsumeTag(bs)
+		if n < 0 {
+			return
+		}
+		bs = bs[n:]
+		if num == otlpSampleField && typ == protowire.VarintType {
+			idx, n = protowire.ConsumeVarint(bs)
+			return idx, n >= 0
+		}
+		if n = protowire.ConsumeFieldValue(num, typ, bs); n < 0 {
+			return
+		}
+		bs = bs[n:]
+	}
+	return
+}
+
+func otlpNumDataPoints(m pmetric.Metric) int {
+	switch m.Type() {
+	case pmetric.MetricTypeGauge:
+		return m.Gauge().DataPoints().Len()
+	case pmetric.MetricTypeSum:
+		return m.Sum().DataPoints().Len()
+	case pmetric.MetricTypeHistogram:
+		return m.Histogram().DataPoints().Len()
+	case pmetric.MetricTypeExponentialHistogram:
+		return m.ExponentialHistogram().DataPoints().Len()
+	case pmetric.MetricTypeSummary:
+		return m.Summary().DataPoints().Len()
+	}
+	return 0
+}
+
+// otlpCopyDataPoint copies a metric with only its data point d to dest, and returns the number of samples the data
+// point expands to, see appendOtlpSamples.
+func otlpCopyDataPoint(m pmetric.Metric, d int, dest pmetric.Metric) int {
+	dest.SetName(m.Name())
+	dest.SetDescription(m.Description())
+	dest.SetUnit(m.Unit())
+	switch m.Type() {
+	case pmetric.MetricTypeGauge:
+		m.Gauge().DataPoints().At(d).CopyTo(dest.SetEmptyGauge().DataPoints().AppendEmpty())
+		return 1
+	case pmetric.MetricTypeSum:
+		sum := dest.SetEmptySum()
+		sum.SetAggregationTemporality(m.Sum().AggregationTemporality())
+		sum.SetIsMonotonic(m.Sum().IsMonotonic())
+		m.Sum().DataPoints().At(d).CopyTo(sum.DataPoints().AppendEmpty())
+		return 1
+	case pmetric.MetricTypeHistogram:
+		hist := dest.SetEmptyHistogram()
+		hist.SetAggregationTemporality(m.Histogram().AggregationTemporality())
+		dp := m.Histogram().DataPoints().At(d)
+		dp.CopyTo(hist.DataPoints().AppendEmpty())
+		n := dp.BucketCounts().Len() + 1
+		if dp.HasSum() {
+			n++
+		}
+		return n
+	case pmetric.MetricTypeExponentialHistogram:
+		hist := dest.SetEmptyExponentialHistogram()
+		hist.SetAggregationTemporality(m.ExponentialHistogram().AggregationTemporality())
+		dp := m.ExponentialHistogram().DataPoints().At(d)
+		dp.CopyTo(hist.DataPoints().AppendEmpty())
+		if dp.HasSum() {
+			return 2
+		}
+		return 1
+	case pmetric.MetricTypeSummary:
+		dp := m.Summary().DataPoints().At(d)
+		dp.CopyTo(dest.SetEmptySummary().DataPoints().AppendEmpty())
+		return dp.QuantileValues().Len() + 2
+	}
+	return 0
+}
+
+func unmarshalOtlpMetrics(bs []byte) (md pmetric.Metrics, err error) {
+	if isOtlpJSON(bs) {
+		md, err = (&pmetric.JSONUnmarshaler{}).UnmarshalMetrics(bs)
+	} else {
+		md, err = (&pmetric.ProtoUnmarshaler{}).UnmarshalMetrics(bs)
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "failed to unmarshal OTLP metrics")
+	}
+	return
+}
+
+func otlpSamples(bs []byte) (samples []otlpSample, err error) {
+	var md pmetric.Metrics
+	if md, err = unmarshalOtlpMetrics(bs); err != nil {
+		return
+	}
+	samples = make([]otlpSample, 0, md.DataPointCount())
+	rms := md.ResourceMetrics()
+	for i := 0; i < rms.Len(); i++ {
+		rm := rms.At(i)
+		resLabels := otlpLabels(nil, rm.Resource().Attributes())
+		sms := rm.ScopeMetrics()
+		for j := 0; j < sms.Len(); j++ {
+			ms := sms.At(j).Metrics()
+			for k := 0; k < ms.Len(); k++ {
+				samples = appendOtlpSamples(samples, ms.At(k), resLabels)
+			}
+		}
+	}
+	return
+}
+
+func appendOtlpSamples(samples []otlpSample, m pmetric.Metric, resLabels map[string]interface{}) []otlpSample {
+	name := otlpLabelName(m.Name())
+	sample := func(name string, ts pcommon.Timestamp, value float64, attrs pcommon.Map, extra ...string) {
+		labels := otlpLabels(resLabels, attrs)
+		for i := 0; i+1 < len(extra); i += 2 {
+			labels[extra[i]] = extra[i+1]
+		}
+		samples = append(samples, otlpSample{name: name, ts: ts, value: value, labels: labels})
+	}
+	switch m.Type() {
+	case pmetric.MetricTypeGauge:
+		dps := m.Gauge().DataPoints()
+		for i := 0; i < dps.Len(); i++ {
+			dp := dps.At(i)
+			sample(name, dp.Timestamp(), otlpNumber(dp), dp.Attributes())
+		}
+	case pmetric.MetricTypeSum:
+		dps := m.Sum().DataPoints()
+		for i := 0; i < dps.Len(); i++ {
+			dp := dps.At(i)
+			sample(name, dp.Timestamp(), otlpNumber(dp), dp.Attributes())
+		}
+	case pmetric.MetricTypeHistogram:
+		dps := m.Histogram().DataPoints()
+		for i := 0; i < dps.Len(); i++ {
+			dp := dps.At(i)
+			var cumulative uint64
+			bounds := dp.ExplicitBounds()
+			counts := dp.BucketCounts()
+			for b := 0; b < counts.Len(); b++ {
+				cumulative += counts.At(b)
+				le := "+Inf"
+				if b < bounds.Len() {
+					le = strconv.FormatFloat(bounds.At(b), 'g', -1, 64)
+				}
+				sample(name+"_bucket", dp.Timestamp(), float64(cumulative), dp.Attributes(), "le", le)
+			}
+			if dp.HasSum() {
+				sample(name+"_sum", dp.Timestamp(), dp.Sum(), dp.Attributes())
+			}
+			sample(name+"_count", dp.Timestamp(), float64(dp.Count()), dp.Attributes())
+		}
+	case pmetric.MetricTypeExponentialHistogram:
+		dps := m.ExponentialHistogram().DataPoints()
+		for i := 0; i < dps.Len(); i++ {
+			dp := dps.At(i)
+			if dp.HasSum() {
+				sample(name+"_sum", dp.Timestamp(), dp.Sum(), dp.Attributes())
+			}
+			sample(name+"_count", dp.Timestamp(), float64(dp.Count()), dp.Attributes())
+		}
+	case pmetric.MetricTypeSummary:
+		dps := m.Summary().DataPoints()
+		for i := 0; i < dps.Len(); i++ {
+			dp := dps.At(i)
+			qvs := dp.QuantileValues()
+			for q := 0; q < qvs.Len(); q++ {
+				qv := qvs.At(q)
+				sample(name, dp.Timestamp(), qv.Value(), dp.Attributes(), "quantile", strconv.FormatFloat(qv.Quantile(), 'g', -1, 64))
+			}
+			sample(name+"_sum", dp.Timestamp(), dp.Sum(), dp.Attributes())
+			sample(name+"_count", dp.Timestamp(), float64(dp.Count()), dp.Attributes())
+		}
+	}
+	return samples
+}
+
+func otlpNumber(dp pmetric.NumberDataPoint) float64 {
+	switch dp.ValueType() {
+	case pmetric.NumberDataPointValueTypeInt:
+		return float64(dp.IntValue())
+	case pmetric.NumberDataPointValueTypeDouble:
+		return dp.DoubleValue()
+	}
+	return math.NaN()
+}
+
+// otlpAttributes converts attributes to the value types of MapMetric. Nested values are kept as maps and slices,
+// which MapMetric stores as JSON text.
+func otlpAttributes(attrs pcommon.Map) map[string]interface{} {
+	fields := make(map[string]interface{}, attrs.Len())
+	attrs.Range(func(k string, v pcommon.Value) bool {
+		fields[k] = otlpValue(v)
+		return true
+	})
+	return fields
+}
+
+func otlpValue(v pcommon.Value) interface{} {
+	switch v.Type() {
+	case pcommon.ValueTypeStr:
+		return v.Str()
+	case pcommon.ValueTypeInt:
+		return v.Int()
+	case pcommon.ValueTypeDouble:
+		return v.Double()
+	case pcommon.ValueTypeBool:
+		return v.Bool()
+	case pcommon.ValueTypeMap:
+		return otlpAttributes(v.Map())
+	case pcommon.ValueTypeSlice:
+		s := v.Slice()
+		arr := make([]interface{}, s.Len())
+		for i := range arr {
+			arr[i] = otlpValue(s.At(i))
+		}
+		return arr
+	case pcommon.ValueTypeBytes:
+		return v.AsString()
+	}
+	return nil
+}
+
+// otlpLabels merges attributes into a copy of base, with label names and values as Prometheus would have them.
+func otlpLabels(base map[string]interface{}, attrs pcommon.Map) map[string]interface{} {
+	labels := make(map[string]interface{}, len(base)+attrs.Len()+3)
+	for k, v := range base {
+		labels[k] = v
+	}
+	attrs.Range(func(k string, v pcommon.Value) bool {
+		labels[otlpLabelName(k)] = v.AsString()
+		return true
+	})
+	return labels
+}
+
+func otlpLabelName(name string) string {
+	name = otlpInvalidLabelChars.ReplaceAllString(name, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
@@ -0,0 +1,282 @@
+package parser
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var otlpTestTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func otlpTestLogs(bodies ...string) plog.Logs {
+	logs := plog.NewLogs()
+	rl := logs.ResourceLogs().AppendEmpty()
+	rl.Resource().Attributes().PutStr("service.name", "checkout")
+	sl := rl.ScopeLogs().AppendEmpty()
+	sl.Scope().SetName("app")
+	sl.Scope().SetVersion("1.2")
+	for i, body := range bodies {
+		lr := sl.LogRecords().AppendEmpty()
+		lr.SetTimestamp(pcommon.NewTimestampFromTime(otlpTestTime.Add(time.Duration(i) * time.Second)))
+		lr.SetSeverityNumber(plog.SeverityNumberWarn)
+		lr.SetSeverityText("WARN")
+		lr.Body().SetStr(body)
+	}
+	return logs
+}
+
+func otlpTestMarshal(t *testing.T, v interface{}, json bool) []byte {
+	t.Helper()
+	var bs []byte
+	var err error
+	switch v := v.(type) {
+	case plog.Logs:
+		if json {
+			bs, err = (&plog.JSONMarshaler{}).MarshalLogs(v)
+		} else {
+			bs, err = (&plog.ProtoMarshaler{}).MarshalLogs(v)
+		}
+	case pmetric.Metrics:
+		if json {
+			bs, err = (&pmetric.JSONMarshaler{}).MarshalMetrics(v)
+		} else {
+			bs, err = (&pmetric.ProtoMarshaler{}).MarshalMetrics(v)
+		}
+	}
+	require.NoError(t, err)
+	return bs
+}
+
+func TestOtlpLogsParser(t *testing.T) {
+	pp, err := NewParserPool(OtlpLogs, nil, "", "UTC", 0, "")
+	require.NoError(t, err)
+	logs := otlpTestLogs("payment failed")
+	lr := logs.ResourceLogs().At(0).ScopeLogs().At(0).LogRecords().At(0)
+	lr.SetTraceID(pcommon.TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	lr.SetFlags(plog.DefaultLogRecordFlags.WithIsSampled(true))
+	lr.Attributes().PutInt("attempt", 3)
+	lr.Attributes().PutEmptyMap("order").PutStr("id", "o-1")
+	want := map[string]interface{}{
+		"timestamp":           otlpTestTime,
+		"observed_timestamp":  time.Unix(0, 0).UTC(),
+		"severity_number":     int64(plog.SeverityNumberWarn),
+		"severity_text":       "WARN",
+		"body":                "payment failed",
+		"trace_id":            "0102030405060708090a0b0c0d0e0f10",
+		"trace_flags":         int64(1),
+		"service_name":        "checkout",
+		"scope_name":          "app",
+		"scope_version":       "1.2",
+		"resource_attributes": map[string]interface{}{"service.name": "checkout"},
+		"scope_attributes":    map[string]interface{}{},
+		"log_attributes":      map[string]interface{}{"attempt": int64(3), "order": map[string]interface{}{"id": "o-1"}},
+	}
+	for _, json := range []bool{false, true} {
+		t.Run(fmt.Sprintf("json=%v", json), func(t *testing.T) {
+			fields, err := parseFields(t, pp, string(otlpTestMarshal(t, logs, json)))
+			require.NoError(t, err)
+			assert.Equal(t, want, fields)
+		})
+	}
+
+	t.Run("many records", func(t *testing.T) {
+		_, err := parseFields(t, pp, string(otlpTestMarshal(t, otlpTestLogs("a", "b"), false)))
+		assert.Error(t, err)
+	})
+	t.Run("invalid message", func(t *testing.T) {
+		_, err := parseFields(t, pp, "\xff\xff")
+		assert.Error(t, err)
+	})
+}
+
+func TestOtlpLogsSplit(t *testing.T) {
+	pp, err := NewParserPool(OtlpLogs, nil, "", "UTC", 0, "")
+	require.NoError(t, err)
+	splitter := NewSplitter(OtlpLogs)
+	require.NotNil(t, splitter)
+	for _, json := range []bool{false, true} {
+		t.Run(fmt.Sprintf("json=%v", json), func(t *testing.T) {
+			msgs, err := splitter.Split(otlpTestMarshal(t, otlpTestLogs("a", "b", "c"), json))
+			require.NoError(t, err)
+			require.Len(t, msgs, 3)
+			for i, msg := range msgs {
+				fields, err := parseFields(t, pp, string(msg))
+				require.NoError(t, err)
+				assert.Equal(t, []string{"a", "b", "c"}[i], fields["body"])
+				assert.Equal(t, otlpTestTime.Add(time.Duration(i)*time.Second), fields["timestamp"])
+				assert.Equal(t, "checkout", fields["service_name"])
+				assert.Equal(t, "1.2", fields["scope_version"])
+			}
+		})
+	}
+
+	t.Run("single record", func(t *testing.T) {
+		msg := otlpTestMarshal(t, otlpTestLogs("a"), true)
+		msgs, err := splitter.Split(msg)
+		require.NoError(t, err)
+		assert.Equal(t, [][]byte{msg}, msgs)
+	})
+	t.Run("invalid message", func(t *testing.T) {
+		_, err := splitter.Split([]byte("{"))
+		assert.Error(t, err)
+	})
+}
+
+// otlpTestMetrics returns one metric of each type. Its data points expand to 13 samples.
+func otlpTestMetrics() pmetric.Metrics {
+	md := pmetric.NewMetrics()
+	rm := md.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("service.name", "checkout")
+	ms := rm.ScopeMetrics().AppendEmpty().Metrics()
+	ts := pcommon.NewTimestampFromTime(otlpTestTime)
+
+	gauge := ms.AppendEmpty()
+	gauge.SetName("queue.size")
+	gdps := gauge.SetEmptyGauge().DataPoints()
+	for i, method := range []string{"GET", "POST"} {
+		dp := gdps.AppendEmpty()
+		dp.SetTimestamp(ts)
+		dp.SetDoubleValue(float64(i + 1))
+		dp.Attributes().PutStr("http.method", method)
+	}
+
+	sum := ms.AppendEmpty()
+	sum.SetName("requests")
+	sum.SetEmptySum().SetIsMonotonic(true)
+	sdp := sum.Sum().DataPoints().AppendEmpty()
+	sdp.SetTimestamp(ts)
+	sdp.SetIntValue(5)
+
+	hist := ms.AppendEmpty()
+	hist.SetName("latency")
+	hdp := hist.SetEmptyHistogram().DataPoints().AppendEmpty()
+	hdp.SetTimestamp(ts)
+	hdp.ExplicitBounds().FromRaw([]float64{1, 5})
+	hdp.BucketCounts().FromRaw([]uint64{1, 2, 3})
+	hdp.SetSum(10)
+	hdp.SetCount(6)
+
+	summary := ms.AppendEmpty()
+	summary.SetName("size")
+	qdp := summary.SetEmptySummary().DataPoints().AppendEmpty()
+	qdp.SetTimestamp(ts)
+	for _, q := range [][2]float64{{0.5, 3}, {0.9, 7}} {
+		qv := qdp.QuantileValues().AppendEmpty()
+		qv.SetQuantile(q[0])
+		qv.SetValue(q[1])
+	}
+	qdp.SetSum(20)
+	qdp.SetCount(4)
+
+	exp := ms.AppendEmpty()
+	exp.SetName("wait")
+	edp := exp.SetEmptyExponentialHistogram().DataPoints().AppendEmpty()
+	edp.SetTimestamp(ts)
+	edp.SetCount(3)
+	return md
+}
+
+func TestOtlpMetricsParser(t *testing.T) {
+	pp, err := NewParserPool(OtlpMetrics, nil, "", "UTC", 0, "")
+	require.NoError(t, err)
+	md := pmetric.NewMetrics()
+	rm := md.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("service.name", "checkout")
+	m := rm.ScopeMetrics().AppendEmpty().Metrics().AppendEmpty()
+	m.SetName("http.requests-total")
+	dp := m.SetEmptySum().DataPoints().AppendEmpty()
+	dp.SetTimestamp(pcommon.NewTimestampFromTime(otlpTestTime))
+	dp.SetIntValue(42)
+	dp.Attributes().PutStr("http.method", "GET")
+	dp.Attributes().PutInt("2xx", 1)
+	want := map[string]interface{}{
+		"__name__":     "http_requests_total",
+		"timestamp":    otlpTestTime,
+		"value":        42.0,
+		"service_name": "checkout",
+		"http_method":  "GET",
+		"_2xx":         "1",
+	}
+	for _, json := range []bool{false, true} {
+		t.Run(fmt.Sprintf("json=%v", json), func(t *testing.T) {
+			fields, err := parseFields(t, pp, string(otlpTestMarshal(t, md, json)))
+			require.NoError(t, err)
+			assert.Equal(t, want, fields)
+		})
+	}
+
+	t.Run("many samples", func(t *testing.T) {
+		_, err := parseFields(t, pp, string(otlpTestMarshal(t, otlpTestMetrics(), false)))
+		assert.Error(t, err)
+	})
+	t.Run("sample index out of range", func(t *testing.T) {
+		msg := append(otlpTestMarshal(t, md, false), otlpSampleTag...)
+		_, err := parseFields(t, pp, string(protowire.AppendVarint(msg, 1)))
+		assert.Error(t, err)
+	})
+	t.Run("invalid message", func(t *testing.T) {
+		_, err := parseFields(t, pp, "{")
+		assert.Error(t, err)
+	})
+}
+
+func TestOtlpMetricsSplit(t *testing.T) {
+	pp, err := NewParserPool(OtlpMetrics, nil, "", "UTC", 0, "")
+	require.NoError(t, err)
+	splitter := NewSplitter(OtlpMetrics)
+	require.NotNil(t, splitter)
+	want := []string{
+		"queue_size{http_method=GET} 1",
+		"queue_size{http_method=POST} 2",
+		"requests{} 5",
+		"latency_bucket{le=1} 1",
+		"latency_bucket{le=5} 3",
+		"latency_bucket{le=+Inf} 6",
+		"latency_sum{} 10",
+		"latency_count{} 6",
+		"size{quantile=0.5} 3",
+		"size{quantile=0.9} 7",
+		"size_sum{} 20",
+		"size_count{} 4",
+		"wait_count{} 3",
+	}
+	for _, json := range []bool{false, true} {
+		t.Run(fmt.Sprintf("json=%v", json), func(t *testing.T) {
+			msgs, err := splitter.Split(otlpTestMarshal(t, otlpTestMetrics(), json))
+			require.NoError(t, err)
+			got := make([]string, len(msgs))
+			for i, msg := range msgs {
+				fields, err := parseFields(t, pp, string(msg))
+				require.NoError(t, err)
+				assert.Equal(t, otlpTestTime, fields["timestamp"])
+				assert.Equal(t, "checkout", fields["service_name"])
+				var label string
+				for _, k := range []string{"http_method", "le", "quantile"} {
+					if v, ok := fields[k]; ok {
+						label = fmt.Sprintf("%s=%v", k, v)
+					}
+				}
+				got[i] = fmt.Sprintf("%v{%s} %v", fields["__name__"], label, fields["value"])
+			}
+			assert.Equal(t, want, got)
+		})
+	}
+
+	t.Run("single sample", func(t *testing.T) {
+		md := pmetric.NewMetrics()
+		m := md.ResourceMetrics().AppendEmpty().ScopeMetrics().AppendEmpty().Metrics().AppendEmpty()
+		m.SetName("up")
+		m.SetEmptyGauge().DataPoints().AppendEmpty().SetIntValue(1)
+		msg := otlpTestMarshal(t, md, false)
+		msgs, err := splitter.Split(msg)
+		require.NoError(t, err)
+		assert.Equal(t, [][]byte{msg}, msgs)
+	})
+}
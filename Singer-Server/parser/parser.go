@@ -3,8 +3,10 @@ package parser
 import (
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/housepower/clickhouse_sinker/config"
 	"github.com/housepower/clickhouse_sinker/model"
 	"github.com/housepower/clickhouse_sinker/util"
 	"github.com/thanos-io/thanos/pkg/errors"
@@ -34,6 +36,9 @@ type Parser interface {
 	Parse(bs []byte) (metric model.Metric, err error)
 }
 
+// RejectFunc is told about every message ParseMessage fails to parse.
+type RejectFunc func(msg *model.InputMessage, err error)
+
 type Pool struct {
 	name         string
 	csvFormat    map[string]int
@@ -44,9 +49,42 @@ type Pool struct {
 	pool         sync.Pool
 	once         sync.Once
 	fields       string
+	logFormat    string
+	accessFormat *logFormat
+	grokCfg      grokSettings
+	grok         *grok
+	onReject     atomic.Pointer[RejectFunc]
+}
+
+// Option sets parser specific settings of a Pool.
+type Option func(pp *Pool)
+
+// WithLogFormat sets the format of the apachelog parser, either "common", "combined", "error" or a LogFormat string.
+func WithLogFormat(format string) Option {
+	return func(pp *Pool) {
+		pp.logFormat = format
+	}
+}
+
+// WithGrok sets the match expressions, user defined patterns and fallback field of the grok parser.
+func WithGrok(patterns []string, definitions map[string]string, fallbackField string) Option {
+	return func(pp *Pool) {
+		pp.grokCfg = grokSettings{patterns: patterns, definitions: definitions, fallback: fallbackField}
+	}
+}
+
+// TaskOptions returns the parser specific settings of a task, which its pool is created with.
+func TaskOptions(taskCfg *config.TaskConfig) (opts []Option) {
+	if taskCfg.LogFormat != "" {
+		opts = append(opts, WithLogFormat(taskCfg.LogFormat))
+	}
+	if taskCfg.Grok != nil {
+		opts = append(opts, WithGrok(taskCfg.Grok.Patterns, taskCfg.Grok.Definitions, taskCfg.Grok.FallbackField))
+	}
+	return
 }
 
-func NewParserPool(name string, csvFormat []string, delimiter string, timezone string, timeunit float64, fields string) (pp *Pool, err error) {
+func NewParserPool(name string, csvFormat []string, delimiter string, timezone string, timeunit float64, fields string, opts ...Option) (pp *Pool, err error) {
 	var tz *time.Location
 	if timezone == "" {
 		tz = time.Local
@@ -67,6 +105,35 @@ func NewParserPool(name string, csvFormat []string, delimiter string, timezone s
 			pp.csvFormat[title] = i
 		}
 	}
+	for _, opt := range opts {
+		opt(pp)
+	}
+	if name == "apachelog" {
+		if pp.accessFormat, err = compileLogFormat(pp.logFormat); err != nil {
+			return
+		}
+	}
+	if name == "grok" {
+		if pp.grok, err = compileGrok(pp.grokCfg.patterns, pp.grokCfg.definitions, pp.grokCfg.fallback); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// SetRejectFunc sets the function which is told about the messages ParseMessage fails to parse.
+func (pp *Pool) SetRejectFunc(fn RejectFunc) {
+	pp.onReject.Store(&fn)
+}
+
+// ParseMessage parses the value of a message with a parser of the pool, and tells the RejectFunc of the pool about
+// the message if it fails.
+func (pp *Pool) ParseMessage(p Parser, msg *model.InputMessage) (metric model.Metric, err error) {
+	if metric, err = p.Parse(msg.Value); err != nil {
+		if fn := pp.onReject.Load(); fn != nil {
+			(*fn)(msg, err)
+		}
+	}
 	return
 }
 
@@ -81,6 +148,36 @@ func (pp *Pool) Get() (Parser, error) {
 				util.Logger.Warn("extra fields for csv parser is not supported, fields ignored")
 			}
 			return &CsvParser{pp: pp}, nil
+		case "syslog":
+			if pp.fields != "" {
+				util.Logger.Warn("extra fields for syslog parser is not supported, fields ignored")
+			}
+			return &SyslogParser{pp: pp}, nil
+		case "apachelog":
+			if pp.fields != "" {
+				util.Logger.Warn("extra fields for apachelog parser is not supported, fields ignored")
+			}
+			return &ApacheLogParser{pp: pp, format: pp.accessFormat}, nil
+		case "grok":
+			if pp.fields != "" {
+				util.Logger.Warn("extra fields for grok parser is not supported, fields ignored")
+			}
+			return &GrokParser{pp: pp}, nil
+		case "logfmt":
+			if pp.fields != "" {
+				util.Logger.Warn("extra fields for logfmt parser is not supported, fields ignored")
+			}
+			return &LogfmtParser{pp: pp}, nil
+		case OtlpLogs:
+			if pp.fields != "" {
+				util.Logger.Warn("extra fields for otlp_logs parser is not supported, fields ignored")
+			}
+			return &OtlpLogsParser{pp: pp}, nil
+		case OtlpMetrics:
+			if pp.fields != "" {
+				util.Logger.Warn("extra fields for otlp_metrics parser is not supported, fields ignored")
+			}
+			return &OtlpMetricsParser{pp: pp}, nil
 		case "fastjson":
 			fallthrough
 		default:
@@ -0,0 +1,217 @@
+package parser
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/thanos-io/thanos/pkg/errors"
+)
+
+const (
+	syslogNilValue = "-"
+	syslogBOM      = "\xEF\xBB\xBF"
+)
+
+var _ Parser = (*SyslogParser)(nil)
+
+// SyslogParser parses raw RFC 5424 and RFC 3164 (BSD) syslog lines into the fields facility, severity, version,
+// timestamp, hostname, app_name, procid, msgid, structured_data and message. Parameters of the structured data
+// are flattened to "SD-ID.PARAM-NAME" keys. Fields which are absent or NILVALUE are left out of the metric.
+type SyslogParser struct {
+	pp *Pool
+}
+
+func (p *SyslogParser) Parse(bs []byte) (metric model.Metric, err error) {
+	line := strings.TrimRight(string(bs), "\r\n")
+	fields := make(map[string]interface{}, 10)
+	var pri int
+	if pri, line, err = parsePRI(line); err != nil {
+		return
+	}
+	fields["facility"] = int64(pri / 8)
+	fields["severity"] = int64(pri % 8)
+	if len(line) > 1 && line[0] >= '1' && line[0] <= '9' && line[1] == ' ' {
+		err = p.parseRFC5424(line, fields)
+	} else {
+		err = p.parseRFC3164(line, fields)
+	}
+	if err != nil {
+		return
+	}
+	metric = &MapMetric{pp: p.pp, fields: fields}
+	return
+}
+
+func parsePRI(line string) (pri int, rest string, err error) {
+	end := strings.IndexByte(line, '>')
+	if len(line) < 3 || line[0] != '<' || end < 2 || end > 4 {
+		err = errors.Newf("syslog message has no PRI part")
+		return
+	}
+	if pri, err = strconv.Atoi(line[1:end]); err != nil || pri < 0 || pri > 191 {
+		err = errors.Newf("invalid syslog PRI %q", line[1:end])
+		return
+	}
+	rest = line[end+1:]
+	return
+}
+
+// parseRFC5424 parses "VERSION SP TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID SP MSGID SP STRUCTURED-DATA [SP MSG]"
+func (p *SyslogParser) parseRFC5424(line string, fields map[string]interface{}) (err error) {
+	header := strings.SplitN(line, " ", 7)
+	if len(header) < 7 {
+		return errors.Newf("incomplete RFC 5424 header")
+	}
+	version, _ := strconv.Atoi(header[0])
+	fields["version"] = int64(version)
+	if ts := header[1]; ts != syslogNilValue {
+		var t time.Time
+		// RFC 3339 with optional fractional seconds, which isn't among the generic layouts
+		if t, err = time.Parse(time.RFC3339Nano, ts); err != nil {
+			return errors.Wrapf(err, "RFC 5424 timestamp %q", ts)
+		}
+		fields["timestamp"] = t.UTC()
+	}
+	for i, name := range []string{"hostname", "app_name", "procid", "msgid"} {
+		if v := header[i+2]; v != syslogNilValue {
+			fields[name] = v
+		}
+	}
+	var sd map[string]interface{}
+	var msg string
+	if sd, msg, err = parseStructuredData(header[6]); err != nil {
+		return
+	}
+	if sd != nil {
+		fields["structured_data"] = sd
+	}
+	if msg = strings.TrimPrefix(msg, " "); msg != "" {
+		fields["message"] = strings.TrimPrefix(msg, syslogBOM)
+	}
+	return
+}
+
+func parseStructuredData(s string) (sd map[string]interface{}, rest string, err error) {
+	if strings.HasPrefix(s, syslogNilValue) {
+		return nil, s[1:], nil
+	}
+	sd = make(map[string]interface{})
+	for len(s) > 0 && s[0] == '[' {
+		s = s[1:]
+		end := strings.IndexAny(s, " ]")
+		if end <= 0 {
+			err = errors.Newf("invalid RFC 5424 structured data")
+			return
+		}
+		id := s[:end]
+		s = s[end:]
+		var params int
+		for len(s) > 0 && s[0] == ' ' {
+			s = s[1:]
+			eq := strings.IndexByte(s, '=')
+			if eq <= 0 || len(s) < eq+2 || s[eq+1] != '"' {
+				err = errors.Newf("invalid RFC 5424 structured data param of %s", id)
+				return
+			}
+			name := s[:eq]
+			s = s[eq+2:]
+			var val strings.Builder
+			closed := false
+			for i := 0; i < len(s); i++ {
+				if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\' || s[i+1] == ']') {
+					val.WriteByte(s[i+1])
+					i++
+				} else if s[i] == '"' {
+					s = s[i+1:]
+					closed = true
+					break
+				} else {
+					val.WriteByte(s[i])
+				}
+			}
+			if !closed {
+				err = errors.Newf("unterminated RFC 5424 structured data param %s.%s", id, name)
+				return
+			}
+			sd[id+"."+name] = val.String()
+			params++
+		}
+		if len(s) == 0 || s[0] != ']' {
+			err = errors.Newf("unterminated RFC 5424 structured data element %s", id)
+			return
+		}
+		s = s[1:]
+		if params == 0 {
+			sd[id] = ""
+		}
+	}
+	rest = s
+	return
+}
+
+// stampYear gives a timestamp without year the year which puts it closest to now, but not more than a day ahead.
+// That is the previous one for a message of December received in January, and the next one for a message of January
+// received in December by a clock behind the sender's. Feb 29 fails unless one of them is a leap year.
+func stampYear(t, now time.Time) (ts time.Time, ok bool) {
+	var best time.Duration
+	for year := now.Year() - 1; year <= now.Year()+1; year++ {
+		cand := time.Date(year, t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+		if cand.Day() != t.Day() {
+			continue
+		}
+		d := cand.Sub(now)
+		if d > 24*time.Hour {
+			continue
+		}
+		if d < 0 {
+			d = -d
+		}
+		if !ok || d < best {
+			ts, best, ok = cand, d, true
+		}
+	}
+	return
+}
+
+// parseRFC3164 parses "TIMESTAMP SP HOSTNAME SP TAG[PID]: MSG". The timestamp has no year, see stampYear.
+func (p *SyslogParser) parseRFC3164(line string, fields map[string]interface{}) (err error) {
+	stamped := false
+	if len(line) >= len(time.Stamp) {
+		if t, e := time.ParseInLocation(time.Stamp, line[:len(time.Stamp)], p.pp.timeZone); e == nil {
+			if t, ok := stampYear(t, time.Now().In(p.pp.timeZone)); ok {
+				fields["timestamp"] = t.UTC()
+			}
+			stamped = true
+			line = strings.TrimPrefix(line[len(time.Stamp):], " ")
+		}
+	}
+	if !stamped {
+		// some senders use a full timestamp instead
+		if ts, rest, found := strings.Cut(line, " "); found {
+			if t, e := time.Parse(time.RFC3339Nano, ts); e == nil {
+				fields["timestamp"] = t.UTC()
+				line = rest
+			} else if t, e := p.pp.ParseDateTime("timestamp", ts); e == nil {
+				fields["timestamp"] = t
+				line = rest
+			}
+		}
+	}
+	if host, rest, found := strings.Cut(line, " "); found && host != "" && !strings.HasSuffix(host, ":") {
+		fields["hostname"] = host
+		line = rest
+	}
+	if tag, rest, found := strings.Cut(line, " "); found && strings.HasSuffix(tag, ":") {
+		tag = strings.TrimSuffix(tag, ":")
+		if lb := strings.IndexByte(tag, '['); lb > 0 && strings.HasSuffix(tag, "]") {
+			fields["procid"] = tag[lb+1 : len(tag)-1]
+			tag = tag[:lb]
+		}
+		fields["app_name"] = tag
+		line = rest
+	}
+	fields["message"] = line
+	return
+}
@@ -0,0 +1,193 @@
+package parser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// parseFields parses a message with a parser of the pool and returns the fields of the metric.
+func parseFields(t *testing.T, pp *Pool, msg string) (map[string]interface{}, error) {
+	t.Helper()
+	p, err := pp.Get()
+	require.NoError(t, err)
+	defer pp.Put(p)
+	metric, err := p.Parse([]byte(msg))
+	if err != nil {
+		return nil, err
+	}
+	return metric.(*MapMetric).fields, nil
+}
+
+func TestSyslogParser(t *testing.T) {
+	pp, err := NewParserPool("syslog", nil, "", "UTC", 0, "")
+	require.NoError(t, err)
+	tests := []struct {
+		name    string
+		msg     string
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name: "rfc5424",
+			msg:  `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application"] An application event`,
+			want: map[string]interface{}{
+				"facility":  int64(20),
+				"severity":  int64(5),
+				"version":   int64(1),
+				"timestamp": time.Date(2003, 10, 11, 22, 14, 15, 3e6, time.UTC),
+				"hostname":  "mymachine.example.com",
+				"app_name":  "evntslog",
+				"msgid":     "ID47",
+				"structured_data": map[string]interface{}{
+					"exampleSDID@32473.iut":         "3",
+					"exampleSDID@32473.eventSource": "Application",
+				},
+				"message": "An application event",
+			},
+		},
+		{
+			name: "rfc5424 nil values and BOM",
+			msg:  "<34>1 - - - - - - \xEF\xBB\xBFhello",
+			want: map[string]interface{}{
+				"facility": int64(4),
+				"severity": int64(2),
+				"version":  int64(1),
+				"message":  "hello",
+			},
+		},
+		{
+			name: "rfc5424 escapes and empty element",
+			msg:  `<13>1 2024-01-02T03:04:05+01:00 host app 12 - [a x="q\"b\]c\\"][b]`,
+			want: map[string]interface{}{
+				"facility":        int64(1),
+				"severity":        int64(5),
+				"version":         int64(1),
+				"timestamp":       time.Date(2024, 1, 2, 2, 4, 5, 0, time.UTC),
+				"hostname":        "host",
+				"app_name":        "app",
+				"procid":          "12",
+				"structured_data": map[string]interface{}{"a.x": `q"b]c\`, "b": ""},
+			},
+		},
+		{
+			name: "rfc3164 with full timestamp",
+			msg:  "<14>2024-05-06T07:08:09Z web01 nginx[42]: GET / 200",
+			want: map[string]interface{}{
+				"facility":  int64(1),
+				"severity":  int64(6),
+				"timestamp": time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC),
+				"hostname":  "web01",
+				"app_name":  "nginx",
+				"procid":    "42",
+				"message":   "GET / 200",
+			},
+		},
+		{name: "no PRI", msg: "hello", wantErr: true},
+		{name: "PRI out of range", msg: "<192>1 - - - - - -", wantErr: true},
+		{name: "incomplete rfc5424 header", msg: "<13>1 - host", wantErr: true},
+		{name: "invalid rfc5424 timestamp", msg: "<13>1 yesterday host app - - -", wantErr: true},
+		{name: "unterminated structured data", msg: `<13>1 - - - - - [a x="1"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, err := parseFields(t, pp, tt.msg)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, fields)
+		})
+	}
+}
+
+func TestSyslogParserRFC3164Stamp(t *testing.T) {
+	pp, err := NewParserPool("syslog", nil, "", "UTC", 0, "")
+	require.NoError(t, err)
+	fields, err := parseFields(t, pp, "<34>Oct 11 22:14:15 mymachine su: 'su root' failed for lonvick on /dev/pts/8")
+	require.NoError(t, err)
+	ts, ok := fields["timestamp"].(time.Time)
+	require.True(t, ok)
+	assert.Equal(t, "Oct 11 22:14:15", ts.Format(time.Stamp))
+	delete(fields, "timestamp")
+	assert.Equal(t, map[string]interface{}{
+		"facility": int64(4),
+		"severity": int64(2),
+		"hostname": "mymachine",
+		"app_name": "su",
+		"message":  "'su root' failed for lonvick on /dev/pts/8",
+	}, fields)
+}
+
+func TestStampYear(t *testing.T) {
+	tests := []struct {
+		name  string
+		stamp string
+		now   time.Time
+		want  time.Time // zero if none fits
+	}{
+		{
+			name:  "same year",
+			stamp: "Jun  1 10:00:00",
+			now:   time.Date(2026, 6, 2, 0, 0, 0, 0, time.UTC),
+			want:  time.Date(2026, 6, 1, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "less than a day ahead",
+			stamp: "Jun  2 10:00:00",
+			now:   time.Date(2026, 6, 2, 0, 0, 0, 0, time.UTC),
+			want:  time.Date(2026, 6, 2, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "more than a day ahead is last year",
+			stamp: "Jun  5 10:00:00",
+			now:   time.Date(2026, 6, 2, 0, 0, 0, 0, time.UTC),
+			want:  time.Date(2025, 6, 5, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "december received in january",
+			stamp: "Dec 31 23:59:00",
+			now:   time.Date(2027, 1, 1, 0, 1, 0, 0, time.UTC),
+			want:  time.Date(2026, 12, 31, 23, 59, 0, 0, time.UTC),
+		},
+		{
+			name:  "january received in december",
+			stamp: "Jan  1 00:00:10",
+			now:   time.Date(2026, 12, 31, 23, 59, 0, 0, time.UTC),
+			want:  time.Date(2027, 1, 1, 0, 0, 10, 0, time.UTC),
+		},
+		{
+			name:  "leap day in a leap year",
+			stamp: "Feb 29 12:00:00",
+			now:   time.Date(2028, 3, 1, 0, 0, 0, 0, time.UTC),
+			want:  time.Date(2028, 2, 29, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "leap day of last year",
+			stamp: "Feb 29 12:00:00",
+			now:   time.Date(2029, 1, 10, 0, 0, 0, 0, time.UTC),
+			want:  time.Date(2028, 2, 29, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "leap day without a leap year",
+			stamp: "Feb 29 12:00:00",
+			now:   time.Date(2027, 3, 2, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stamp, err := time.ParseInLocation(time.Stamp, tt.stamp, time.UTC)
+			require.NoError(t, err)
+			got, ok := stampYear(stamp, tt.now)
+			if tt.want.IsZero() {
+				assert.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -15,6 +16,7 @@ import (
 var (
 	lock        sync.Mutex
 	clusterConn []*ShardConn
+	curHosts    [][]string // the hosts of clusterConn, from the config or system.clusters
 )
 
 type ShardConn struct {
@@ -22,8 +24,12 @@ type ShardConn struct {
 	conn        *Conn
 	dbVer       int
 	opts        clickhouse.Options
-	replicas    []string
-	nextRep     int
+	replicas    []string // the first one is preferred
+	curRep      int      // index of the replica of conn
+	shard       int
+	switching   chan struct{} // closed when the replica switch in progress is done
+	switchErr   error         // why the last failover found no replica
+	closed      bool
 	writingPool *util.WorkerPool
 	protocol    clickhouse.Protocol
 	chCfg       *config.ClickHouseConfig
@@ -37,14 +43,14 @@ func (sc *ShardConn) GetReplica() (replica string) {
 	sc.lock.Lock()
 	defer sc.lock.Unlock()
 	if sc.conn != nil {
-		curRep := (len(sc.replicas) + sc.nextRep - 1) % len(sc.replicas)
-		replica = sc.replicas[curRep]
+		replica = sc.replicas[sc.curRep]
 	}
 	return
 }
 func (sc *ShardConn) Close() {
 	sc.lock.Lock()
 	defer sc.lock.Unlock()
+	sc.closed = true
 	if sc.conn != nil {
 		sc.conn.Close()
 		sc.conn = nil
@@ -54,50 +60,198 @@ func (sc *ShardConn) Close() {
 	}
 }
 
+// NextGoodReplica returns the connection of the shard, or switches to the best replica if the connection of
+// version failedVer failed. Connections are opened without holding sc.lock, writers which ask meanwhile wait for the
+// switch in progress.
 func (sc *ShardConn) NextGoodReplica(failedVer int) (db *Conn, dbVer int, err error) {
 	sc.lock.Lock()
-	defer sc.lock.Unlock()
-	if sc.conn != nil {
-		if sc.dbVer > failedVer {
+	for {
+		if sc.conn != nil && sc.dbVer > failedVer {
 			// Another goroutine has already done connection.
 			// Notice: Why recording failure version instead timestamp?
 			// Consider following scenario:
 			// conn1 = NextGood(0); conn2 = NexGood(0); conn1.Exec failed at ts1;
 			// conn3 = NextGood(ts1); conn2.Exec failed at ts2;
 			// conn4 = NextGood(ts2) will close the good connection and break users.
-			return sc.conn, sc.dbVer, nil
+			db, dbVer = sc.conn, sc.dbVer
+			sc.lock.Unlock()
+			return
 		}
-		sc.conn.Close()
+		ch := sc.switching
+		if ch == nil {
+			break
+		}
+		sc.lock.Unlock()
+		<-ch
+		sc.lock.Lock()
+		if sc.conn == nil && sc.switchErr != nil {
+			err, dbVer = sc.switchErr, sc.dbVer
+			sc.lock.Unlock()
+			return
+		}
+	}
+	if sc.closed {
+		dbVer = sc.dbVer
+		sc.lock.Unlock()
+		return nil, dbVer, errors.Newf("connection to shard %d is closed", sc.shard)
+	}
+	old := sc.conn
+	if old != nil {
+		recordHealth(sc.shard, sc.replicas[sc.curRep], true, 0, errors.Newf("a write failed"))
 		sc.conn = nil
 	}
-	savedNextRep := sc.nextRep
-	conn := Conn{
-		protocol: sc.protocol,
-		ctx:      context.Background(),
+	ch := make(chan struct{})
+	sc.switching = ch
+	opts := sc.opts
+	candidates := sc.rankReplicas()
+	sc.lock.Unlock()
+
+	if old != nil {
+		old.Close()
 	}
-	for i := 0; i < len(sc.replicas); i++ {
-		replica := sc.replicas[sc.nextRep]
-		sc.opts.Addr = []string{replica}
-		sc.nextRep = (sc.nextRep + 1) % len(sc.replicas)
-		if sc.protocol == clickhouse.HTTP {
-			conn.db = clickhouse.OpenDB(&sc.opts)
-			conn.db.SetMaxOpenConns(sc.chCfg.MaxOpenConns)
-			conn.db.SetMaxIdleConns(sc.chCfg.MaxOpenConns)
-			conn.db.SetConnMaxLifetime(time.Minute * 10)
-		} else {
-			conn.c, err = clickhouse.Open(&sc.opts)
-		}
-		if err != nil {
+	conn, idx, err := sc.connect(opts, candidates, true)
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.switching = nil
+	close(ch)
+	sc.switchErr = err
+	if err == nil {
+		err = sc.install(conn, idx)
+	}
+	if err != nil {
+		return nil, sc.dbVer, err
+	}
+	return sc.conn, sc.dbVer, nil
+}
+
+// failback switches to the best replica, which is the preferred one once it recovered, if the current replica is
+// unhealthy or not preferred. Writers keep using the current connection until the new one is ready, it's closed
+// later so that writes in progress finish.
+func (sc *ShardConn) failback() {
+	sc.lock.Lock()
+	if sc.conn == nil || sc.switching != nil || sc.closed {
+		// writers reconnect on their own
+		sc.lock.Unlock()
+		return
+	}
+	best := sc.rankReplicas()[0]
+	if best == sc.curRep || !isHealthy(sc.replicas[best]) || (best != 0 && isHealthy(sc.replicas[sc.curRep])) {
+		sc.lock.Unlock()
+		return
+	}
+	ch := make(chan struct{})
+	sc.switching = ch
+	opts := sc.opts
+	from := sc.replicas[sc.curRep]
+	sc.lock.Unlock()
+
+	conn, idx, err := sc.connect(opts, []int{best}, false)
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.switching = nil
+	close(ch)
+	if err != nil {
+		return
+	}
+	old := sc.conn
+	if err = sc.install(conn, idx); err != nil {
+		return
+	}
+	util.Logger.Info("switched replica", zap.Int("shard", sc.shard), zap.String("from", from), zap.String("to", sc.replicas[idx]))
+	if old != nil {
+		time.AfterFunc(retireDelay, func() { old.Close() })
+	}
+}
+
+// install makes conn the connection of the shard. The caller holds sc.lock.
+func (sc *ShardConn) install(conn *Conn, idx int) error {
+	if sc.closed {
+		conn.Close()
+		return errors.Newf("connection to shard %d is closed", sc.shard)
+	}
+	sc.conn, sc.curRep = conn, idx
+	sc.dbVer++
+	util.Logger.Info("clickhouse.Open succeeded", zap.Int("dbVer", sc.dbVer), zap.String("replica", sc.replicas[idx]))
+	return nil
+}
+
+// connect opens a connection to the first candidate which answers a ping. If none does and lenient is set, it
+// settles for the first one it could open, writes to it fail and are retried.
+func (sc *ShardConn) connect(opts clickhouse.Options, candidates []int, lenient bool) (conn *Conn, idx int, err error) {
+	var fallback *Conn
+	fallbackIdx := -1
+	for _, i := range candidates {
+		replica := sc.replicas[i]
+		var c *Conn
+		if c, err = sc.open(opts, replica); err != nil {
 			util.Logger.Warn("clickhouse.Open failed", zap.String("replica", replica), zap.Error(err))
 			continue
 		}
-		sc.dbVer++
-		util.Logger.Info("clickhouse.Open succeeded", zap.Int("dbVer", sc.dbVer), zap.String("replica", replica))
-		sc.conn = &conn
-		return sc.conn, sc.dbVer, nil
+		ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+		err = c.PingContext(ctx)
+		cancel()
+		if err == nil {
+			if fallback != nil {
+				fallback.Close()
+			}
+			return c, i, nil
+		}
+		util.Logger.Warn("replica doesn't answer ping", zap.String("replica", replica), zap.Error(err))
+		if lenient && fallback == nil {
+			fallback, fallbackIdx = c, i
+		} else {
+			c.Close()
+		}
 	}
-	err = errors.Newf("no good replica among replicas %v since %d", sc.replicas, savedNextRep)
-	return nil, sc.dbVer, err
+	if fallback != nil {
+		return fallback, fallbackIdx, nil
+	}
+	return nil, -1, errors.Newf("no good replica among replicas %v", sc.replicas)
+}
+
+func (sc *ShardConn) open(opts clickhouse.Options, replica string) (conn *Conn, err error) {
+	opts.Addr = []string{replica}
+	conn = &Conn{
+		protocol: sc.protocol,
+		ctx:      context.Background(),
+	}
+	if sc.protocol == clickhouse.HTTP {
+		conn.db = clickhouse.OpenDB(&opts)
+		conn.db.SetMaxOpenConns(sc.chCfg.MaxOpenConns)
+		conn.db.SetMaxIdleConns(sc.chCfg.MaxOpenConns)
+		conn.db.SetConnMaxLifetime(time.Minute * 10)
+	} else if conn.c, err = clickhouse.Open(&opts); err != nil {
+		return nil, errors.Wrapf(err, "")
+	}
+	return
+}
+
+// rankReplicas returns the indices of the replicas in the order to try them: the healthy ones first, the preferred
+// one first among them, then by latency weighted with the error rate. The caller holds sc.lock.
+func (sc *ShardConn) rankReplicas() []int {
+	n := len(sc.replicas)
+	idxs := make([]int, n)
+	healthy := make([]bool, n)
+	scores := make([]float64, n)
+	for i, replica := range sc.replicas {
+		idxs[i] = i
+		h := getHealth(replica)
+		healthy[i] = h == nil || h.Healthy
+		scores[i] = h.score()
+	}
+	sort.SliceStable(idxs, func(a, b int) bool {
+		i, j := idxs[a], idxs[b]
+		if healthy[i] != healthy[j] {
+			return healthy[i]
+		}
+		if healthy[i] && (i == 0) != (j == 0) {
+			return i == 0
+		}
+		return scores[i] < scores[j]
+	})
+	return idxs
 }
 
 func InitClusterConn(chCfg *config.ClickHouseConfig) (err error) {
@@ -105,60 +259,91 @@ func InitClusterConn(chCfg *config.ClickHouseConfig) (err error) {
 	defer lock.Unlock()
 	freeClusterConn()
 
+	hosts := chCfg.Hosts
+	if chCfg.Cluster != "" {
+		if hosts, err = discoverHosts(chCfg, chCfg.Hosts); err != nil {
+			return
+		}
+	}
+	if clusterConn, err = newShardConns(chCfg, hosts); err != nil {
+		return
+	}
+	curHosts = hosts
+	startProber()
+	if chCfg.Cluster != "" {
+		startDiscovery(chCfg)
+	}
+	return
+}
+
+// newShardConns connects to every shard of hosts.
+func newShardConns(chCfg *config.ClickHouseConfig, hosts [][]string) (shards []*ShardConn, err error) {
+	for i, replicas := range hosts {
+		sc := newShardConn(chCfg, i, replicas)
+		sc.writingPool = util.NewWorkerPool(chCfg.MaxOpenConns, 1)
+		if _, _, err = sc.NextGoodReplica(0); err != nil {
+			sc.Close()
+			for _, sc := range shards {
+				sc.Close()
+			}
+			return nil, err
+		}
+		shards = append(shards, sc)
+	}
+	return
+}
+
+func newShardConn(chCfg *config.ClickHouseConfig, shard int, replicas []string) *ShardConn {
 	proto := clickhouse.Native
 	if chCfg.Protocol == clickhouse.HTTP.String() {
 		proto = clickhouse.HTTP
 	}
-
-	for _, replicas := range chCfg.Hosts {
-		numReplicas := len(replicas)
-		replicaAddrs := make([]string, numReplicas)
-		for i, ip := range replicas {
-			if !chCfg.Secure {
-				if ips2, err := util.GetIP4Byname(ip); err == nil {
-					ip = ips2[0]
-				}
+	numReplicas := len(replicas)
+	replicaAddrs := make([]string, numReplicas)
+	for i, ip := range replicas {
+		if !chCfg.Secure {
+			if ips2, err := util.GetIP4Byname(ip); err == nil {
+				ip = ips2[0]
 			}
-			replicaAddrs[i] = fmt.Sprintf("%s:%d", ip, chCfg.Port)
 		}
-		sc := &ShardConn{
-			replicas: replicaAddrs,
-			chCfg:    chCfg,
-			opts: clickhouse.Options{
-				Auth: clickhouse.Auth{
-					Database: chCfg.DB,
-					Username: chCfg.Username,
-					Password: chCfg.Password,
-				},
-				Protocol:    proto,
-				DialTimeout: time.Minute * 10,
+		replicaAddrs[i] = fmt.Sprintf("%s:%d", ip, chCfg.Port)
+	}
+	sc := &ShardConn{
+		replicas: replicaAddrs,
+		shard:    shard,
+		chCfg:    chCfg,
+		opts: clickhouse.Options{
+			Auth: clickhouse.Auth{
+				Database: chCfg.DB,
+				Username: chCfg.Username,
+				Password: chCfg.Password,
 			},
-			writingPool: util.NewWorkerPool(chCfg.MaxOpenConns, 1),
-		}
-		if chCfg.Secure {
-			tlsConfig := &tls.Config{}
-			tlsConfig.InsecureSkipVerify = chCfg.InsecureSkipVerify
-			sc.opts.TLS = tlsConfig
-		}
-		if proto == clickhouse.Native {
-			sc.opts.MaxOpenConns = chCfg.MaxOpenConns
-			sc.opts.MaxIdleConns = chCfg.MaxOpenConns
-			sc.opts.ConnMaxLifetime = time.Minute * 10
-		}
-		sc.protocol = proto
-		if _, _, err = sc.NextGoodReplica(0); err != nil {
-			return
-		}
-		clusterConn = append(clusterConn, sc)
+			Protocol:    proto,
+			DialTimeout: time.Minute * 10,
+		},
 	}
-	return
+	if chCfg.Secure {
+		tlsConfig := &tls.Config{}
+		tlsConfig.InsecureSkipVerify = chCfg.InsecureSkipVerify
+		sc.opts.TLS = tlsConfig
+	}
+	if proto == clickhouse.Native {
+		sc.opts.MaxOpenConns = chCfg.MaxOpenConns
+		sc.opts.MaxIdleConns = chCfg.MaxOpenConns
+		sc.opts.ConnMaxLifetime = time.Minute * 10
+	}
+	sc.protocol = proto
+	return sc
 }
 
 func freeClusterConn() {
+	stopDiscovery()
+	stopProber()
 	for _, sc := range clusterConn {
 		sc.Close()
 	}
 	clusterConn = []*ShardConn{}
+	curHosts = nil
 }
 
 func FreeClusterConn() {
@@ -0,0 +1,148 @@
+package pool
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// seconds between two reads of system.clusters if Clickhouse.DiscoveryInterval is 0
+const defaultDiscoveryInterval = 300
+
+var discoveryStop chan struct{}
+
+// discoverHosts reads the shards and replicas of Clickhouse.Cluster from system.clusters of the first seed host
+// which answers. Every host is reached at Clickhouse.Port, like the hosts of the config.
+func discoverHosts(chCfg *config.ClickHouseConfig, seeds [][]string) (hosts [][]string, err error) {
+	var all []string
+	for _, replicas := range seeds {
+		all = append(all, replicas...)
+	}
+	if len(all) == 0 {
+		return nil, errors.Newf("no host to read the layout of cluster %s from", chCfg.Cluster)
+	}
+	sc := newShardConn(chCfg, 0, all)
+	defer sc.Close()
+	var conn *Conn
+	if conn, _, err = sc.NextGoodReplica(0); err != nil {
+		return
+	}
+	query := fmt.Sprintf("SELECT shard_num, host_name FROM system.clusters WHERE cluster = '%s' ORDER BY shard_num, replica_num", chCfg.Cluster)
+	util.Logger.Debug(fmt.Sprintf("executing sql=> %s", query))
+	var rows *Rows
+	if rows, err = conn.Query(query); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer rows.Close()
+	var lastShard uint32
+	for rows.Next() {
+		var shardNum uint32
+		var host string
+		if err = rows.Scan(&shardNum, &host); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		if len(hosts) == 0 || shardNum != lastShard {
+			hosts = append(hosts, nil)
+			lastShard = shardNum
+		}
+		hosts[len(hosts)-1] = append(hosts[len(hosts)-1], host)
+	}
+	if len(hosts) == 0 {
+		err = errors.Newf("cluster %s not found in system.clusters", chCfg.Cluster)
+	}
+	return
+}
+
+// startDiscovery reads system.clusters every Clickhouse.DiscoveryInterval seconds, and rebuilds clusterConn when
+// nodes were added or removed. The caller holds lock.
+func startDiscovery(chCfg *config.ClickHouseConfig) {
+	discoveryStop = make(chan struct{})
+	stop := discoveryStop
+	interval := chCfg.DiscoveryInterval
+	if interval <= 0 {
+		interval = defaultDiscoveryInterval
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rediscover(chCfg, stop)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopDiscovery doesn't wait for a rebuild in progress, which gives up once it gets lock. The caller holds lock.
+func stopDiscovery() {
+	if discoveryStop != nil {
+		close(discoveryStop)
+		discoveryStop = nil
+	}
+}
+
+func rediscover(chCfg *config.ClickHouseConfig, stop chan struct{}) {
+	lock.Lock()
+	seeds := append(append([][]string(nil), curHosts...), chCfg.Hosts...)
+	prev := curHosts
+	lock.Unlock()
+
+	hosts, err := discoverHosts(chCfg, seeds)
+	if err != nil {
+		util.Logger.Warn("failed to read the layout of the cluster", zap.String("cluster", chCfg.Cluster), zap.Error(err))
+		return
+	}
+	if reflect.DeepEqual(hosts, prev) {
+		return
+	}
+	// connect to the new layout before taking lock, writers keep going meanwhile
+	shards, err := newShardConns(chCfg, hosts)
+	if err != nil {
+		util.Logger.Warn("failed to connect to the new layout of the cluster", zap.String("cluster", chCfg.Cluster), zap.Error(err))
+		return
+	}
+
+	lock.Lock()
+	select {
+	case <-stop:
+		lock.Unlock()
+		for _, sc := range shards {
+			sc.Close()
+		}
+		return
+	default:
+	}
+	stopProber()
+	old := clusterConn
+	clusterConn, curHosts = shards, hosts
+	startProber()
+	lock.Unlock()
+
+	util.Logger.Info("rebuilt the connections to the cluster", zap.String("cluster", chCfg.Cluster),
+		zap.Reflect("from", prev), zap.Reflect("to", hosts))
+	for _, sc := range old {
+		go sc.retire()
+	}
+}
+
+// retire closes a replaced ShardConn once the writes submitted to it are done.
+func (sc *ShardConn) retire() {
+	sc.writingPool.StopWait()
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.closed = true
+	if sc.conn != nil {
+		sc.conn.Close()
+		sc.conn = nil
+	}
+}
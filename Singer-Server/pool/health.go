@@ -0,0 +1,232 @@
+package pool
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	probeInterval = 10 * time.Second
+	probeTimeout  = 5 * time.Second
+	// weight of the latest probe in the latency and error rate
+	healthAlpha = 0.3
+	// a replica failing every probe scores as if it were this many times slower
+	errorPenalty = 10
+	// how long a connection replaced on failback stays open for the writes in progress
+	retireDelay = time.Minute
+)
+
+// ReplicaHealth is the outcome of the latest probes of a replica.
+type ReplicaHealth struct {
+	Shard         int       `json:"shard"`
+	Replica       string    `json:"replica"`
+	Current       bool      `json:"current"` // the replica the shard writes to
+	Healthy       bool      `json:"healthy"`
+	LastCheck     time.Time `json:"lastCheck"`
+	LastSuccess   time.Time `json:"lastSuccess,omitempty"`
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorTime time.Time `json:"lastErrorTime,omitempty"`
+	LatencyMs     float64   `json:"latencyMs"` // smoothed ping latency
+	ErrorRate     float64   `json:"errorRate"` // smoothed share of failed probes and writes
+}
+
+// score ranks healthy replicas, lower is better. A replica not probed yet scores best.
+func (h *ReplicaHealth) score() float64 {
+	if h == nil {
+		return 0
+	}
+	return (h.LatencyMs + 1) * (1 + errorPenalty*h.ErrorRate)
+}
+
+func getHealth(replica string) *ReplicaHealth {
+	if v, ok := replicaHealth.Load(replica); ok {
+		return v.(*ReplicaHealth)
+	}
+	return nil
+}
+
+func isHealthy(replica string) bool {
+	h := getHealth(replica)
+	return h == nil || h.Healthy
+}
+
+var (
+	// replica address -> *ReplicaHealth, replaced rather than changed
+	replicaHealth sync.Map
+	proberStop    chan struct{}
+	proberWg      sync.WaitGroup
+)
+
+// ReplicaHealths returns the health of every replica ordered by shard and replica.
+func ReplicaHealths() (healths []ReplicaHealth) {
+	replicaHealth.Range(func(key, value any) bool {
+		healths = append(healths, *value.(*ReplicaHealth))
+		return true
+	})
+	sort.Slice(healths, func(i, j int) bool {
+		if healths[i].Shard != healths[j].Shard {
+			return healths[i].Shard < healths[j].Shard
+		}
+		return healths[i].Replica < healths[j].Replica
+	})
+	return
+}
+
+// ShardsReady tells whether every shard has a healthy replica, and the shards which don't.
+func ShardsReady() (ready bool, badShards []int) {
+	lock.Lock()
+	numShards := len(clusterConn)
+	lock.Unlock()
+	if numShards == 0 {
+		return false, nil
+	}
+	good := make([]bool, numShards)
+	replicaHealth.Range(func(key, value any) bool {
+		if h := value.(*ReplicaHealth); h.Healthy && h.Shard < numShards {
+			good[h.Shard] = true
+		}
+		return true
+	})
+	for i, ok := range good {
+		if !ok {
+			badShards = append(badShards, i)
+		}
+	}
+	return len(badShards) == 0, badShards
+}
+
+// startProber probes the replicas of every shard now and then every probeInterval, and fails the shard back to
+// its preferred replica once it recovered. The caller holds lock.
+func startProber() {
+	proberStop = make(chan struct{})
+	stop := proberStop
+	for _, sc := range clusterConn {
+		proberWg.Add(1)
+		go func(sc *ShardConn) {
+			defer proberWg.Done()
+			ticker := time.NewTicker(probeInterval)
+			defer ticker.Stop()
+			for {
+				sc.probe()
+				sc.failback()
+				select {
+				case <-ticker.C:
+				case <-stop:
+					return
+				}
+			}
+		}(sc)
+	}
+}
+
+// stopProber waits for the running probes and forgets the health of all replicas. The caller holds lock.
+func stopProber() {
+	if proberStop == nil {
+		return
+	}
+	close(proberStop)
+	proberWg.Wait()
+	proberStop = nil
+	replicaHealth.Range(func(key, value any) bool {
+		replicaHealth.Delete(key)
+		return true
+	})
+}
+
+// probe pings the connection of the shard, and opens a connection to ping each of the other replicas.
+func (sc *ShardConn) probe() {
+	sc.lock.Lock()
+	conn := sc.conn
+	current := ""
+	if conn != nil {
+		current = sc.replicas[sc.curRep]
+	}
+	opts := sc.opts
+	replicas := sc.replicas
+	sc.lock.Unlock()
+
+	for _, replica := range replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+		var err error
+		begin := time.Now()
+		if replica == current {
+			err = conn.PingContext(ctx)
+		} else {
+			err = pingReplica(ctx, opts, replica)
+		}
+		cancel()
+		recordHealth(sc.shard, replica, replica == current, time.Since(begin), err)
+	}
+}
+
+func pingReplica(ctx context.Context, opts clickhouse.Options, replica string) (err error) {
+	opts.Addr = []string{replica}
+	opts.DialTimeout = probeTimeout
+	opts.MaxOpenConns = 1
+	opts.MaxIdleConns = 1
+	if opts.Protocol == clickhouse.HTTP {
+		db := clickhouse.OpenDB(&opts)
+		defer db.Close()
+		err = db.PingContext(ctx)
+	} else {
+		var c clickhouse.Conn
+		if c, err = clickhouse.Open(&opts); err != nil {
+			return errors.Wrapf(err, "")
+		}
+		defer c.Close()
+		err = c.Ping(ctx)
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+// recordHealth records the outcome of a probe, or of a write if latency is 0.
+func recordHealth(shard int, replica string, current bool, latency time.Duration, err error) {
+	now := time.Now()
+	h := &ReplicaHealth{Shard: shard, Replica: replica, Current: current, Healthy: err == nil, LastCheck: now}
+	var failed float64
+	if err != nil {
+		failed = 1
+	}
+	prev := getHealth(replica)
+	if prev != nil {
+		h.LastSuccess, h.LastError, h.LastErrorTime = prev.LastSuccess, prev.LastError, prev.LastErrorTime
+		h.LatencyMs = prev.LatencyMs
+		h.ErrorRate = smooth(prev.ErrorRate, failed)
+	} else {
+		h.ErrorRate = failed
+	}
+	if err == nil && latency > 0 {
+		ms := float64(latency) / float64(time.Millisecond)
+		if h.LatencyMs == 0 {
+			h.LatencyMs = ms
+		} else {
+			h.LatencyMs = smooth(h.LatencyMs, ms)
+		}
+	}
+	if err == nil {
+		h.LastSuccess = now
+		if prev != nil && !prev.Healthy {
+			util.Logger.Info("replica is healthy again", zap.Int("shard", shard), zap.String("replica", replica))
+		}
+	} else {
+		h.LastError, h.LastErrorTime = err.Error(), now
+		if prev == nil || prev.Healthy {
+			util.Logger.Warn("replica is unhealthy", zap.Int("shard", shard), zap.String("replica", replica), zap.Error(err))
+		}
+	}
+	replicaHealth.Store(replica, h)
+}
+
+func smooth(prev, cur float64) float64 {
+	return healthAlpha*cur + (1-healthAlpha)*prev
+}
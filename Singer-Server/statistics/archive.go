@@ -0,0 +1,43 @@
+package statistics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ArchivedRowsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "archived_rows_total",
+			Help: "total num of rows uploaded to the archive",
+		},
+		[]string{"task"},
+	)
+	ArchivedObjectsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "archived_objects_total",
+			Help: "total num of objects uploaded to the archive",
+		},
+		[]string{"task"},
+	)
+	ArchiveErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "archive_errors_total",
+			Help: "total num of objects which failed to encode or upload",
+		},
+		[]string{"task"},
+	)
+	ArchiveDroppedRowsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "archive_dropped_rows_total",
+			Help: "total num of rows not archived because the queue was full or the upload failed",
+		},
+		[]string{"task"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(ArchivedRowsTotal)
+	prometheus.MustRegister(ArchivedObjectsTotal)
+	prometheus.MustRegister(ArchiveErrorsTotal)
+	prometheus.MustRegister(ArchiveDroppedRowsTotal)
+}
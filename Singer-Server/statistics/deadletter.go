@@ -0,0 +1,42 @@
+package statistics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	DeadLetterTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "dead_letter_total",
+			Help: "total num of records sent to the dead-letter queue",
+		},
+		[]string{"task", "stage"},
+	)
+	DeadLetterDroppedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "dead_letter_dropped_total",
+			Help: "total num of dead-letter records dropped because the queue was full or failed to write",
+		},
+		[]string{"task"},
+	)
+	DeadLetterWriteErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "dead_letter_write_errors_total",
+			Help: "total num of failed writes to the dead-letter destination",
+		},
+		[]string{"type"},
+	)
+	DeadLetterQueueLength = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: prefix + "dead_letter_queue_length",
+			Help: "num of dead-letter records waiting to be written",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(DeadLetterTotal)
+	prometheus.MustRegister(DeadLetterDroppedTotal)
+	prometheus.MustRegister(DeadLetterWriteErrorsTotal)
+	prometheus.MustRegister(DeadLetterQueueLength)
+}
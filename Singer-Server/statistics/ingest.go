@@ -0,0 +1,35 @@
+package statistics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	IngestRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "ingest_requests_total",
+			Help: "total num of http ingestion requests by response code",
+		},
+		[]string{"task", "code"},
+	)
+	IngestRecordsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "ingest_records_total",
+			Help: "total num of records accepted by http ingestion",
+		},
+		[]string{"task"},
+	)
+	IngestPendingRecords = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "ingest_pending_records",
+			Help: "num of records accepted by http ingestion which haven't been written yet",
+		},
+		[]string{"consumer"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(IngestRequestsTotal)
+	prometheus.MustRegister(IngestRecordsTotal)
+	prometheus.MustRegister(IngestPendingRecords)
+}
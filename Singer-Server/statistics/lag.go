@@ -0,0 +1,43 @@
+package statistics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ConsumerLag = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "consumer_lag",
+			Help: "num of messages between the committed offset and the end of a partition",
+		},
+		[]string{"consumer", "topic", "partition"},
+	)
+	ConsumerCatchUpSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "consumer_catch_up_seconds",
+			Help: "estimated seconds for a consumer to consume the lag of a topic at current rates, +Inf if it's falling behind",
+		},
+		[]string{"consumer", "topic"},
+	)
+	ConsumerPartitionStalled = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "consumer_partition_stalled",
+			Help: "whether the committed offset of a partition hasn't moved for the stall timeout while its lag grows",
+		},
+		[]string{"consumer", "topic", "partition"},
+	)
+	LagCollectErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "lag_collect_errors_total",
+			Help: "total num of failures to fetch the offsets of a consumer",
+		},
+		[]string{"consumer"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(ConsumerLag)
+	prometheus.MustRegister(ConsumerCatchUpSeconds)
+	prometheus.MustRegister(ConsumerPartitionStalled)
+	prometheus.MustRegister(LagCollectErrorsTotal)
+}
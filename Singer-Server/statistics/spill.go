@@ -0,0 +1,35 @@
+package statistics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	SpilledBatches = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "spilled_batches",
+			Help: "num of batches spilled after failing to write, waiting to be replayed",
+		},
+		[]string{"task"},
+	)
+	SpillErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "spill_errors_total",
+			Help: "total num of batches which couldn't be spilled to disk and were kept in memory",
+		},
+		[]string{"task"},
+	)
+	ConsumerPaused = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "consumer_paused",
+			Help: "whether a consumer group is paused because of spilled batches",
+		},
+		[]string{"consumer"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(SpilledBatches)
+	prometheus.MustRegister(SpillErrorsTotal)
+	prometheus.MustRegister(ConsumerPaused)
+}
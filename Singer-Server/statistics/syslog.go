@@ -0,0 +1,35 @@
+package statistics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	SyslogMessagesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "syslog_messages_total",
+			Help: "total num of messages received by the syslog listeners",
+		},
+		[]string{"task", "transport"},
+	)
+	SyslogErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "syslog_errors_total",
+			Help: "total num of framing and connection errors of the syslog listeners",
+		},
+		[]string{"task", "transport"},
+	)
+	SyslogConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "syslog_connections",
+			Help: "num of open connections to the syslog listeners",
+		},
+		[]string{"task", "transport"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(SyslogMessagesTotal)
+	prometheus.MustRegister(SyslogErrorsTotal)
+	prometheus.MustRegister(SyslogConnections)
+}
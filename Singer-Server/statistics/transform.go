@@ -0,0 +1,19 @@
+package statistics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ClassifiedLevelsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "classified_levels_total",
+			Help: "total num of records classified per log level",
+		},
+		[]string{"task", "level"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(ClassifiedLevelsTotal)
+}
@@ -0,0 +1,334 @@
+package task
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const adminTimeout = 30 * time.Second
+
+var (
+	ErrConsumerNotFound  = errors.Newf("consumer not found")
+	ErrSinkerBusy        = errors.Newf("sinker is busy, try again later")
+	ErrAdminForbidden    = errors.Newf("admin api is only served on the loopback address without a token")
+	ErrAdminUnauthorized = errors.Newf("missing or invalid admin token")
+
+	// config fields whose values the admin API never shows, compared case-insensitively
+	secretFields = []string{"Password", "AccessKey", "SecretKey", "APIKeys", "DSN"}
+)
+
+// adminCmd runs in the main loop of Sinker.Run, the only place s.consumers may be touched.
+type adminCmd struct {
+	fn   func() (interface{}, error)
+	done chan adminResult
+}
+
+type adminResult struct {
+	val interface{}
+	err error
+}
+
+type ConsumerStatus struct {
+	Name   string       `json:"name"`
+	State  string       `json:"state"`
+	Paused bool         `json:"paused"` // by the admin API
+	Pauses int          `json:"pauses"` // including those of tasks with spilled batches
+	Topics []string     `json:"topics"`
+	Tasks  []TaskStatus `json:"tasks"`
+}
+
+type TaskStatus struct {
+	Name           string `json:"name"`
+	Topic          string `json:"topic"`
+	Table          string `json:"table"`
+	PendingBatches int32  `json:"pendingBatches"`
+	SpilledBatches int    `json:"spilledBatches"`
+}
+
+func (s *Sinker) execAdmin(fn func() (interface{}, error)) (interface{}, error) {
+	return s.execAdminTimeout(fn, adminTimeout)
+}
+
+func (s *Sinker) execAdminTimeout(fn func() (interface{}, error), timeout time.Duration) (interface{}, error) {
+	cmd := &adminCmd{fn: fn, done: make(chan adminResult, 1)}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case s.adminCh <- cmd:
+	case <-s.ctx.Done():
+		return nil, ErrSinkerBusy
+	case <-timer.C:
+		return nil, ErrSinkerBusy
+	}
+	res := <-cmd.done
+	return res.val, res.err
+}
+
+func (s *Sinker) handleAdmin(cmd *adminCmd) {
+	val, err := cmd.fn()
+	cmd.done <- adminResult{val, err}
+}
+
+// ListConsumers returns the consumers and their tasks ordered by name.
+func (s *Sinker) ListConsumers() (statuses []ConsumerStatus, err error) {
+	_, err = s.execAdmin(func() (interface{}, error) {
+		statuses = make([]ConsumerStatus, 0, len(s.consumers))
+		for _, c := range s.consumers {
+			statuses = append(statuses, c.status())
+		}
+		return nil, nil
+	})
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return
+}
+
+// PauseConsumer stops the consumption of a group until ResumeConsumer. Data in flight is still written and
+// committed.
+func (s *Sinker) PauseConsumer(name string) error {
+	return s.withConsumer(name, func(c *Consumer) {
+		if c.pauseByAdmin(true) {
+			util.Logger.Info("paused consumer by admin request", zap.String("consumer", name))
+		}
+	})
+}
+
+func (s *Sinker) ResumeConsumer(name string) error {
+	return s.withConsumer(name, func(c *Consumer) {
+		if c.pauseByAdmin(false) {
+			util.Logger.Info("resumed consumer by admin request", zap.String("consumer", name))
+		}
+	})
+}
+
+// Flush makes a consumer, or every consumer if name is empty, write its buffered records now.
+func (s *Sinker) Flush(name string) error {
+	if name == "" {
+		_, err := s.execAdmin(func() (interface{}, error) {
+			for _, c := range s.consumers {
+				c.flush()
+			}
+			return nil, nil
+		})
+		return err
+	}
+	return s.withConsumer(name, (*Consumer).flush)
+}
+
+// EffectiveConfig returns the applied config as JSON, without secrets.
+func (s *Sinker) EffectiveConfig() ([]byte, error) {
+	val, err := s.execAdmin(func() (interface{}, error) {
+		// marshal here, applyConfig changes the current config in place
+		return json.Marshal(s.curCfg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var cfg interface{}
+	if err = json.Unmarshal(val.([]byte), &cfg); err != nil {
+		return nil, errors.Wrapf(err, "")
+	}
+	return json.MarshalIndent(redact(cfg), "", "  ")
+}
+
+func (s *Sinker) withConsumer(name string, fn func(c *Consumer)) error {
+	_, err := s.execAdmin(func() (interface{}, error) {
+		c, ok := s.consumers[name]
+		if !ok {
+			return nil, ErrConsumerNotFound
+		}
+		fn(c)
+		return nil, nil
+	})
+	return err
+}
+
+func (c *Consumer) status() ConsumerStatus {
+	st := ConsumerStatus{
+		Name:   c.grpConfig.Name,
+		State:  "stopped",
+		Topics: c.grpConfig.Topics,
+		Tasks:  []TaskStatus{},
+	}
+	if c.state.Load() == util.StateRunning {
+		st.State = "running"
+	}
+	c.mux.Lock()
+	st.Paused, st.Pauses = c.adminPaused, c.pauses
+	c.mux.Unlock()
+	c.tasks.Range(func(key, value any) bool {
+		tsk := value.(*Service)
+		ts := TaskStatus{
+			Name:  tsk.taskCfg.Name,
+			Topic: tsk.taskCfg.Topic,
+			Table: tsk.taskCfg.TableName,
+		}
+		if tsk.clickhouse != nil {
+			ts.PendingBatches, ts.SpilledBatches = tsk.clickhouse.Backlog()
+		}
+		st.Tasks = append(st.Tasks, ts)
+		return true
+	})
+	sort.Slice(st.Tasks, func(i, j int) bool { return st.Tasks[i].Name < st.Tasks[j].Name })
+	return st
+}
+
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			secret := false
+			for _, s := range secretFields {
+				if strings.EqualFold(k, s) {
+					secret = true
+					break
+				}
+			}
+			if !secret {
+				v[k] = redact(val)
+				continue
+			}
+			switch val := val.(type) {
+			case string:
+				if val != "" {
+					v[k] = "******"
+				}
+			case []interface{}:
+				if len(val) != 0 {
+					v[k] = "******"
+				}
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redact(v[i])
+		}
+	}
+	return v
+}
+
+// AdminHandler serves the admin API under /api/:
+//
+//	GET  /api/consumers               consumers and tasks with their state
+//	POST /api/consumers/{name}/pause  pause consumption of a group
+//	POST /api/consumers/{name}/resume resume consumption of a group
+//	POST /api/consumers/{name}/flush  flush the buffer of a group
+//	POST /api/flush                   flush the buffers of all groups
+//	GET  /api/config                  the effective config, secrets masked
+//
+// Requests must carry the token as "Authorization: Bearer <token>". Without a token only requests from the loopback
+// address are served.
+func (s *Sinker) AdminHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(r, token) {
+			if token == "" {
+				writeAdminResponse(w, nil, ErrAdminForbidden)
+			} else {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeAdminResponse(w, nil, ErrAdminUnauthorized)
+			}
+			return
+		}
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api"), "/")
+		parts := strings.Split(path, "/")
+		switch {
+		case path == "consumers":
+			if !allowMethod(w, r, http.MethodGet) {
+				return
+			}
+			statuses, err := s.ListConsumers()
+			writeAdminResponse(w, statuses, err)
+		case len(parts) == 3 && parts[0] == "consumers":
+			if !allowMethod(w, r, http.MethodPost) {
+				return
+			}
+			var err error
+			switch parts[2] {
+			case "pause":
+				err = s.PauseConsumer(parts[1])
+			case "resume":
+				err = s.ResumeConsumer(parts[1])
+			case "flush":
+				err = s.Flush(parts[1])
+			default:
+				http.NotFound(w, r)
+				return
+			}
+			writeAdminResponse(w, map[string]string{"consumer": parts[1], "action": parts[2]}, err)
+		case path == "flush":
+			if !allowMethod(w, r, http.MethodPost) {
+				return
+			}
+			writeAdminResponse(w, map[string]string{"action": "flush"}, s.Flush(""))
+		case path == "config":
+			if !allowMethod(w, r, http.MethodGet) {
+				return
+			}
+			bs, err := s.EffectiveConfig()
+			if err != nil {
+				writeAdminResponse(w, nil, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(bs)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func adminAuthorized(r *http.Request, token string) bool {
+	if token == "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return false
+		}
+		ip := net.ParseIP(host)
+		return ip != nil && ip.IsLoopback()
+	}
+	auth := r.Header.Get("Authorization")
+	const scheme = "Bearer "
+	if len(auth) <= len(scheme) || !strings.EqualFold(auth[:len(scheme)], scheme) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(auth[len(scheme):])), []byte(token)) == 1
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeAdminResponse(w http.ResponseWriter, val interface{}, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrConsumerNotFound):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, ErrSinkerBusy):
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case errors.Is(err, ErrAdminForbidden):
+			w.WriteHeader(http.StatusForbidden)
+		case errors.Is(err, ErrAdminUnauthorized):
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		val = map[string]string{"error": err.Error()}
+	}
+	if e := json.NewEncoder(w).Encode(val); e != nil {
+		util.Logger.Warn("failed to write admin response", zap.Error(e))
+	}
+}
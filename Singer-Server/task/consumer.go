@@ -1,19 +1,22 @@
 package task
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"fmt"
 	"math"
-	"math/rand"
-	"regexp"
-	"strings"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/dlq"
+	"github.com/housepower/clickhouse_sinker/input"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/parser"
+	"github.com/housepower/clickhouse_sinker/pool"
+	"github.com/housepower/clickhouse_sinker/statistics"
+	"github.com/housepower/clickhouse_sinker/transform"
+	"github.com/housepower/clickhouse_sinker/util"
 	"github.com/twmb/franz-go/pkg/kgo"
 	"go.uber.org/zap"
 
@@ -25,23 +28,35 @@ type Commit struct {
 	offsets  model.RecordMap
 	wg       *sync.WaitGroup
 	consumer *Consumer
+	journal  *flushJournal // nil unless a task of the consumer deduplicates inserts
+	seq      int64
 }
 
 type Consumer struct {
 	sinker    *Sinker
-	inputer   *input.KafkaFranz
+	inputer   input.Inputer
 	tasks     sync.Map
+	chains    sync.Map
+	splitters sync.Map
 	grpConfig *config.GroupConfig
 	fetchesCh chan *kgo.Fetches
 	processWg sync.WaitGroup
 	ctx       context.Context
 	cancel    context.CancelFunc
 	state     atomic.Uint32
-	errCommit bool
-
-	numFlying  int32
-	mux        sync.Mutex
-	commitDone *sync.Cond
+	errCommit atomic.Bool // offsets aren't committed until the consumer restarts, see Rewind
+
+	flushCh   chan struct{}
+	journal   *flushJournal
+	commitsCh chan *Commit
+	commitWg  sync.WaitGroup
+	// unix nanoseconds since commitFn waits for a commit, 0 if it doesn't
+	commitBusySince atomic.Int64
+	numFlying       int32
+	pauses          int
+	adminPaused     bool
+	mux             sync.Mutex
+	commitDone      *sync.Cond
 }
 
 const (
@@ -53,9 +68,9 @@ func newConsumer(s *Sinker, gCfg *config.GroupConfig) *Consumer {
 	c := &Consumer{
 		sinker:    s,
 		numFlying: 0,
-		errCommit: false,
 		grpConfig: gCfg,
 		fetchesCh: make(chan *kgo.Fetches),
+		flushCh:   make(chan struct{}, 1),
 	}
 	c.state.Store(util.StateStopped)
 	c.commitDone = sync.NewCond(&c.mux)
@@ -63,6 +78,20 @@ func newConsumer(s *Sinker, gCfg *config.GroupConfig) *Consumer {
 }
 
 func (c *Consumer) addTask(tsk *Service) {
+	if chain := c.sinker.chains[tsk.taskCfg.Name]; chain != nil {
+		c.chains.Store(tsk.taskCfg.Name, chain)
+	} else {
+		c.chains.Delete(tsk.taskCfg.Name)
+	}
+	if splitter := parser.NewSplitter(tsk.taskCfg.Parser); splitter != nil {
+		c.splitters.Store(tsk.taskCfg.Name, splitter)
+	} else {
+		c.splitters.Delete(tsk.taskCfg.Name)
+	}
+	tsk.sink.SetPauser(c)
+	tsk.pp.SetRejectFunc(func(msg *model.InputMessage, err error) {
+		rejectParsed(tsk, msg, err)
+	})
 	c.tasks.Store(tsk.taskCfg.Name, tsk)
 }
 
@@ -71,9 +100,24 @@ func (c *Consumer) start() {
 		return
 	}
 	c.ctx, c.cancel = context.WithCancel(context.Background())
-	c.inputer = input.NewKafkaFranz()
+	c.openJournal()
+	inputer, err := input.NewInputer(c.grpConfig)
+	if err != nil {
+		util.Logger.Fatal("failed to create consumer", zap.String("consumer", c.grpConfig.Name), zap.Error(err))
+	}
 	c.state.Store(util.StateRunning)
-	if err := c.inputer.Init(c.sinker.curCfg, c.grpConfig, c.fetchesCh, c.cleanupFn); err == nil {
+	// each consumer commits on its own, a consumer paused for a spilled batch only holds back its own offsets
+	c.commitsCh = make(chan *Commit, 10)
+	c.errCommit.Store(false)
+	c.commitWg.Add(1)
+	go c.commitFn()
+	if err = inputer.Init(c.sinker.curCfg, c.grpConfig, c.fetchesCh, c.cleanupFn); err == nil {
+		c.mux.Lock()
+		c.inputer = inputer
+		if c.pauses > 0 {
+			inputer.Pause()
+		}
+		c.mux.Unlock()
 		go c.inputer.Run()
 		go c.processFetch()
 	} else {
@@ -82,15 +126,94 @@ func (c *Consumer) start() {
 }
 
 func (c *Consumer) stop() {
-	if c.state.Load() == util.StateStopped {
+	// a failed commit may stop the consumer while the sinker does
+	if !c.state.CompareAndSwap(util.StateRunning, util.StateStopped) {
 		return
 	}
-	c.state.Store(util.StateStopped)
 
 	// stop the processFetch routine, make sure no more input to the commit chan & writing pool
 	c.cancel()
 	c.processWg.Wait()
 	c.inputer.Stop()
+	// the Kafka input cleans up as its partitions are revoked, the other inputs don't
+	if !input.IsKafkaGroup(c.grpConfig) {
+		c.cleanupFn()
+	}
+	close(c.commitsCh)
+	c.commitWg.Wait()
+}
+
+// Pause stops consumption until every Pause has been matched by a Resume. A task pauses its consumer while it
+// has spilled batches.
+func (c *Consumer) Pause() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.pauses++; c.pauses == 1 {
+		if c.inputer != nil {
+			c.inputer.Pause()
+		}
+		statistics.ConsumerPaused.WithLabelValues(c.grpConfig.Name).Set(1)
+	}
+}
+
+func (c *Consumer) Resume() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.pauses == 0 {
+		return
+	}
+	if c.pauses--; c.pauses == 0 {
+		if c.inputer != nil {
+			c.inputer.Resume()
+		}
+		statistics.ConsumerPaused.WithLabelValues(c.grpConfig.Name).Set(0)
+	}
+}
+
+// Rewind makes the consumer read again from its last committed offsets, the flushes which aren't committed yet won't
+// be. A running consumer is restarted, a stopped one reads from there once started again.
+func (c *Consumer) Rewind() {
+	if c.errCommit.Swap(true) {
+		return
+	}
+	if c.state.Load() == util.StateRunning {
+		// avoid change the s.consumers outside of s.Run
+		go func() {
+			c.stop()
+			c.sinker.consumerRestartCh <- c
+		}()
+	}
+}
+
+// pauseByAdmin pauses or resumes on behalf of the admin API, which holds at most one pause. It returns whether
+// that changed anything.
+func (c *Consumer) pauseByAdmin(pause bool) bool {
+	c.mux.Lock()
+	changed := c.adminPaused != pause
+	c.adminPaused = pause
+	c.mux.Unlock()
+	if changed {
+		if pause {
+			c.Pause()
+		} else {
+			c.Resume()
+		}
+	}
+	return changed
+}
+
+func (c *Consumer) isAdminPaused() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.adminPaused
+}
+
+// flush asks processFetch to flush its buffer now, unless a flush is pending already.
+func (c *Consumer) flush() {
+	select {
+	case c.flushCh <- struct{}{}:
+	default:
+	}
 }
 
 func (c *Consumer) restart() {
@@ -105,7 +228,7 @@ func (c *Consumer) cleanupFn() {
 		wg.Add(1)
 		go func(t *Service) {
 			// drain ensure we have completeted persisting all received messages
-			t.clickhouse.Drain()
+			t.sink.Drain()
 			wg.Done()
 		}(value.(*Service))
 		return true
@@ -121,6 +244,81 @@ func (c *Consumer) cleanupFn() {
 	c.mux.Unlock()
 }
 
+// reject sends a record which a task can't take to the dead-letter queue, the task goes on with the next one.
+func reject(tsk *Service, stage string, rec *kgo.Record, err error) {
+	util.Logger.Warn("failed to "+stage+" record, sent to dead-letter queue",
+		zap.String("task", tsk.taskCfg.Name),
+		zap.String("topic", rec.Topic),
+		zap.Int32("partition", rec.Partition),
+		zap.Int64("offset", rec.Offset),
+		zap.Error(err))
+	statistics.ParseMsgsErrorTotal.WithLabelValues(tsk.taskCfg.Name).Inc()
+	dlq.Put(&dlq.Entry{
+		Task:      tsk.taskCfg.Name,
+		Stage:     stage,
+		Topic:     rec.Topic,
+		Partition: rec.Partition,
+		Offset:    rec.Offset,
+		Key:       rec.Key,
+		Value:     rec.Value,
+		Reason:    err.Error(),
+	})
+}
+
+// rejectParsed sends a message which failed to parse to the dead-letter queue, with the value the parser was given.
+// The task counts and logs parse errors itself.
+func rejectParsed(tsk *Service, msg *model.InputMessage, err error) {
+	dlq.Put(&dlq.Entry{
+		Task:      tsk.taskCfg.Name,
+		Stage:     dlq.StageParse,
+		Topic:     msg.Topic,
+		Partition: int32(msg.Partition),
+		Offset:    msg.Offset,
+		Key:       msg.Key,
+		Value:     msg.Value,
+		Reason:    err.Error(),
+	})
+}
+
+// commitFn commits the offsets of each flush once its batches have been written, in the order of the flushes.
+func (c *Consumer) commitFn() {
+	defer c.commitWg.Done()
+	for com := range c.commitsCh {
+		c.commitBusySince.Store(time.Now().UnixNano())
+		com.wg.Wait()
+
+		if !c.errCommit.Load() {
+		LOOP:
+			for i, value := range com.offsets {
+				for k, v := range value {
+					if err := c.inputer.CommitMessages(&model.InputMessage{Topic: i, Partition: int(k), Offset: v.End}); err != nil {
+						// restart the consumer when facing commit error
+						// error could be RebalanceInProgress, IllegalGeneration, UnknownMemberID
+						c.Rewind()
+						util.Logger.Warn("Batch.Commit failed, will restart later", zap.Error(err))
+						break LOOP
+					} else {
+						statistics.ConsumeOffsets.WithLabelValues(c.grpConfig.Name, i, strconv.Itoa(int(k))).Set(float64(v.End))
+					}
+				}
+			}
+			if !c.errCommit.Load() && com.journal != nil && com.seq != 0 {
+				if err := com.journal.ack(com.seq); err != nil {
+					util.Logger.Warn("failed to update flush journal", zap.String("group", com.group), zap.Error(err))
+				}
+			}
+		}
+		c.mux.Lock()
+		c.numFlying--
+		if c.numFlying == 0 {
+			c.commitDone.Broadcast()
+		}
+		c.mux.Unlock()
+		c.commitBusySince.Store(0)
+	}
+	util.Logger.Info("stopped committing loop", zap.String("consumer", c.grpConfig.Name))
+}
+
 func (c *Consumer) updateGroupConfig(g *config.GroupConfig) {
 	if c.state.Load() == util.StateStopped {
 		return
@@ -131,23 +329,77 @@ func (c *Consumer) updateGroupConfig(g *config.GroupConfig) {
 	c.cancel()
 	c.processWg.Wait()
 	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.openJournal()
 	go c.processFetch()
 }
 
+// openJournal opens the flush journal if a task of the consumer deduplicates inserts. The caller makes sure
+// processFetch isn't running. Offsets of the other inputs than Kafka start over with every run, so they have no use
+// for one.
+func (c *Consumer) openJournal() {
+	dedup := false
+	if input.IsKafkaGroup(c.grpConfig) {
+		c.tasks.Range(func(key, value any) bool {
+			dedup = value.(*Service).taskCfg.Deduplicate
+			return !dedup
+		})
+	}
+	if !dedup {
+		c.journal = nil
+		return
+	}
+	if c.journal != nil {
+		return
+	}
+	path := journalPath(c.sinker, c.grpConfig.Name)
+	j, err := openFlushJournal(path)
+	if err != nil {
+		util.Logger.Error("failed to open flush journal, a restart may write records again without deduplication",
+			zap.String("group", c.grpConfig.Name), zap.String("path", path), zap.Error(err))
+		return
+	}
+	c.journal = j
+}
+
 func (c *Consumer) processFetch() {
 	c.processWg.Add(1)
 	defer c.processWg.Done()
 	recMap := make(model.RecordMap)
 	var bufLength int
 
+	// flushes recorded before a restart are cut again at the same offsets
+	journal := c.journal
+	var cuts []*journalEntry
+	var cutSeq int64 // of the cut being flushed, which is in the journal already
+	var held []*kgo.Record
+	var cutDeadline time.Time
+	if journal != nil {
+		if cuts = journal.pending(); len(cuts) != 0 {
+			cutDeadline = time.Now().Add(replayCutTimeout)
+			util.Logger.Info("cutting flushes at the offsets recorded before restart", zap.String("group", c.grpConfig.Name),
+				zap.Int("flushes", len(cuts)))
+		}
+	}
+
 	flushFn := func() {
 		if len(recMap) == 0 {
 			return
 		}
+		seq := cutSeq
+		if journal != nil && seq == 0 {
+			var err error
+			if seq, err = journal.add(recMap); err != nil {
+				util.Logger.Error("failed to record flush, a restart may write it again without deduplication",
+					zap.String("group", c.grpConfig.Name), zap.Error(err))
+			}
+		}
 		var wg sync.WaitGroup
 		c.tasks.Range(func(key, value any) bool {
 			// flush to shard, ck
 			task := value.(*Service)
+			if task.clickhouse != nil {
+				task.clickhouse.SetFlushRanges(task.taskCfg.Topic, recMap[task.taskCfg.Topic], cutSeq != 0)
+			}
 			task.sharder.Flush(c.ctx, &wg, recMap[task.taskCfg.Topic])
 			return true
 		})
@@ -156,314 +408,208 @@ func (c *Consumer) processFetch() {
 		c.mux.Lock()
 		c.numFlying++
 		c.mux.Unlock()
-		c.sinker.commitsCh <- &Commit{group: c.grpConfig.Name, offsets: recMap, wg: &wg, consumer: c}
+		select {
+		case c.commitsCh <- &Commit{group: c.grpConfig.Name, offsets: recMap, wg: &wg, consumer: c, journal: journal, seq: seq}:
+		case <-c.ctx.Done():
+			// the commit loop may wait for spilled batches, the records are consumed again from the last commit
+			c.mux.Lock()
+			if c.numFlying--; c.numFlying == 0 {
+				c.commitDone.Broadcast()
+			}
+			c.mux.Unlock()
+		}
 		recMap = make(model.RecordMap)
 	}
 
-	bufThreshold := c.grpConfig.BufferSize * len(c.sinker.curCfg.Clickhouse.Hosts) * 4 / 5
-	if bufThreshold > MaxCountInBuf {
-		bufThreshold = MaxCountInBuf
-	}
-
-	ticker := time.NewTicker(time.Duration(c.grpConfig.FlushInterval) * time.Second)
-	defer ticker.Stop()
-	for {
-		select {
-		case fetches := <-c.fetchesCh:
-			if c.state.Load() == util.StateStopped {
-				continue
-			}
+	process := func(fetch []*kgo.Record) (err error) {
+		items, done := int64(len(fetch)), int64(-1)
+		var concurrency int
+		if concurrency = int(items/1000) + 1; concurrency > MaxParallelism {
+			concurrency = MaxParallelism
+		}
 
-			fetch := fetches.Records()
-			items, done := int64(len(fetch)), int64(-1)
-			var concurrency int
-			if concurrency = int(items/1000) + 1; concurrency > MaxParallelism {
-				concurrency = MaxParallelism
-			}
+		var wg sync.WaitGroup
+		wg.Add(concurrency)
+		for i := 0; i < concurrency; i++ {
+			go func() {
+				for {
+					index := atomic.AddInt64(&done, 1)
+					if index >= items || c.state.Load() == util.StateStopped {
+						wg.Done()
+						break
+					}
 
-			var wg sync.WaitGroup
-			var err error
-			wg.Add(concurrency)
-			for i := 0; i < concurrency; i++ {
-				go func() {
-					for {
-						index := atomic.AddInt64(&done, 1)
-						if index >= items || c.state.Load() == util.StateStopped {
-							wg.Done()
+					rec := fetch[index]
+					msg := &model.InputMessage{
+						Topic:     rec.Topic,
+						Partition: int(rec.Partition),
+						Key:       rec.Key,
+						Value:     rec.Value,
+						Offset:    rec.Offset,
+						Timestamp: &rec.Timestamp,
+					}
+					tablename := ""
+					for _, it := range rec.Headers {
+						if it.Key == "__table_name" {
+							tablename = string(it.Value)
 							break
 						}
+					}
 
-						rec := fetch[index]
-						var prettyJSON bytes.Buffer
-						err := json.Indent(&prettyJSON, rec.Value, "", "  ")
-						if err != nil {
-							return
-						}
-						var data map[string]interface{}
-						err = json.Unmarshal([]byte(prettyJSON.String()), &data)
-						if err != nil {
-							fmt.Println("Error unmarshaling JSON:", err)
-							return
-						}
-						if rec.Topic == "apache" || rec.Topic == "bsd_syslog" || rec.Topic == "http" {
-							hostname := []string{
-								"00c1ff47ea91",
-								"01386986dccd",
-								"013a3d45228b",
-								"0554031f7833",
-								"06880bf8d319",
-								"076ce06672ef",
-								"082c00bc249d",
-								"0842a4fd0786",
-								"0a9e2cfe29b2",
-								"0d1b7b71f312",
-								"1005ad71fd96",
-								"12ca26568852",
-								"13a63a8f754d",
-								"179a8134654b",
-								"187aeff3d2d3",
-								"19d7cb80485c",
-								"23429398a5f5",
-								"242f64596671",
-								"285db9d9cec4",
-								"2cb36eec97b7",
-								"2d298744911a",
-								"2d44edd99782",
-								"2e5fbb51f866",
-								"35f51e5c8bd8",
-								"36c7d513ad5c",
-								"3aa01894401f",
-								"3e361e23d683",
-								"002bbff4b128",
-								"017e2b579d4b",
-								"0184a70bbc2b",
-								"01f39a1fc780",
-								"0219458df459",
-								"029321d124e6",
-								"02cb0793ae12",
-								"035a012b83d0",
-								"056e75f83fa7",
-								"05fd0d3648ac",
-								"06ac0fefc43f",
-								"06b262ba9e77",
-								"08497e104734",
-								"0a9188cc6de8",
-								"0b42c75c6945",
-								"0bd852d6a30b",
-								"0c45318f14c5",
-								"0cbb02a208d8",
-								"3e5486a2224f",
-								"44b9280a30e4",
-								"46d558ab745a",
-								"474ba8a95866",
-								"47820b5000d6",
-								"49f5022c1227",
-								"4b1ee19b75bd",
-								"4c99fb7712c1",
-								"4e36e071ed02",
-								"4ed8e8e6f4aa",
-								"52056b33bac5",
-								"52ce82a66742",
-								"537b0e8a04d3",
-								"57b6b35def3f",
-								"5880fbc705aa",
-								"58fbe14991eb",
-								"5a85e5f96a46",
-								"5b3990247584",
-								"5b4cf04776a9",
-								"5c43f5690500",
-								"5d9732abd073",
-								"5e3c968129bd",
-								"602c7de79bff",
-								"60a61bc51d15",
-								"61c8d9cd8373",
-								"61f82ef2f952",
-								"6aa9f00537e3",
-								"6b12711f3aa3",
-								"6b145d9241db",
-								"6c6b62e09ee9",
-								"750a42c4f53e",
-								"75ef7f4bbcf1",
-								"7621ee6c938d",
-								"790b2b8fbdaa",
-								"797bf8b9091a",
-								"7a21f6f76927",
-								"7a50105d0d8b",
-								"7f025c678b27",
-								"8304da48cb58",
-								"89a13c966bd2",
-								"89ae97d220c6",
-								"89e54de130d6",
-								"8a3ca18a6026",
-								"8ab4b540b314",
-								"8ade18f4ddee",
-								"8b9c3f4e29f8",
-								"8c4383c74087",
-								"8ea6911d4e14",
-								"8fbff5931328",
-								"94242e2c0bb8",
-								"957eadf7a565",
-								"96d36894a986",
-								"99b739d10fd1",
-								"9aaf9b300af7",
-								"9c20da6181ca",
-							}
-							if rec.Topic == "apache" || rec.Topic == "bsd_syslog" || rec.Topic == "http" {
-								// fmt.Println("Topic", rec.Topic)
-								// fmt.Println("Data", data)
-								data["hostname"] = hostname[rand.Intn(len(hostname))]
-								data["log_type"] = rec.Topic
-								text := data["message"].(string)
-
-								_, err := regexp.Match(".*info.*", []byte(strings.ToLower(text)))
-								if err != nil {
-									fmt.Println("Error:", err)
-									return
-								} else {
-									data["log_level"] = "info"
-								}
-
-								_, err = regexp.Match(".*error.*|.*crit.*", []byte(strings.ToLower(text)))
-								if err != nil {
-									fmt.Println("Error:", err)
-									return
-								} else {
-									data["log_level"] = "error"
-								}
-
-								_, err = regexp.Match(".*debug.*", []byte(strings.ToLower(text)))
-								if err != nil {
-									fmt.Println("Error:", err)
-									return
-								} else {
-									data["log_level"] = "debug"
-								}
-
-								_, err = regexp.Match(".*trace.*", []byte(strings.ToLower(text)))
-								if err != nil {
-									fmt.Println("Error:", err)
-									return
-								} else {
-									data["log_level"] = "trace"
+					c.tasks.Range(func(key, value any) bool {
+						tsk := value.(*Service)
+						if (tablename != "" && tsk.clickhouse != nil && tsk.clickhouse.TableName == tablename) || tsk.taskCfg.Topic == rec.Topic {
+							tskMsg := msg
+							if chain, ok := c.chains.Load(tsk.taskCfg.Name); ok {
+								val, e := chain.(*transform.Chain).Process(rec)
+								if e != nil {
+									reject(tsk, dlq.StageTransform, rec, e)
+									return true
 								}
+								m := *msg
+								m.Value = val
+								tskMsg = &m
 							}
-
-						} else {
-
-							var prettyJSON bytes.Buffer
-							err := json.Indent(&prettyJSON, rec.Value, "", "  ")
-							if err == nil {
-								// fmt.Println("First aithe", prettyJSON.String())
-								var data map[string]interface{}
-								err := json.Unmarshal([]byte(prettyJSON.String()), &data)
-								if err != nil {
-									fmt.Println("Error unmarshaling JSON:", err)
-									return
-								}
-								// fmt.Println("Extracting tags and moving to parent")
-								for key, value := range data["tags"].(map[string]interface{}) {
-									data[key] = value
-								}
-
-								if _, ok := data["gauge"]; ok {
-									if gaugeValue, ok := data["gauge"].(map[string]interface{})["value"].(float64); ok {
-										data["gauge"] = float64(gaugeValue)
-									}
+							tskMsgs := []*model.InputMessage{tskMsg}
+							if splitter, ok := c.splitters.Load(tsk.taskCfg.Name); ok {
+								vals, e := splitter.(parser.Splitter).Split(tskMsg.Value)
+								if e != nil {
+									reject(tsk, dlq.StageParse, rec, e)
+									return true
 								}
-
-								if _, ok := data["counter"]; ok {
-									if gaugeValue, ok := data["counter"].(map[string]interface{})["value"].(float64); ok {
-										data["counter"] = float64(gaugeValue)
-									}
+								tskMsgs = make([]*model.InputMessage, len(vals))
+								for i, val := range vals {
+									m := *tskMsg
+									m.Value = val
+									tskMsgs[i] = &m
 								}
-								// rec.Value, err = json.Marshal(data)
-							}
-						}
-
-						rec.Value, err = json.MarshalIndent(data, "", "  ")
-						if err != nil {
-							fmt.Println("Error marshaling JSON:", err)
-							return
-						} else {
-							var newJSON bytes.Buffer
-							err := json.Indent(&newJSON, rec.Value, "", "  ")
-							if err == nil {
-								// fmt.Println("check log level", newJSON.String())
-							}
-						}
-
-						msg := &model.InputMessage{
-							Topic:     rec.Topic,
-							Partition: int(rec.Partition),
-							Key:       rec.Key,
-							Value:     rec.Value,
-							Offset:    rec.Offset,
-							Timestamp: &rec.Timestamp,
-						}
-						tablename := ""
-						for _, it := range rec.Headers {
-							if it.Key == "__table_name" {
-								tablename = string(it.Value)
-								break
 							}
-						}
-
-						c.tasks.Range(func(key, value any) bool {
-							tsk := value.(*Service)
-							if (tablename != "" && tsk.clickhouse.TableName == tablename) || tsk.taskCfg.Topic == rec.Topic {
+							for _, tskMsg := range tskMsgs {
 								bufLength++
-								if e := tsk.Put(msg, flushFn); e != nil {
+								if e := tsk.Put(tskMsg, flushFn); e != nil {
 									atomic.StoreInt64(&done, items)
 									err = e
 									return false
 								}
 							}
 							return true
-						})
-					}
-				}()
+						}
+						return true
+					})
+				}
+			}()
+		}
+		wg.Wait()
+
+		// record the latest offset in order
+		// assume the c.state was reset to stopped when facing error, so that further fetch won't get processed
+		if err == nil {
+			for _, rec := range fetch {
+				if recMap[rec.Topic] == nil {
+					recMap[rec.Topic] = make(map[int32]*model.BatchRange)
+				}
+				or, ok := recMap[rec.Topic][rec.Partition]
+				if !ok {
+					or = &model.BatchRange{Begin: math.MaxInt64, End: -1}
+					recMap[rec.Topic][rec.Partition] = or
+				}
+				if or.End < rec.Offset {
+					or.End = rec.Offset
+				}
+				if or.Begin > rec.Offset {
+					or.Begin = rec.Offset
+				}
 			}
-			wg.Wait()
+		}
+		return
+	}
 
-			// record the latest offset in order
-			// assume the c.state was reset to stopped when facing error, so that further fetch won't get processed
-			if err == nil {
-				for _, f := range *fetches {
-					for i := range f.Topics {
-						ft := &f.Topics[i]
-						if recMap[ft.Topic] == nil {
-							recMap[ft.Topic] = make(map[int32]*model.BatchRange)
-						}
-						for j := range ft.Partitions {
-							fpr := ft.Partitions[j].Records
-							if len(fpr) == 0 {
-								continue
-							}
-							lastOff := fpr[len(fpr)-1].Offset
-							firstOff := fpr[0].Offset
+	// replayCuts processes records up to the end of the recorded flushes, holding back the rest until the flush
+	// in progress is complete.
+	replayCuts := func(recs []*kgo.Record) (rest []*kgo.Record, err error) {
+		rest = append(held, recs...)
+		held = nil
+		for len(cuts) != 0 && len(rest) != 0 {
+			var in []*kgo.Record
+			in, rest = splitCut(cuts[0].Offsets, rest)
+			if err = process(in); err != nil {
+				return
+			}
+			if !cutComplete(cuts[0].Offsets, recMap, rest) {
+				held, rest = rest, nil
+				return
+			}
+			cutSeq = cuts[0].Seq
+			flushFn()
+			cutSeq = 0
+			cuts = cuts[1:]
+			cutDeadline = time.Now().Add(replayCutTimeout)
+		}
+		return
+	}
 
-							or, ok := recMap[ft.Topic][ft.Partitions[j].Partition]
-							if !ok {
-								or = &model.BatchRange{Begin: math.MaxInt64, End: -1}
-								recMap[ft.Topic][ft.Partitions[j].Partition] = or
-							}
-							if or.End < lastOff {
-								or.End = lastOff
-							}
-							if or.Begin > firstOff {
-								or.Begin = firstOff
-							}
-						}
-					}
+	// giveUpCuts goes on with usual flushes, a restart may then write records again without deduplication.
+	giveUpCuts := func() {
+		util.Logger.Warn("gave up cutting flushes at the offsets recorded before restart", zap.String("group", c.grpConfig.Name),
+			zap.Int("flushes", len(cuts)))
+		cuts = nil
+		if err := journal.reset(); err != nil {
+			util.Logger.Error("failed to reset flush journal", zap.String("group", c.grpConfig.Name), zap.Error(err))
+		}
+		recs := held
+		held = nil
+		if err := process(recs); err != nil {
+			util.Logger.Error("failed to process records", zap.String("group", c.grpConfig.Name), zap.Error(err))
+		}
+		flushFn()
+	}
+
+	// the cluster may be rebuilt with another number of shards
+	bufThreshold := func() int {
+		if n := c.grpConfig.BufferSize * pool.NumShard() * 4 / 5; n < MaxCountInBuf {
+			return n
+		}
+		return MaxCountInBuf
+	}
+
+	ticker := time.NewTicker(time.Duration(c.grpConfig.FlushInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case fetches := <-c.fetchesCh:
+			if c.state.Load() == util.StateStopped {
+				continue
+			}
+
+			fetch := fetches.Records()
+			var err error
+			if len(cuts) != 0 {
+				if fetch, err = replayCuts(fetch); err == nil && len(held) > bufThreshold() {
+					giveUpCuts()
 				}
 			}
+			if err == nil {
+				err = process(fetch)
+			}
 
-			if bufLength > bufThreshold {
+			if len(cuts) == 0 && bufLength > bufThreshold() {
 				flushFn()
 				ticker.Reset(time.Duration(c.grpConfig.FlushInterval) * time.Second)
 			}
 		case <-ticker.C:
+			if len(cuts) != 0 {
+				if time.Now().After(cutDeadline) {
+					giveUpCuts()
+				}
+				continue
+			}
+			flushFn()
+		case <-c.flushCh:
+			if len(cuts) != 0 {
+				continue
+			}
 			flushFn()
+			ticker.Reset(time.Duration(c.grpConfig.FlushInterval) * time.Second)
 		case <-c.ctx.Done():
 			util.Logger.Info("stopped processing loop", zap.String("group", c.grpConfig.Name))
 			return
@@ -0,0 +1,88 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/pool"
+	"github.com/housepower/clickhouse_sinker/util"
+	"go.uber.org/zap"
+)
+
+const (
+	// a commit waits for the writes of its batches, a longer wait means ClickHouse doesn't take them
+	commitStallTimeout = 5 * time.Minute
+	// how long readiness waits for the main loop, which is busy while applying a config
+	readyTimeout = 2 * time.Second
+)
+
+// Readiness is the body of /readyz.
+type Readiness struct {
+	Ready     bool                 `json:"ready"`
+	Reasons   []string             `json:"reasons,omitempty"`
+	Replicas  []pool.ReplicaHealth `json:"replicas"`
+	Consumers map[string]string    `json:"consumers"` // name -> state
+	// since when the longest waiting commitFn waits for a commit, if any does
+	CommitBusySince *time.Time `json:"commitBusySince,omitempty"`
+}
+
+// Healthz tells the process is up and serving. A sinker which can't do its job is reported by Readyz instead,
+// restarting it doesn't help while ClickHouse or Kafka are down.
+func (s *Sinker) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// Readyz tells whether every shard has a healthy replica, every consumer is running and commits make progress.
+func (s *Sinker) Readyz(w http.ResponseWriter, r *http.Request) {
+	rd := s.readiness()
+	w.Header().Set("Content-Type", "application/json")
+	if !rd.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(rd); err != nil {
+		util.Logger.Warn("failed to write readiness", zap.Error(err))
+	}
+}
+
+func (s *Sinker) readiness() (rd Readiness) {
+	rd.Replicas = pool.ReplicaHealths()
+	if ok, badShards := pool.ShardsReady(); !ok {
+		if len(badShards) == 0 {
+			rd.Reasons = append(rd.Reasons, "not connected to ClickHouse")
+		}
+		for _, shard := range badShards {
+			rd.Reasons = append(rd.Reasons, fmt.Sprintf("no healthy replica in shard %d", shard))
+		}
+	}
+
+	_, err := s.execAdminTimeout(func() (interface{}, error) {
+		rd.Consumers = make(map[string]string, len(s.consumers))
+		for name, c := range s.consumers {
+			if c.state.Load() == util.StateRunning {
+				rd.Consumers[name] = "running"
+			} else {
+				rd.Consumers[name] = "stopped"
+				rd.Reasons = append(rd.Reasons, fmt.Sprintf("consumer %s is not running", name))
+			}
+			if since := c.commitBusySince.Load(); since != 0 {
+				t := time.Unix(0, since)
+				if rd.CommitBusySince == nil || t.Before(*rd.CommitBusySince) {
+					rd.CommitBusySince = &t
+				}
+				if time.Since(t) > commitStallTimeout {
+					rd.Reasons = append(rd.Reasons, fmt.Sprintf("consumer %s made no commit since %s", name, t.Format(time.RFC3339)))
+				}
+			}
+		}
+		return nil, nil
+	}, readyTimeout)
+	if err != nil {
+		rd.Reasons = append(rd.Reasons, err.Error())
+	}
+
+	rd.Ready = len(rd.Reasons) == 0
+	return
+}
@@ -0,0 +1,165 @@
+package task
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultJournalDir = "spill"
+	// a replayed cut not complete by then is given up, e.g. its partitions went to another instance
+	replayCutTimeout = time.Minute
+)
+
+// flushJournal records the offsets of the flushes of a consumer group which haven't been committed. After a crash
+// or a commit error the consumer cuts its first flushes at the same offsets, so that the batches it writes again
+// carry the same deduplication tokens.
+type flushJournal struct {
+	path    string
+	mux     sync.Mutex
+	seq     int64
+	entries []*journalEntry
+}
+
+type journalEntry struct {
+	Seq     int64
+	Offsets model.RecordMap
+}
+
+func journalPath(s *Sinker, group string) string {
+	dir := defaultJournalDir
+	if s.curCfg.Spill != nil && s.curCfg.Spill.Dir != "" {
+		dir = s.curCfg.Spill.Dir
+	}
+	return filepath.Join(dir, "_flushes", group+".json")
+}
+
+func openFlushJournal(path string) (j *flushJournal, err error) {
+	j = &flushJournal{path: path}
+	var data []byte
+	if data, err = os.ReadFile(path); err == nil {
+		if err = json.Unmarshal(data, &j.entries); err != nil {
+			// the journal only helps deduplication, a broken one is dropped
+			util.Logger.Warn("dropped unreadable flush journal", zap.String("path", path), zap.Error(err))
+			j.entries = nil
+		}
+		if n := len(j.entries); n != 0 {
+			j.seq = j.entries[n-1].Seq
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "")
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, errors.Wrapf(err, "")
+	}
+	return j, nil
+}
+
+// pending returns the flushes to cut again, oldest first.
+func (j *flushJournal) pending() []*journalEntry {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	return append([]*journalEntry(nil), j.entries...)
+}
+
+// add records a flush before its batches are sent, and returns its sequence number.
+func (j *flushJournal) add(offsets model.RecordMap) (seq int64, err error) {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	j.seq++
+	j.entries = append(j.entries, &journalEntry{Seq: j.seq, Offsets: offsets})
+	return j.seq, j.save()
+}
+
+// ack forgets a flush once its offsets have been committed, together with any older one.
+func (j *flushJournal) ack(seq int64) (err error) {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	i := 0
+	for i < len(j.entries) && j.entries[i].Seq <= seq {
+		i++
+	}
+	if i == 0 {
+		return
+	}
+	j.entries = j.entries[i:]
+	return j.save()
+}
+
+// reset forgets all flushes, after the consumer gave up cutting them again.
+func (j *flushJournal) reset() (err error) {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	j.entries = nil
+	return j.save()
+}
+
+// save replaces the journal file atomically. The caller holds j.mux.
+func (j *flushJournal) save() (err error) {
+	var data []byte
+	if data, err = json.Marshal(j.entries); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	tmp := j.path + ".tmp"
+	var f *os.File
+	if f, err = os.Create(tmp); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		err = errors.Wrapf(err, "failed to save flush journal %s", j.path)
+	}
+	return
+}
+
+// splitCut splits records into those of the cut, up to its end offset in every partition, and the rest.
+func splitCut(cut model.RecordMap, recs []*kgo.Record) (in, rest []*kgo.Record) {
+	for _, rec := range recs {
+		if r, ok := cut[rec.Topic][rec.Partition]; ok && rec.Offset <= r.End {
+			in = append(in, rec)
+		} else {
+			rest = append(rest, rec)
+		}
+	}
+	return
+}
+
+// cutComplete tells whether every partition of the cut reached its end offset, or went past it in rest because the
+// end record is gone, e.g. compacted away.
+func cutComplete(cut, recMap model.RecordMap, rest []*kgo.Record) bool {
+	past := make(map[string]map[int32]bool)
+	for _, rec := range rest {
+		if r, ok := cut[rec.Topic][rec.Partition]; ok && rec.Offset > r.End {
+			if past[rec.Topic] == nil {
+				past[rec.Topic] = make(map[int32]bool)
+			}
+			past[rec.Topic][rec.Partition] = true
+		}
+	}
+	for topic, ranges := range cut {
+		for p, r := range ranges {
+			if got, ok := recMap[topic][p]; (!ok || got.End < r.End) && !past[topic][p] {
+				return false
+			}
+		}
+	}
+	return true
+}
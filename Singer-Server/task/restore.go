@@ -0,0 +1,266 @@
+package task
+
+import (
+	"bufio"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/archive"
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/output"
+	"github.com/housepower/clickhouse_sinker/pool"
+	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultRestoreParallelism = 4
+	DefaultRestoreBatchSize   = 100000
+
+	restoreProgressInterval = 10 * time.Second
+)
+
+// RestoreOptions selects the archived objects to restore and where to.
+type RestoreOptions struct {
+	Task        string
+	Table       string // the table of the task if empty
+	From, To    time.Time
+	Parallelism int
+	BatchSize   int
+	StateFile   string // keys of the restored objects, a rerun skips them
+}
+
+type restorer struct {
+	store     archive.Store
+	ck        *output.ClickHouse
+	state     *restoreState
+	batchSize int
+	batchIdx  atomic.Int64
+
+	total                            int
+	objects, rows, skipped, failures atomic.Int64
+}
+
+// Restore reloads the objects archived by a task into ClickHouse, through the write path of consumed data.
+func Restore(cfg *config.Config, opts *RestoreOptions) (err error) {
+	if cfg.Archive == nil {
+		return errors.Newf("no archive configured")
+	}
+	var taskCfg *config.TaskConfig
+	for _, t := range cfg.Tasks {
+		if t.Name == opts.Task {
+			taskCfg = t
+			break
+		}
+	}
+	if taskCfg == nil {
+		return errors.Newf("task %s not found", opts.Task)
+	}
+
+	var store archive.Store
+	if store, err = archive.NewStore(cfg.Archive); err != nil {
+		return
+	}
+	var keys []string
+	if keys, err = archive.ListObjects(store, cfg.Archive, opts.Task, opts.From, opts.To); err != nil {
+		return
+	}
+	var state *restoreState
+	if state, err = openRestoreState(opts.StateFile); err != nil {
+		return
+	}
+	defer state.close()
+	todo := keys[:0:0]
+	for _, key := range keys {
+		if !state.isDone(key) {
+			todo = append(todo, key)
+		}
+	}
+	util.Logger.Info("restoring archived objects", zap.String("task", opts.Task), zap.Time("from", opts.From),
+		zap.Time("to", opts.To), zap.Int("objects", len(keys)), zap.Int("restored before", len(keys)-len(todo)))
+	if len(todo) == 0 {
+		return
+	}
+
+	if err = pool.InitClusterConn(&cfg.Clickhouse); err != nil {
+		return
+	}
+	defer pool.CloseAll()
+	rstCfg := *taskCfg
+	// a name of its own, the spill files of a running sinker are left alone
+	rstCfg.Name = "restore_" + taskCfg.Name
+	if opts.Table != "" {
+		rstCfg.TableName = opts.Table
+	}
+	// archived columns are named after the table, and the series of a Prometheus schema aren't archived
+	rstCfg.AutoSchema = true
+	rstCfg.PrometheusSchema = false
+	ck := output.NewClickHouse(cfg, &rstCfg)
+	if err = ck.Init(); err != nil {
+		return
+	}
+
+	r := &restorer{
+		store:     store,
+		ck:        ck,
+		state:     state,
+		batchSize: opts.BatchSize,
+		total:     len(todo),
+	}
+	if r.batchSize <= 0 {
+		r.batchSize = DefaultRestoreBatchSize
+	}
+	parallelism := opts.Parallelism
+	if parallelism <= 0 {
+		parallelism = DefaultRestoreParallelism
+	}
+
+	begin := time.Now()
+	stopProgress := make(chan struct{})
+	go r.reportProgress(begin, stopProgress)
+	keyCh := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keyCh {
+				if e := r.restoreObject(key); e != nil {
+					r.failures.Add(1)
+					util.Logger.Error("failed to restore object", zap.String("key", key), zap.Error(e))
+				}
+			}
+		}()
+	}
+	for _, key := range todo {
+		keyCh <- key
+	}
+	close(keyCh)
+	wg.Wait()
+	close(stopProgress)
+	ck.Drain()
+
+	util.Logger.Info("restored archived objects", zap.String("task", opts.Task),
+		zap.Int64("objects", r.objects.Load()), zap.Int64("failed", r.failures.Load()),
+		zap.Int64("rows", r.rows.Load()), zap.Int64("skipped rows", r.skipped.Load()),
+		zap.Duration("took", time.Since(begin)))
+	if n := r.failures.Load(); n != 0 {
+		err = errors.Newf("failed to restore %d objects, run again to retry them", n)
+	}
+	return
+}
+
+// restoreObject sends the rows of an object in batches, and marks it done once they have all been written.
+func (r *restorer) restoreObject(key string) (err error) {
+	var data []byte
+	if data, err = r.store.Get(key); err != nil {
+		return
+	}
+	var rows model.Rows
+	var skipped int
+	if rows, skipped, err = archive.Decode(key, data, r.ck.Dims); err != nil {
+		return
+	}
+	if skipped != 0 {
+		util.Logger.Warn("skipped archived rows not matching the table", zap.String("key", key), zap.Int("rows", skipped))
+	}
+	var wg sync.WaitGroup
+	for begin := 0; begin < len(rows); begin += r.batchSize {
+		end := begin + r.batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		batchRows := rows[begin:end]
+		wg.Add(1)
+		r.ck.Send(&model.Batch{
+			Rows:     &batchRows,
+			BatchIdx: r.batchIdx.Add(1),
+			RealSize: len(batchRows),
+			Wg:       &wg,
+			// the rows come from the archive
+			NoArchive: true,
+		})
+	}
+	// a batch which failed all retries is done once it has been replayed
+	wg.Wait()
+	if err = r.state.markDone(key); err != nil {
+		return
+	}
+	r.objects.Add(1)
+	r.rows.Add(int64(len(rows)))
+	r.skipped.Add(int64(skipped))
+	return
+}
+
+func (r *restorer) reportProgress(begin time.Time, stop chan struct{}) {
+	ticker := time.NewTicker(restoreProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rows := r.rows.Load()
+			util.Logger.Info("restore progress",
+				zap.Int64("objects", r.objects.Load()), zap.Int("total", r.total),
+				zap.Int64("failed", r.failures.Load()), zap.Int64("rows", rows),
+				zap.Float64("rows/s", float64(rows)/time.Since(begin).Seconds()))
+		case <-stop:
+			return
+		}
+	}
+}
+
+// restoreState appends the key of every restored object to a file.
+type restoreState struct {
+	mux  sync.Mutex
+	f    *os.File
+	done map[string]struct{}
+}
+
+func openRestoreState(path string) (st *restoreState, err error) {
+	st = &restoreState{done: make(map[string]struct{})}
+	var f *os.File
+	if f, err = os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if key := scanner.Text(); key != "" {
+				st.done[key] = struct{}{}
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read restore state %s", path)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "")
+	}
+	if st.f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644); err != nil {
+		return nil, errors.Wrapf(err, "")
+	}
+	return
+}
+
+func (st *restoreState) isDone(key string) bool {
+	_, ok := st.done[key]
+	return ok
+}
+
+func (st *restoreState) markDone(key string) (err error) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	if _, err = st.f.WriteString(key + "\n"); err == nil {
+		err = st.f.Sync()
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "failed to record restored object %s", key)
+	}
+	return
+}
+
+func (st *restoreState) close() {
+	st.f.Close()
+}
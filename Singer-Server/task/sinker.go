@@ -6,7 +6,6 @@ import (
 	"os"
 	"reflect"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -34,15 +33,16 @@ type Sinker struct {
 	httpAddr string
 	numCfg   int
 	pusher   *statistics.Pusher
+	lag      *input.LagCollector
 	rcm      cm.RemoteConfManager
 	ctx      context.Context
 	cancel   context.CancelFunc
 
 	consumers         map[string]*Consumer
-	commitsCh         chan *Commit
+	chains            map[string]*transform.Chain // of the tasks of the config being applied, nil if none
 	exitCh            chan struct{}
-	stopCommitCh      chan struct{}
 	consumerRestartCh chan *Consumer
+	adminCh           chan *adminCmd
 }
 
 func NewSinker(rcm cm.RemoteConfManager, http string, cmd *util.CmdOptions) *Sinker {
@@ -52,10 +52,9 @@ func NewSinker(rcm cm.RemoteConfManager, http string, cmd *util.CmdOptions) *Sin
 		ctx:               ctx,
 		cmdOps:            cmd,
 		cancel:            cancel,
-		commitsCh:         make(chan *Commit, 10),
 		exitCh:            make(chan struct{}),
-		stopCommitCh:      make(chan struct{}),
 		consumerRestartCh: make(chan *Consumer),
+		adminCh:           make(chan *adminCmd),
 		consumers:         make(map[string]*Consumer),
 		httpAddr:          http,
 	}
@@ -125,13 +124,18 @@ func (s *Sinker) Run() {
 						cloneTask(value.(*Service), newGroup)
 						return true
 					})
+					if c.isAdminPaused() {
+						newGroup.pauseByAdmin(true)
+					}
 					newGroup.start()
-					util.Logger.Info("consumer restarted because of previous offset commit error",
+					util.Logger.Info("consumer restarted from the last committed offsets",
 						zap.String("consumer", c.grpConfig.Name))
 				} else {
 					util.Logger.Info("consumer restarted when applying another config",
 						zap.String("consumer", c.grpConfig.Name))
 				}
+			case cmd := <-s.adminCh:
+				s.handleAdmin(cmd)
 			case <-reloadBmSeriesTicker.C:
 				util.Logger.Info("offloading out-of-date series record")
 				if err = s.reloadBmSeries(); err != nil {
@@ -189,13 +193,18 @@ func (s *Sinker) Run() {
 						cloneTask(value.(*Service), newGroup)
 						return true
 					})
+					if c.isAdminPaused() {
+						newGroup.pauseByAdmin(true)
+					}
 					newGroup.start()
-					util.Logger.Info("consumer restarted because of previous offset commit error",
+					util.Logger.Info("consumer restarted from the last committed offsets",
 						zap.String("consumer", c.grpConfig.Name))
 				} else {
 					util.Logger.Info("consumer restarted when applying another config",
 						zap.String("consumer", c.grpConfig.Name))
 				}
+			case cmd := <-s.adminCh:
+				s.handleAdmin(cmd)
 			case <-reloadBmSeriesTicker.C:
 				util.Logger.Info("offloading out-of-date series record")
 				if err = s.reloadBmSeries(); err != nil {
@@ -220,6 +229,12 @@ func (s *Sinker) Close() {
 	<-s.exitCh
 	// 3. Stop tasks gracefully.
 	s.stopAllTasks()
+	dlq.Close()
+	archive.Close()
+	if s.lag != nil {
+		s.lag.Stop()
+		s.lag = nil
+	}
 	// 4. Stop pusher
 	if s.pusher != nil {
 		s.pusher.Stop()
@@ -242,12 +257,6 @@ func (s *Sinker) stopAllTasks() {
 	wg.Wait()
 	util.Logger.Info("stopped all consumers")
 
-	select {
-	case s.stopCommitCh <- struct{}{}:
-	default:
-	}
-	util.Logger.Debug("stopped commit session")
-
 	for name := range s.consumers {
 		delete(s.consumers, name)
 	}
@@ -257,7 +266,24 @@ func (s *Sinker) stopAllTasks() {
 }
 
 func (s *Sinker) applyConfig(newCfg *config.Config) (err error) {
+	// a bad transform spec rejects the config before anything is changed
+	if err = s.buildChains(newCfg); err != nil {
+		return
+	}
 	util.SetLogLevel(newCfg.LogLevel)
+	if s.curCfg != nil && (!reflect.DeepEqual(newCfg.DeadLetter, s.curCfg.DeadLetter) ||
+		!reflect.DeepEqual(newCfg.Kafka, s.curCfg.Kafka) || !reflect.DeepEqual(newCfg.Clickhouse, s.curCfg.Clickhouse)) {
+		if err = dlq.Init(newCfg); err != nil {
+			return
+		}
+		s.curCfg.DeadLetter = newCfg.DeadLetter
+	}
+	if s.curCfg != nil && !reflect.DeepEqual(newCfg.Archive, s.curCfg.Archive) {
+		if err = archive.Init(newCfg); err != nil {
+			return
+		}
+		s.curCfg.Archive = newCfg.Archive
+	}
 	if s.curCfg == nil {
 		// The first time invoking of applyConfig
 		err = s.applyFirstConfig(newCfg)
@@ -267,6 +293,9 @@ func (s *Sinker) applyConfig(newCfg *config.Config) (err error) {
 		!reflect.DeepEqual(newCfg.Assignment.Map, s.curCfg.Assignment.Map) {
 		err = s.applyAnotherConfig(newCfg)
 	}
+	if err == nil {
+		err = s.applyLagMonitor(newCfg)
+	}
 	s.curCfg.ActiveSeriesRange = newCfg.ActiveSeriesRange
 	s.curCfg.ReloadSeriesMapInterval = newCfg.ReloadSeriesMapInterval
 
@@ -276,6 +305,20 @@ func (s *Sinker) applyConfig(newCfg *config.Config) (err error) {
 	return
 }
 
+// buildChains builds the transform chains of the tasks of a config, which the consumers take as the tasks are added.
+func (s *Sinker) buildChains(newCfg *config.Config) (err error) {
+	chains := make(map[string]*transform.Chain, len(newCfg.Tasks))
+	for _, taskCfg := range newCfg.Tasks {
+		var chain *transform.Chain
+		if chain, err = transform.NewChain(taskCfg); err != nil {
+			return
+		}
+		chains[taskCfg.Name] = chain
+	}
+	s.chains = chains
+	return
+}
+
 func (s *Sinker) applyFirstConfig(newCfg *config.Config) (err error) {
 	util.Logger.Info("going to apply the first config", zap.Any("config", newCfg))
 	// 1. Initialize clickhouse connections
@@ -283,11 +326,14 @@ func (s *Sinker) applyFirstConfig(newCfg *config.Config) (err error) {
 	if err = pool.InitClusterConn(chCfg); err != nil {
 		return
 	}
+	if err = dlq.Init(newCfg); err != nil {
+		return
+	}
+	if err = archive.Init(newCfg); err != nil {
+		return
+	}
 
-	// 2. Start goroutine pools.
-	go s.commitFn()
-
-	// 3. Generate, initialize and run task
+	// 2. Generate, initialize and run task
 	s.curCfg = newCfg
 	for group, grpCfg := range newCfg.Groups {
 		c := newConsumer(s, grpCfg)
@@ -324,9 +370,8 @@ func (s *Sinker) applyAnotherConfig(newCfg *config.Config) (err error) {
 		}
 
 		// 3. Restart goroutine pools.
-		maxWorkers := len(newCfg.Clickhouse.Hosts) * newCfg.Clickhouse.MaxOpenConns
+		maxWorkers := pool.NumShard() * newCfg.Clickhouse.MaxOpenConns
 		util.Logger.Info("resized writing pool", zap.Int("maxWorkers", maxWorkers))
-		go s.commitFn()
 
 		// 4. Generate, initialize and run task
 		var tasksToStart []string
@@ -385,8 +430,11 @@ func (s *Sinker) applyAnotherConfig(newCfg *config.Config) (err error) {
 		}
 		// 1) stop consumers no longer with newcfg
 		var wg sync.WaitGroup
+		// a consumer paused by the admin API stays paused when recreated
+		adminPaused := make(map[string]bool)
 		for _, v := range deleteConsumers {
 			c := s.consumers[v]
+			adminPaused[v] = c.isAdminPaused()
 			if c.state.Load() == util.StateRunning {
 				wg.Add(1)
 				go func(c *Consumer) {
@@ -410,6 +458,9 @@ func (s *Sinker) applyAnotherConfig(newCfg *config.Config) (err error) {
 						return
 					}
 				}
+				if adminPaused[v.Name] {
+					c.pauseByAdmin(true)
+				}
 				s.consumers[v.Name] = c
 			}
 		}
@@ -426,44 +477,24 @@ func (s *Sinker) applyAnotherConfig(newCfg *config.Config) (err error) {
 	return
 }
 
-func (s *Sinker) commitFn() {
-	for {
-		select {
-		case com := <-s.commitsCh:
-			com.wg.Wait()
-			c := com.consumer
-
-			if !c.errCommit {
-			LOOP:
-				for i, value := range com.offsets {
-					for k, v := range value {
-						if err := c.inputer.CommitMessages(&model.InputMessage{Topic: i, Partition: int(k), Offset: v.End}); err != nil {
-							c.errCommit = true
-							// restart the consumer when facing commit error, avoid change the s.consumers outside of s.Run
-							// error could be RebalanceInProgress, IllegalGeneration, UnknownMemberID
-							go func() {
-								c.stop()
-								s.consumerRestartCh <- c
-							}()
-							util.Logger.Warn("Batch.Commit failed, will restart later", zap.Error(err))
-							break LOOP
-						} else {
-							statistics.ConsumeOffsets.WithLabelValues(com.consumer.grpConfig.Name, i, strconv.Itoa(int(k))).Set(float64(v.End))
-						}
-					}
-				}
-			}
-			c.mux.Lock()
-			c.numFlying--
-			if c.numFlying == 0 {
-				c.commitDone.Broadcast()
-			}
-			c.mux.Unlock()
-		case <-s.stopCommitCh:
-			util.Logger.Info("stopped committing loop")
+// applyLagMonitor (re)starts the lag collector when the consumer groups or its config change.
+func (s *Sinker) applyLagMonitor(newCfg *config.Config) (err error) {
+	if s.lag != nil {
+		if !s.lag.Changed(newCfg) {
 			return
 		}
+		s.lag.Stop()
+		s.lag = nil
 	}
+	if newCfg.LagMonitor == nil || len(newCfg.Groups) == 0 {
+		return
+	}
+	if s.lag, err = input.NewLagCollector(newCfg); err != nil {
+		return
+	}
+	s.lag.Start()
+	util.Logger.Info("started lag collector", zap.Int("consumer groups", len(newCfg.Groups)))
+	return
 }
 
 func (s *Sinker) initBmSeries() (err error) {
@@ -471,6 +502,9 @@ func (s *Sinker) initBmSeries() (err error) {
 	tables := make(map[string][]*Service)
 	for _, c := range s.consumers {
 		c.tasks.Range(func(key, value any) bool {
+			if value.(*Service).clickhouse == nil {
+				return true
+			}
 			k := value.(*Service).clickhouse.GetSeriesQuotaKey()
 			if k != "" {
 				tables[k] = append(tables[k], value.(*Service))
@@ -543,6 +577,9 @@ func (s *Sinker) reloadBmSeries() (err error) {
 	tables := make(map[string][]*Service)
 	for _, c := range s.consumers {
 		c.tasks.Range(func(key, value any) bool {
+			if value.(*Service).clickhouse == nil {
+				return true
+			}
 			k := value.(*Service).clickhouse.GetSeriesQuotaKey()
 			if _, ok := sqMap[k]; ok {
 				tables[k] = append(tables[k], value.(*Service))
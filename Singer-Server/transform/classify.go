@@ -0,0 +1,180 @@
+package transform
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/statistics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/thanos/pkg/errors"
+)
+
+const (
+	LevelTrace = "trace"
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+	LevelFatal = "fatal"
+)
+
+var (
+	_ Transformer = (*Classifier)(nil)
+
+	// DefaultClassifierRules are checked from the most to the least severe level.
+	DefaultClassifierRules = []config.ClassifierRule{
+		{Level: LevelFatal, Pattern: `(?i)\b(fatal|panic|emerg(ency)?|alert|crit(ical)?)\b`},
+		{Level: LevelError, Pattern: `(?i)\b(err(or)?|exception|fail(ed|ure)?)\b`},
+		{Level: LevelWarn, Pattern: `(?i)\bwarn(ing)?\b`},
+		{Level: LevelInfo, Pattern: `(?i)\b(info|notice)\b`},
+		{Level: LevelDebug, Pattern: `(?i)\bdebug\b`},
+		{Level: LevelTrace, Pattern: `(?i)\btrace\b`},
+	}
+
+	// syslogSeverities maps the RFC 5424 severity (PRI % 8) to a level.
+	syslogSeverities = [8]string{LevelFatal, LevelFatal, LevelFatal, LevelError, LevelWarn, LevelInfo, LevelInfo, LevelDebug}
+)
+
+type classifierRule struct {
+	level string
+	re    *regexp.Regexp
+}
+
+// Classifier sets the log level of a record.
+type Classifier struct {
+	field       string
+	source      string
+	syslog      bool
+	statusField string
+	rules       []classifierRule
+	dflt        string
+	counters    map[string]prometheus.Counter
+}
+
+func NewClassifier(taskName string, cfg *config.ClassifierConfig) (c *Classifier, err error) {
+	c = &Classifier{
+		field:       cfg.Field,
+		source:      cfg.Source,
+		syslog:      cfg.Syslog,
+		statusField: cfg.StatusField,
+		dflt:        cfg.Default,
+		counters:    make(map[string]prometheus.Counter),
+	}
+	if c.field == "" {
+		c.field = "log_level"
+	}
+	if c.source == "" {
+		c.source = "message"
+	}
+	if c.dflt == "" {
+		c.dflt = LevelInfo
+	}
+	rules := cfg.Rules
+	if len(rules) == 0 {
+		rules = DefaultClassifierRules
+	}
+	for _, r := range rules {
+		var re *regexp.Regexp
+		if r.Level == "" {
+			err = errors.Newf("classifier rule %q has no level", r.Pattern)
+			return
+		}
+		if re, err = regexp.Compile(r.Pattern); err != nil {
+			err = errors.Wrapf(err, "classifier rule of level %s", r.Level)
+			return
+		}
+		c.rules = append(c.rules, classifierRule{level: r.Level, re: re})
+	}
+	// resolve the counters up front, the label set is known and small
+	levels := append(syslogSeverities[:], LevelWarn, c.dflt)
+	for _, r := range c.rules {
+		levels = append(levels, r.level)
+	}
+	for _, l := range levels {
+		if _, ok := c.counters[l]; !ok {
+			c.counters[l] = statistics.ClassifiedLevelsTotal.WithLabelValues(taskName, l)
+		}
+	}
+	return
+}
+
+func (c *Classifier) Transform(rec *Record) error {
+	level := c.Classify(rec.Data)
+	rec.Data[c.field] = level
+	c.counters[level].Inc()
+	return nil
+}
+
+// Classify returns the level of the decoded record.
+func (c *Classifier) Classify(data map[string]interface{}) string {
+	text, _ := data[c.source].(string)
+	if c.syslog {
+		if sev, ok := syslogSeverity(text); ok {
+			return syslogSeverities[sev]
+		}
+	}
+	if c.statusField != "" {
+		if status, ok := httpStatus(data[c.statusField]); ok {
+			return statusLevel(status)
+		}
+	}
+	if text != "" {
+		for _, r := range c.rules {
+			if r.re.MatchString(text) {
+				return r.level
+			}
+		}
+	}
+	return c.dflt
+}
+
+// syslogSeverity decodes the "<PRI>" prefix of a syslog message.
+func syslogSeverity(text string) (sev int, ok bool) {
+	if len(text) < 3 || text[0] != '<' {
+		return
+	}
+	end := strings.IndexByte(text, '>')
+	if end < 2 || end > 4 {
+		return
+	}
+	pri, err := strconv.Atoi(text[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return
+	}
+	return pri % 8, true
+}
+
+func httpStatus(v interface{}) (status int, ok bool) {
+	var err error
+	switch val := v.(type) {
+	case json.Number:
+		var i int64
+		if i, err = val.Int64(); err == nil {
+			status = int(i)
+		}
+	case float64:
+		status = int(val)
+	case string:
+		status, err = strconv.Atoi(strings.TrimSpace(val))
+	default:
+		return
+	}
+	if err != nil || status < 100 || status > 599 {
+		return
+	}
+	return status, true
+}
+
+func statusLevel(status int) string {
+	switch {
+	case status >= 500:
+		return LevelError
+	case status >= 400:
+		return LevelWarn
+	default:
+		return LevelInfo
+	}
+}
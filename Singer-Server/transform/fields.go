@@ -0,0 +1,179 @@
+package transform
+
+import (
+	"regexp"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/thanos-io/thanos/pkg/errors"
+)
+
+var (
+	_ Transformer = (*addField)(nil)
+	_ Transformer = (*rename)(nil)
+	_ Transformer = (*flatten)(nil)
+	_ Transformer = (*unwrap)(nil)
+	_ Transformer = (*drop)(nil)
+	_ Transformer = (*regexExtract)(nil)
+)
+
+type addField struct {
+	field string
+	value interface{}
+}
+
+func newAddField(cfg *config.TransformConfig) (t Transformer, err error) {
+	if cfg.Field == "" {
+		err = errors.Newf("%s requires field", cfg.Type)
+		return
+	}
+	return &addField{field: cfg.Field, value: cfg.Value}, nil
+}
+
+func (t *addField) Transform(rec *Record) error {
+	rec.Data[t.field] = t.value
+	return nil
+}
+
+type rename struct {
+	field  string
+	target string
+}
+
+func newRename(cfg *config.TransformConfig) (t Transformer, err error) {
+	if cfg.Field == "" || cfg.Target == "" {
+		err = errors.Newf("%s requires field and target", cfg.Type)
+		return
+	}
+	return &rename{field: cfg.Field, target: cfg.Target}, nil
+}
+
+func (t *rename) Transform(rec *Record) error {
+	if v, ok := rec.Data[t.field]; ok {
+		delete(rec.Data, t.field)
+		rec.Data[t.target] = v
+	}
+	return nil
+}
+
+type flatten struct {
+	field  string
+	prefix string
+}
+
+func newFlatten(cfg *config.TransformConfig) (t Transformer, err error) {
+	if cfg.Field == "" {
+		err = errors.Newf("%s requires field", cfg.Type)
+		return
+	}
+	return &flatten{field: cfg.Field, prefix: cfg.Prefix}, nil
+}
+
+func (t *flatten) Transform(rec *Record) error {
+	obj, ok := rec.Data[t.field].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	delete(rec.Data, t.field)
+	for k, v := range obj {
+		rec.Data[t.prefix+k] = v
+	}
+	return nil
+}
+
+type unwrap struct {
+	field string
+	key   string
+}
+
+func newUnwrap(cfg *config.TransformConfig) (t Transformer, err error) {
+	if cfg.Field == "" {
+		err = errors.Newf("%s requires field", cfg.Type)
+		return
+	}
+	key := cfg.Key
+	if key == "" {
+		key = "value"
+	}
+	return &unwrap{field: cfg.Field, key: key}, nil
+}
+
+func (t *unwrap) Transform(rec *Record) error {
+	obj, ok := rec.Data[t.field].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if v, ok := obj[t.key]; ok {
+		rec.Data[t.field] = v
+	}
+	return nil
+}
+
+type drop struct {
+	fields []string
+}
+
+func newDrop(cfg *config.TransformConfig) (t Transformer, err error) {
+	fields := cfg.Fields
+	if cfg.Field != "" {
+		fields = append(fields, cfg.Field)
+	}
+	if len(fields) == 0 {
+		err = errors.Newf("%s requires fields", cfg.Type)
+		return
+	}
+	return &drop{fields: fields}, nil
+}
+
+func (t *drop) Transform(rec *Record) error {
+	for _, f := range t.fields {
+		delete(rec.Data, f)
+	}
+	return nil
+}
+
+type regexExtract struct {
+	field string
+	re    *regexp.Regexp
+	names []string
+}
+
+func newRegexExtract(cfg *config.TransformConfig) (t Transformer, err error) {
+	if cfg.Field == "" || cfg.Pattern == "" {
+		err = errors.Newf("%s requires field and pattern", cfg.Type)
+		return
+	}
+	var re *regexp.Regexp
+	if re, err = regexp.Compile(cfg.Pattern); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	var named bool
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			named = true
+			break
+		}
+	}
+	if !named {
+		err = errors.Newf("%s pattern %q has no named group", cfg.Type, cfg.Pattern)
+		return
+	}
+	return &regexExtract{field: cfg.Field, re: re, names: re.SubexpNames()}, nil
+}
+
+func (t *regexExtract) Transform(rec *Record) error {
+	s, ok := rec.Data[t.field].(string)
+	if !ok {
+		return nil
+	}
+	match := t.re.FindStringSubmatch(s)
+	if match == nil {
+		return nil
+	}
+	for i, name := range t.names {
+		if name != "" && i < len(match) {
+			rec.Data[name] = match[i]
+		}
+	}
+	return nil
+}
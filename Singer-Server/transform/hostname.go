@@ -0,0 +1,86 @@
+package transform
+
+import (
+	"strings"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/thanos-io/thanos/pkg/errors"
+)
+
+const (
+	HostSourceField  = "field"
+	HostSourceKey    = "key"
+	HostSourceHeader = "header"
+	HostSourceStatic = "static"
+
+	UnknownHost = "unknown"
+)
+
+var _ Transformer = (*HostResolver)(nil)
+
+type hostSource struct {
+	typ  string
+	name string
+}
+
+// HostResolver attributes a record to the host which produced it.
+type HostResolver struct {
+	field   string
+	sources []hostSource
+}
+
+func NewHostResolver(cfg *config.HostnameConfig) (h *HostResolver, err error) {
+	h = &HostResolver{field: cfg.Field}
+	if h.field == "" {
+		h.field = "hostname"
+	}
+	for _, spec := range cfg.Sources {
+		typ, name, _ := strings.Cut(spec, ":")
+		switch typ {
+		case HostSourceKey:
+		case HostSourceField, HostSourceHeader, HostSourceStatic:
+			if name == "" {
+				err = errors.Newf("hostname source %q requires a name", spec)
+				return
+			}
+		default:
+			err = errors.Newf("unknown hostname source %q", spec)
+			return
+		}
+		h.sources = append(h.sources, hostSource{typ: typ, name: name})
+	}
+	if len(h.sources) == 0 {
+		h.sources = []hostSource{{typ: HostSourceField, name: h.field}}
+	}
+	return
+}
+
+func (h *HostResolver) Transform(rec *Record) error {
+	rec.Data[h.field] = h.Resolve(rec)
+	return nil
+}
+
+// Resolve returns the hostname from the first source which has one.
+func (h *HostResolver) Resolve(rec *Record) string {
+	for _, src := range h.sources {
+		var host string
+		switch src.typ {
+		case HostSourceField:
+			if s, ok := rec.Data[src.name].(string); ok {
+				host = s
+			}
+		case HostSourceKey:
+			host = string(rec.Key)
+		case HostSourceHeader:
+			if v, ok := rec.Header(src.name); ok {
+				host = string(v)
+			}
+		case HostSourceStatic:
+			host = src.name
+		}
+		if host = strings.TrimSpace(host); host != "" {
+			return host
+		}
+	}
+	return UnknownHost
+}
@@ -0,0 +1,133 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/thanos-io/thanos/pkg/errors"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+const (
+	TypeAddField     = "add_field"
+	TypeRename       = "rename"
+	TypeFlatten      = "flatten"
+	TypeUnwrap       = "unwrap"
+	TypeDrop         = "drop"
+	TypeRegexExtract = "regex_extract"
+)
+
+// Record is the decoded form of a Kafka record which transformers operate on.
+type Record struct {
+	Topic   string
+	Key     []byte
+	Headers []kgo.RecordHeader
+	Data    map[string]interface{}
+}
+
+// Header returns the value of the first header with the given key.
+func (r *Record) Header(key string) (val []byte, ok bool) {
+	for _, h := range r.Headers {
+		if h.Key == key {
+			return h.Value, true
+		}
+	}
+	return
+}
+
+type Transformer interface {
+	Transform(rec *Record) error
+}
+
+// Chain runs a task's transformers in order.
+type Chain struct {
+	steps []Transformer
+}
+
+// NewChain builds the transform chain of a task, followed by its hostname resolver and classifier.
+// It returns a nil Chain if the task has nothing configured, so that records can be passed through untouched.
+func NewChain(taskCfg *config.TaskConfig) (c *Chain, err error) {
+	var steps []Transformer
+	for i := range taskCfg.Transforms {
+		var t Transformer
+		if t, err = newTransformer(&taskCfg.Transforms[i]); err != nil {
+			err = errors.Wrapf(err, "task %s, transform #%d", taskCfg.Name, i)
+			return
+		}
+		steps = append(steps, t)
+	}
+	if taskCfg.Hostname != nil {
+		var h *HostResolver
+		if h, err = NewHostResolver(taskCfg.Hostname); err != nil {
+			err = errors.Wrapf(err, "task %s", taskCfg.Name)
+			return
+		}
+		steps = append(steps, h)
+	}
+	if taskCfg.Classifier != nil {
+		var cl *Classifier
+		if cl, err = NewClassifier(taskCfg.Name, taskCfg.Classifier); err != nil {
+			err = errors.Wrapf(err, "task %s", taskCfg.Name)
+			return
+		}
+		steps = append(steps, cl)
+	}
+	if len(steps) == 0 {
+		return
+	}
+	c = &Chain{steps: steps}
+	return
+}
+
+func newTransformer(cfg *config.TransformConfig) (t Transformer, err error) {
+	switch cfg.Type {
+	case TypeAddField:
+		return newAddField(cfg)
+	case TypeRename:
+		return newRename(cfg)
+	case TypeFlatten:
+		return newFlatten(cfg)
+	case TypeUnwrap:
+		return newUnwrap(cfg)
+	case TypeDrop:
+		return newDrop(cfg)
+	case TypeRegexExtract:
+		return newRegexExtract(cfg)
+	default:
+		err = errors.Newf("unknown transform type %q", cfg.Type)
+	}
+	return
+}
+
+// Process decodes the record value as a JSON object, runs every step of the chain and returns the re-encoded value.
+func (c *Chain) Process(rec *kgo.Record) (value []byte, err error) {
+	if c == nil {
+		return rec.Value, nil
+	}
+	r := &Record{
+		Topic:   rec.Topic,
+		Key:     rec.Key,
+		Headers: rec.Headers,
+	}
+	dec := json.NewDecoder(bytes.NewReader(rec.Value))
+	// keep integers as they are, float64 can't hold every int64
+	dec.UseNumber()
+	if err = dec.Decode(&r.Data); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if r.Data == nil {
+		err = errors.Newf("record value is not a JSON object")
+		return
+	}
+	for _, step := range c.steps {
+		if err = step.Transform(r); err != nil {
+			return
+		}
+	}
+	if value, err = json.Marshal(r.Data); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
@@ -0,0 +1,218 @@
+package transform
+
+import (
+	"testing"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestChain(t *testing.T) {
+	tests := []struct {
+		name    string
+		task    config.TaskConfig
+		rec     kgo.Record
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "nothing configured",
+			rec:  kgo.Record{Value: []byte(`not json`)},
+			want: `not json`,
+		},
+		{
+			name: "field steps in order",
+			task: config.TaskConfig{Transforms: []config.TransformConfig{
+				{Type: TypeAddField, Field: "env", Value: "prod"},
+				{Type: TypeRename, Field: "msg", Target: "message"},
+				{Type: TypeRename, Field: "absent", Target: "ignored"},
+				{Type: TypeFlatten, Field: "http", Prefix: "http_"},
+				{Type: TypeUnwrap, Field: "user"},
+				{Type: TypeUnwrap, Field: "trace", Key: "id"},
+				{Type: TypeDrop, Field: "debug", Fields: []string{"tmp"}},
+			}},
+			rec:  kgo.Record{Value: []byte(`{"msg":"hi","http":{"status":200,"path":"/"},"user":{"value":"ann"},"trace":{"id":"t1","x":1},"debug":true,"tmp":0}`)},
+			want: `{"env":"prod","message":"hi","http_status":200,"http_path":"/","user":"ann","trace":"t1"}`,
+		},
+		{
+			name: "steps skip fields of another type",
+			task: config.TaskConfig{Transforms: []config.TransformConfig{
+				{Type: TypeFlatten, Field: "a"},
+				{Type: TypeUnwrap, Field: "b"},
+				{Type: TypeRegexExtract, Field: "c", Pattern: `(?P<d>\d+)`},
+			}},
+			rec:  kgo.Record{Value: []byte(`{"a":"x","b":[1],"c":7}`)},
+			want: `{"a":"x","b":[1],"c":7}`,
+		},
+		{
+			name: "regex extract",
+			task: config.TaskConfig{Transforms: []config.TransformConfig{
+				{Type: TypeRegexExtract, Field: "line", Pattern: `^(?P<method>[A-Z]+) (?P<path>\S+)(?: (?P<proto>\S+))?`},
+				{Type: TypeRegexExtract, Field: "line", Pattern: `(?P<never>^$)`},
+			}},
+			rec:  kgo.Record{Value: []byte(`{"line":"GET /index.html"}`)},
+			want: `{"line":"GET /index.html","method":"GET","path":"/index.html","proto":""}`,
+		},
+		{
+			name: "integers keep their precision",
+			task: config.TaskConfig{Transforms: []config.TransformConfig{{Type: TypeAddField, Field: "a", Value: 1}}},
+			rec:  kgo.Record{Value: []byte(`{"id":9007199254740993,"f":0.1}`)},
+			want: `{"id":9007199254740993,"f":0.1,"a":1}`,
+		},
+		{
+			name: "hostname from the first source that has one",
+			task: config.TaskConfig{Hostname: &config.HostnameConfig{Sources: []string{"field:host", "header:host", "key"}}},
+			rec: kgo.Record{
+				Key:     []byte("from-key"),
+				Headers: []kgo.RecordHeader{{Key: "host", Value: []byte(" ")}},
+				Value:   []byte(`{"host":""}`),
+			},
+			want: `{"host":"","hostname":"from-key"}`,
+		},
+		{
+			name: "hostname defaults to its own field",
+			task: config.TaskConfig{Hostname: &config.HostnameConfig{Field: "host"}},
+			rec:  kgo.Record{Value: []byte(`{"host":" web01 "}`)},
+			want: `{"host":"web01"}`,
+		},
+		{
+			name: "unknown hostname",
+			task: config.TaskConfig{Hostname: &config.HostnameConfig{Sources: []string{"header:host"}}},
+			rec:  kgo.Record{Value: []byte(`{}`)},
+			want: `{"hostname":"unknown"}`,
+		},
+		{
+			name: "static hostname",
+			task: config.TaskConfig{Hostname: &config.HostnameConfig{Sources: []string{"field:host", "static:edge"}}},
+			rec:  kgo.Record{Value: []byte(`{}`)},
+			want: `{"hostname":"edge"}`,
+		},
+		{
+			name: "classifier after the transforms",
+			task: config.TaskConfig{
+				Transforms: []config.TransformConfig{{Type: TypeRename, Field: "msg", Target: "message"}},
+				Classifier: &config.ClassifierConfig{},
+			},
+			rec:  kgo.Record{Value: []byte(`{"msg":"connection failed"}`)},
+			want: `{"message":"connection failed","log_level":"error"}`,
+		},
+		{
+			name:    "value not an object",
+			task:    config.TaskConfig{Classifier: &config.ClassifierConfig{}},
+			rec:     kgo.Record{Value: []byte(`[1]`)},
+			wantErr: true,
+		},
+		{
+			name:    "invalid json",
+			task:    config.TaskConfig{Classifier: &config.ClassifierConfig{}},
+			rec:     kgo.Record{Value: []byte(`{"a":`)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.task.Name = "test"
+			c, err := NewChain(&tt.task)
+			require.NoError(t, err)
+			value, err := c.Process(&tt.rec)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if c == nil {
+				assert.Equal(t, tt.want, string(value))
+				return
+			}
+			assert.JSONEq(t, tt.want, string(value))
+		})
+	}
+}
+
+func TestNewChainErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		task config.TaskConfig
+	}{
+		{name: "unknown type", task: config.TaskConfig{Transforms: []config.TransformConfig{{Type: "upper", Field: "a"}}}},
+		{name: "add_field without field", task: config.TaskConfig{Transforms: []config.TransformConfig{{Type: TypeAddField, Value: 1}}}},
+		{name: "rename without target", task: config.TaskConfig{Transforms: []config.TransformConfig{{Type: TypeRename, Field: "a"}}}},
+		{name: "flatten without field", task: config.TaskConfig{Transforms: []config.TransformConfig{{Type: TypeFlatten}}}},
+		{name: "unwrap without field", task: config.TaskConfig{Transforms: []config.TransformConfig{{Type: TypeUnwrap, Key: "a"}}}},
+		{name: "drop without fields", task: config.TaskConfig{Transforms: []config.TransformConfig{{Type: TypeDrop}}}},
+		{name: "invalid regexp", task: config.TaskConfig{Transforms: []config.TransformConfig{{Type: TypeRegexExtract, Field: "a", Pattern: `(?P<x>`}}}},
+		{name: "regexp without named group", task: config.TaskConfig{Transforms: []config.TransformConfig{{Type: TypeRegexExtract, Field: "a", Pattern: `(\d+)`}}}},
+		{name: "unknown hostname source", task: config.TaskConfig{Hostname: &config.HostnameConfig{Sources: []string{"dns"}}}},
+		{name: "hostname header without name", task: config.TaskConfig{Hostname: &config.HostnameConfig{Sources: []string{"header"}}}},
+		{name: "classifier rule without level", task: config.TaskConfig{Classifier: &config.ClassifierConfig{Rules: []config.ClassifierRule{{Pattern: "x"}}}}},
+		{name: "invalid classifier rule", task: config.TaskConfig{Classifier: &config.ClassifierConfig{Rules: []config.ClassifierRule{{Level: LevelError, Pattern: "("}}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewChain(&tt.task)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.ClassifierConfig
+		data map[string]interface{}
+		want string
+	}{
+		{name: "default rules", data: map[string]interface{}{"message": "WARNING: disk 90% full"}, want: LevelWarn},
+		{name: "most severe rule first", data: map[string]interface{}{"message": "debug: panic recovered"}, want: LevelFatal},
+		{name: "no rule matches", data: map[string]interface{}{"message": "started"}, want: LevelInfo},
+		{name: "own default", cfg: config.ClassifierConfig{Default: LevelDebug}, data: map[string]interface{}{}, want: LevelDebug},
+		{
+			name: "syslog PRI",
+			cfg:  config.ClassifierConfig{Syslog: true},
+			data: map[string]interface{}{"message": "<11>Oct 11 22:14:15 host app: all good"},
+			want: LevelError,
+		},
+		{
+			name: "invalid syslog PRI",
+			cfg:  config.ClassifierConfig{Syslog: true},
+			data: map[string]interface{}{"message": "<192>fine"},
+			want: LevelInfo,
+		},
+		{
+			name: "http status before rules",
+			cfg:  config.ClassifierConfig{StatusField: "status"},
+			data: map[string]interface{}{"status": "404", "message": "error page"},
+			want: LevelWarn,
+		},
+		{
+			name: "http status of a decoded number",
+			cfg:  config.ClassifierConfig{StatusField: "status"},
+			data: map[string]interface{}{"status": 503.0},
+			want: LevelError,
+		},
+		{
+			name: "not an http status",
+			cfg:  config.ClassifierConfig{StatusField: "status"},
+			data: map[string]interface{}{"status": "42", "message": "exception"},
+			want: LevelError,
+		},
+		{
+			name: "own rules and fields",
+			cfg: config.ClassifierConfig{
+				Source: "text",
+				Rules:  []config.ClassifierRule{{Level: "audit", Pattern: `^AUDIT`}},
+			},
+			data: map[string]interface{}{"text": "AUDIT login", "message": "error"},
+			want: "audit",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewClassifier("test", &tt.cfg)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, c.Classify(tt.data))
+		})
+	}
+}